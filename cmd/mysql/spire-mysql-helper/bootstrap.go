@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/rturner3/spire-mysql-demo/pkg/common"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// runBootstrap waits for the MySQL server SVID, writes it to disk along with
+// the readiness marker and exits, so that MySQL never starts without
+// certificates.
+func runBootstrap(ctx context.Context, c *config) error {
+	client, err := c.bootstrap.NewWorkloadAPIClient(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to create workload API client: %w", err)
+	}
+	defer client.Close()
+
+	return bootstrap(ctx, c, client)
+}
+
+func bootstrap(ctx context.Context, c *config, client *workloadapi.Client) error {
+	// Remove a stale marker so that a failed bootstrap is never reported as ready
+	if err := os.Remove(c.readyFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("unable to remove stale readiness marker: %w", err)
+	}
+
+	x509Context, err := fetchServerSVID(ctx, c, client)
+	if err != nil {
+		return err
+	}
+
+	if err := writeSVIDFiles(c, x509Context); err != nil {
+		return err
+	}
+
+	if err := writeReadyFile(c.readyFile); err != nil {
+		return fmt.Errorf("failed to write readiness marker: %w", err)
+	}
+	log.Printf("Readiness marker written to %s", c.readyFile)
+	return nil
+}
+
+// fetchServerSVID waits up to the configured timeout for an X.509 context
+// with the MySQL server SVID.
+func fetchServerSVID(ctx context.Context, c *config, client *workloadapi.Client) (*workloadapi.X509Context, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	return waitForServerSVID(ctx, client)
+}
+
+// writeSVIDFiles logs the SVIDs and writes the MySQL server SVID files.
+func writeSVIDFiles(c *config, x509Context *workloadapi.X509Context) error {
+	if err := common.LogSVIDs(x509Context); err != nil {
+		return fmt.Errorf("failed to log SVIDs: %w", err)
+	}
+
+	if err := common.WriteMySQLServerSVIDFilesToDir(x509Context, c.svidDir); err != nil {
+		ready.Store(false)
+		return fmt.Errorf("failed to write SVID/Bundle to disk: %w", err)
+	}
+	ready.Store(true)
+	log.Printf("SVID/Bundle files written successfully to %s", c.svidDir)
+	return nil
+}
+
+// waitForServerSVID watches the Workload API until it serves an X.509 context
+// with the MySQL server SVID. The watch retries on errors, e.g. while the SPIRE
+// agent is starting or the registration entry hasn't propagated yet, until ctx
+// is done.
+func waitForServerSVID(ctx context.Context, client *workloadapi.Client) (*workloadapi.X509Context, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	watcher := &serverSVIDWatcher{found: make(chan *workloadapi.X509Context, 1)}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- client.WatchX509Context(ctx, watcher)
+	}()
+
+	select {
+	case x509Context := <-watcher.found:
+		return x509Context, nil
+	case err := <-errCh:
+		if ctx.Err() != nil || status.Code(err) == codes.Canceled || status.Code(err) == codes.DeadlineExceeded {
+			return nil, fmt.Errorf("timed out waiting for an X.509-SVID with the MySQL server hint: %w", ctx.Err())
+		}
+		return nil, fmt.Errorf("error watching X.509 context: %w", err)
+	}
+}
+
+// serverSVIDWatcher signals the first X.509 context containing the MySQL server SVID.
+type serverSVIDWatcher struct {
+	found chan *workloadapi.X509Context
+}
+
+// OnX509ContextUpdate is run every time an SVID is updated
+func (w *serverSVIDWatcher) OnX509ContextUpdate(c *workloadapi.X509Context) {
+	if !common.HasMySQLServerSVID(c) {
+		log.Printf("Waiting for an X.509-SVID with the MySQL server hint; received %d SVID(s)", len(c.SVIDs))
+		return
+	}
+
+	select {
+	case w.found <- c:
+	default:
+	}
+}
+
+// OnX509ContextWatchError is run when the client runs into an error
+func (w *serverSVIDWatcher) OnX509ContextWatchError(err error) {
+	if status.Code(err) != codes.Canceled {
+		log.Printf("Waiting for X.509 context: %v", err)
+	}
+}
+
+// writeReadyFile atomically writes the readiness marker, containing the time
+// the SVID files were written.
+func writeReadyFile(path string) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(time.Now().UTC().Format(time.RFC3339)+"\n"), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
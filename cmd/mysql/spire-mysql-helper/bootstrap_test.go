@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rturner3/spire-mysql-demo/pkg/test/fakeworkloadapi"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+)
+
+var (
+	td             = spiffeid.RequireTrustDomainFromString("example.org")
+	serverIdentity = fakeworkloadapi.Identity{ID: spiffeid.RequireFromPath(td, "/mysql/server"), Hint: "mysql-server"}
+	clientIdentity = fakeworkloadapi.Identity{ID: spiffeid.RequireFromPath(td, "/mysql/client/tls-reloader"), Hint: "mysql-client"}
+)
+
+func TestBootstrapWaitsForServerSVID(t *testing.T) {
+	// The registration entry for the MySQL server hasn't propagated yet
+	api := fakeworkloadapi.New(t, fakeworkloadapi.NewCA(t, td), clientIdentity)
+	c := newConfig(t, api, "-timeout", "10s")
+
+	time.AfterFunc(100*time.Millisecond, func() {
+		api.SetIdentities(serverIdentity, clientIdentity)
+	})
+
+	if err := runBootstrap(context.Background(), c); err != nil {
+		t.Fatalf("bootstrap failed: %v", err)
+	}
+
+	for _, name := range []string{"svid.0.pem", "svid.0.key", "bundle.0.pem", readyFileName} {
+		if _, err := os.Stat(filepath.Join(c.svidDir, name)); err != nil {
+			t.Fatalf("expected %s to be written: %v", name, err)
+		}
+	}
+	if !ready.Load() {
+		t.Fatal("expected to be ready after bootstrap")
+	}
+}
+
+func TestBootstrapTimesOutWithoutServerSVID(t *testing.T) {
+	api := fakeworkloadapi.New(t, fakeworkloadapi.NewCA(t, td), clientIdentity)
+	c := newConfig(t, api, "-timeout", "200ms")
+
+	// A marker left behind by a previous run must not survive a failed bootstrap
+	if err := os.WriteFile(c.readyFile, nil, 0o644); err != nil {
+		t.Fatalf("failed to write stale marker: %v", err)
+	}
+
+	if err := runBootstrap(context.Background(), c); err == nil {
+		t.Fatal("expected bootstrap to time out")
+	}
+	if _, err := os.Stat(c.readyFile); !os.IsNotExist(err) {
+		t.Fatalf("expected no readiness marker; got %v", err)
+	}
+}
+
+func newConfig(t *testing.T, api *fakeworkloadapi.WorkloadAPI, args ...string) *config {
+	svidDir := t.TempDir()
+	c := new(config)
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	c.registerFlags(fs)
+	args = append([]string{"-workload-api-addr", api.Addr(), "-svid-dir", svidDir}, args...)
+	if err := fs.Parse(args); err != nil {
+		t.Fatalf("failed to parse flags: %v", err)
+	}
+	c.readyFile = filepath.Join(svidDir, readyFileName)
+	return c
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// ready is set once the SVID files are in place and cleared when writing
+// them fails, so that /ready reflects whether MySQL has usable certificates.
+var ready atomic.Bool
+
+// newHealthServer returns a server for liveness and readiness checks on addr.
+func newHealthServer(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/live", func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/ready", func(w http.ResponseWriter, _ *http.Request) {
+		if !ready.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	return &http.Server{Addr: addr, Handler: mux}
+}
@@ -0,0 +1,83 @@
+// spire-mysql-helper keeps the MySQL server TLS configuration in sync with the
+// X.509-SVIDs issued by SPIRE. It runs in the MySQL pod in one of these modes:
+//
+//	bootstrap  wait for the MySQL server SVID, write it to disk and exit (init container)
+//	reload     watch for SVID updates, write them to disk and reload MySQL TLS (sidecar container)
+//	oneshot    write the current SVID to disk, reload MySQL TLS once and exit
+//	sidecar    bootstrap, then keep watching like reload (native Kubernetes sidecar container)
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rturner3/spire-mysql-demo/pkg/command"
+	"github.com/rturner3/spire-mysql-demo/pkg/common"
+)
+
+const (
+	// defaultTimeout bounds how long to wait for the MySQL server SVID before failing
+	defaultTimeout = 2 * time.Minute
+
+	// readyFileName is the readiness marker written next to the SVID files
+	readyFileName = "ready"
+)
+
+// config is shared by all modes.
+type config struct {
+	bootstrap  command.Bootstrap
+	svidDir    string
+	timeout    time.Duration
+	readyFile  string
+	healthAddr string
+}
+
+var modes = map[string]func(context.Context, *config) error{
+	"bootstrap": runBootstrap,
+	"reload":    runReload,
+	"oneshot":   runOneshot,
+	"sidecar":   runSidecar,
+}
+
+func main() {
+	if len(os.Args) < 2 || modes[os.Args[1]] == nil {
+		fmt.Fprintf(os.Stderr, "Usage: %s bootstrap|reload|oneshot|sidecar [flags]\n", filepath.Base(os.Args[0]))
+		os.Exit(2)
+	}
+	mode := os.Args[1]
+
+	fs := flag.NewFlagSet(mode, flag.ExitOnError)
+	c := new(config)
+	lifecycle := command.NewLifecycle()
+	c.registerFlags(fs)
+	lifecycle.RegisterFlags(fs)
+	_ = fs.Parse(os.Args[2:])
+	if c.readyFile == "" {
+		c.readyFile = filepath.Join(c.svidDir, readyFileName)
+	}
+
+	log.SetPrefix(fmt.Sprintf("[%s] ", mode))
+
+	// Runs until the mode finishes or SIGINT or SIGTERM is received
+	os.Exit(lifecycle.Run(func(ctx context.Context) error {
+		if c.healthAddr != "" {
+			if err := lifecycle.ServeHTTP("health checks", newHealthServer(c.healthAddr)); err != nil {
+				return err
+			}
+		}
+		return modes[mode](ctx, c)
+	}))
+}
+
+func (c *config) registerFlags(fs *flag.FlagSet) {
+	c.bootstrap.RegisterFlags(fs)
+	fs.StringVar(&c.svidDir, "svid-dir", common.SVIDDir(), "Directory the MySQL server SVID files are written to")
+	fs.DurationVar(&c.timeout, "timeout", defaultTimeout, "How long to wait for an X.509-SVID with the mysql-server hint")
+	fs.StringVar(&c.readyFile, "ready-file", "", "Readiness marker written once the SVID files are in place (defaults to 'ready' in the SVID directory)")
+	fs.StringVar(&c.healthAddr, "health-addr", "", "Address to serve /live and /ready health checks on, e.g. :8080 (disabled if empty)")
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/rturner3/spire-mysql-demo/pkg/common"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// MySQL related constants
+	mysqlUser           = "mysql-tls-reloader"
+	mysqlClientSVIDHint = "mysql-client"
+	reloadTLSQuery      = "ALTER INSTANCE RELOAD TLS"
+)
+
+// runReload watches for SVID updates, writing each to disk and reloading the
+// MySQL TLS configuration, until ctx is cancelled.
+func runReload(ctx context.Context, c *config) error {
+	client, err := c.bootstrap.NewWorkloadAPIClient(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to create workload API client: %w", err)
+	}
+	defer client.Close()
+
+	return watch(ctx, c, client)
+}
+
+// runOneshot writes the current SVID to disk and reloads the MySQL TLS
+// configuration once, e.g. to force a rotation by hand.
+func runOneshot(ctx context.Context, c *config) error {
+	client, err := c.bootstrap.NewWorkloadAPIClient(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to create workload API client: %w", err)
+	}
+	defer client.Close()
+
+	x509Context, err := fetchServerSVID(ctx, c, client)
+	if err != nil {
+		return err
+	}
+	if err := writeSVIDFiles(c, x509Context); err != nil {
+		return err
+	}
+	return reloadTLS(ctx, x509Context)
+}
+
+// runSidecar bootstraps the SVID files, then keeps them up to date like
+// reload. The readiness marker lets a native Kubernetes sidecar container's
+// startup probe hold back MySQL until certificates are in place.
+func runSidecar(ctx context.Context, c *config) error {
+	client, err := c.bootstrap.NewWorkloadAPIClient(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to create workload API client: %w", err)
+	}
+	defer client.Close()
+
+	if err := bootstrap(ctx, c, client); err != nil {
+		return err
+	}
+	return watch(ctx, c, client)
+}
+
+func watch(ctx context.Context, c *config, client *workloadapi.Client) error {
+	// Start a watcher for X.509 SVID updates
+	err := client.WatchX509Context(ctx, &x509Watcher{ctx: ctx, c: c})
+	if err != nil && status.Code(err) != codes.Canceled {
+		return fmt.Errorf("error watching X.509 context: %w", err)
+	}
+	return nil
+}
+
+// reloadTLS makes MySQL reload its TLS configuration from disk, connecting
+// with the MySQL client SVID.
+func reloadTLS(ctx context.Context, c *workloadapi.X509Context) error {
+	db, err := common.NewMySQLDBWithSPIRETLSConfig(c, mysqlUser, "", mysqlClientSVIDHint)
+	if err != nil {
+		return fmt.Errorf("failed to create MySQL client: %w", err)
+	}
+	defer db.Close()
+
+	if _, err := db.ExecContext(ctx, reloadTLSQuery); err != nil {
+		return fmt.Errorf("failed to run reload TLS query: %w", err)
+	}
+
+	log.Printf("Successfully reloaded MySQL TLS config")
+	return nil
+}
+
+// x509Watcher implements the workloadapi.X509ContextWatcher interface
+type x509Watcher struct {
+	// ctx is the context of the watch, so that reloads stop with it
+	ctx context.Context
+	c   *config
+}
+
+// OnX509ContextUpdate is run every time an SVID is updated
+func (w *x509Watcher) OnX509ContextUpdate(c *workloadapi.X509Context) {
+	if err := writeSVIDFiles(w.c, c); err != nil {
+		log.Printf("%v", err)
+		return
+	}
+
+	if err := reloadTLS(w.ctx, c); err != nil {
+		log.Printf("%v", err)
+	}
+}
+
+// OnX509ContextWatchError is run when the client runs into an error
+func (w *x509Watcher) OnX509ContextWatchError(err error) {
+	if status.Code(err) != codes.Canceled {
+		log.Printf("OnX509ContextWatchError error: %v", err)
+	}
+}
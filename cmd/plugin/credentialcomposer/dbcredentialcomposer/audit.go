@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	credentialcomposerv1 "github.com/spiffe/spire-plugin-sdk/proto/spire/plugin/server/credentialcomposer/v1"
+)
+
+const (
+	defaultAuditDedupWindow    = time.Hour
+	defaultAuditLogMaxSizeMB   = 100
+	defaultAuditLogMaxBackups  = 3
+	auditRuleOverride          = "override"
+	auditRulePathPrefixPattern = "path_prefix:%s"
+)
+
+// auditEvent records which MySQL-facing subject was composed for a SPIFFE ID.
+type auditEvent struct {
+	Time     time.Time `json:"time"`
+	SPIFFEID string    `json:"spiffe_id"`
+	Rule     string    `json:"rule"`
+	Subject  string    `json:"subject"`
+}
+
+// auditor emits an audit event for every composed subject through the plugin
+// logger and, optionally, to a rotating JSON-lines file. Identical events are
+// only emitted once per dedup window so that steady-state SVID rotations don't
+// flood the audit trail.
+type auditor struct {
+	log         hclog.Logger
+	file        *rotatingFile
+	dedupWindow time.Duration
+	now         func() time.Time
+
+	mu        sync.Mutex
+	lastSeen  map[auditEvent]time.Time
+	lastPrune time.Time
+}
+
+func newAuditor(log hclog.Logger, file *rotatingFile, dedupWindow time.Duration) *auditor {
+	return &auditor{
+		log:         log,
+		file:        file,
+		dedupWindow: dedupWindow,
+		now:         time.Now,
+		lastSeen:    make(map[auditEvent]time.Time),
+	}
+}
+
+// newConfigAuditor creates the auditor described by the configuration. The
+// audit log file of the previous auditor, if any, is shared when the path is
+// unchanged, rather than opened a second time, and the events it emitted are
+// carried over so that reconfiguring doesn't emit them again within the dedup
+// window.
+func newConfigAuditor(config *Config, prev *auditor, log hclog.Logger) (*auditor, error) {
+	dedupWindow := defaultAuditDedupWindow
+	if config.auditDedupWindow != nil {
+		dedupWindow = *config.auditDedupWindow
+	}
+
+	var file *rotatingFile
+	if config.AuditLogFile != "" {
+		maxSizeMB := config.AuditLogMaxSizeMB
+		if maxSizeMB == 0 {
+			maxSizeMB = defaultAuditLogMaxSizeMB
+		}
+		maxBackups := config.AuditLogMaxBackups
+		if maxBackups == 0 {
+			maxBackups = defaultAuditLogMaxBackups
+		}
+
+		if prev != nil && prev.file != nil && prev.file.path == config.AuditLogFile && prev.file.retain(int64(maxSizeMB)<<20, maxBackups) {
+			file = prev.file
+		} else {
+			var err error
+			file, err = openRotatingFile(config.AuditLogFile, int64(maxSizeMB)<<20, maxBackups)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	a := newAuditor(log.Named("audit"), file, dedupWindow)
+	a.carryDedup(prev)
+	return a, nil
+}
+
+// carryDedup copies the events emitted by the previous auditor, if any.
+func (a *auditor) carryDedup(prev *auditor) {
+	if prev == nil {
+		return
+	}
+	prev.mu.Lock()
+	defer prev.mu.Unlock()
+	for key, seen := range prev.lastSeen {
+		a.lastSeen[key] = seen
+	}
+	a.lastPrune = prev.lastPrune
+}
+
+// record emits an audit event for the subject composed for the SPIFFE ID by
+// the given rule, unless an identical event was emitted within the dedup window.
+func (a *auditor) record(spiffeID, rule string, subject *credentialcomposerv1.DistinguishedName) {
+	if a == nil {
+		return
+	}
+
+	now := a.now()
+	// The dedup key leaves the time unset so that identical events compare equal
+	key := auditEvent{SPIFFEID: spiffeID, Rule: rule, Subject: formatSubject(subject)}
+	if !a.shouldEmit(key, now) {
+		return
+	}
+
+	event := key
+	event.Time = now.UTC()
+	a.log.Info("Composed X509-SVID subject", "spiffe_id", event.SPIFFEID, "rule", event.Rule, "subject", event.Subject, "time", event.Time.Format(time.RFC3339Nano))
+
+	if a.file == nil {
+		return
+	}
+	line, err := json.Marshal(event)
+	if err != nil {
+		a.log.Error("Failed to marshal audit event", "error", err)
+		return
+	}
+	if err := a.file.writeLine(line); err != nil {
+		a.log.Error("Failed to write audit event", "path", a.file.path, "error", err)
+	}
+}
+
+func (a *auditor) shouldEmit(key auditEvent, now time.Time) bool {
+	if a.dedupWindow <= 0 {
+		return true
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if now.Sub(a.lastPrune) >= a.dedupWindow {
+		for k, seen := range a.lastSeen {
+			if now.Sub(seen) >= a.dedupWindow {
+				delete(a.lastSeen, k)
+			}
+		}
+		a.lastPrune = now
+	}
+
+	if seen, ok := a.lastSeen[key]; ok && now.Sub(seen) < a.dedupWindow {
+		return false
+	}
+	a.lastSeen[key] = now
+	return true
+}
+
+// close releases the audit log file, if any.
+func (a *auditor) close() {
+	if a == nil || a.file == nil {
+		return
+	}
+	if err := a.file.close(); err != nil {
+		a.log.Error("Failed to close audit log file", "path", a.file.path, "error", err)
+	}
+}
+
+// formatSubject formats the subject the way MySQL expects it in a
+// `REQUIRE SUBJECT` clause, e.g. /C=US/O=SPIRE/CN=spire-mysql-client.
+func formatSubject(subject *credentialcomposerv1.DistinguishedName) string {
+	var b strings.Builder
+	for _, attr := range []struct {
+		name   string
+		values []string
+	}{
+		{"C", subject.GetCountry()},
+		{"ST", subject.GetProvince()},
+		{"L", subject.GetLocality()},
+		{"O", subject.GetOrganization()},
+		{"OU", subject.GetOrganizationalUnit()},
+	} {
+		for _, value := range attr.values {
+			fmt.Fprintf(&b, "/%s=%s", attr.name, value)
+		}
+	}
+	if cn := subject.GetCommonName(); cn != "" {
+		fmt.Fprintf(&b, "/CN=%s", cn)
+	}
+	return b.String()
+}
+
+// rotatingFile is an append-only file that is rotated once it grows past
+// maxSize, keeping at most maxBackups rotated files named <path>.1, <path>.2...
+// It's shared by the auditors of successive configurations with the same path,
+// and closed once all of them released it.
+type rotatingFile struct {
+	path string
+
+	mu         sync.Mutex
+	maxSize    int64
+	maxBackups int
+	// f is nil when a rotation failed to reopen the file, until it's reopened
+	f    *os.File
+	size int64
+	refs int
+
+	// openFile opens the file, replaced in tests
+	openFile func(name string, flag int, perm os.FileMode) (*os.File, error)
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	r := &rotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+		refs:       1,
+		openFile:   os.OpenFile,
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) writeLine(line []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.refs == 0 {
+		return os.ErrClosed
+	}
+	var rotateErr error
+	if r.f == nil || (r.size > 0 && r.size+int64(len(line))+1 > r.maxSize) {
+		rotateErr = r.rotate()
+		if r.f == nil {
+			return rotateErr
+		}
+	}
+
+	n, err := r.f.Write(append(line, '\n'))
+	r.size += int64(n)
+	return errors.Join(rotateErr, err)
+}
+
+// retain adds a reference to the file and applies the rotation limits of the
+// new configuration. It returns false if the file was already closed.
+func (r *rotatingFile) retain(maxSize int64, maxBackups int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.refs == 0 {
+		return false
+	}
+	r.refs++
+	r.maxSize = maxSize
+	r.maxBackups = maxBackups
+	return true
+}
+
+// close releases a reference to the file, closing it with the last one.
+func (r *rotatingFile) close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.refs--; r.refs > 0 || r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
+
+func (r *rotatingFile) open() error {
+	f, err := r.openFile(r.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f = f
+	r.size = info.Size()
+	return nil
+}
+
+// rotate moves the current file to <path>.1, shifting older backups and
+// dropping the oldest, and opens a new empty file at path. If the file is
+// already closed, because a previous rotation failed to reopen it, it's only
+// reopened.
+func (r *rotatingFile) rotate() error {
+	if r.f == nil {
+		return r.open()
+	}
+	closeErr := r.f.Close()
+	r.f = nil
+
+	// Always reopen the file so that a failed close or rename doesn't stop
+	// auditing
+	shiftErr := r.shiftBackups()
+	if err := r.open(); err != nil {
+		return err
+	}
+	return errors.Join(closeErr, shiftErr)
+}
+
+func (r *rotatingFile) shiftBackups() error {
+	for i := r.maxBackups - 1; i > 0; i-- {
+		if err := os.Rename(r.backupPath(i), r.backupPath(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(r.path, r.backupPath(1))
+}
+
+func (r *rotatingFile) backupPath(i int) string {
+	return fmt.Sprintf("%s.%d", r.path, i)
+}
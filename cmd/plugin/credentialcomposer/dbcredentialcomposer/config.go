@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/hcl"
+	"github.com/hashicorp/hcl/hcl/ast"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// knownConfigFields lists the top-level HCL keys understood by the plugin,
+// along with the keys understood inside them for blocks. Any other key is
+// rejected so that typos don't silently fall back to defaults.
+var knownConfigFields = map[string]map[string]struct{}{
+	"mysql_spiffe_id_path_prefixes": nil,
+	"overrides_file":                nil,
+	"overrides_poll_interval":       nil,
+	"audit_log_file":                nil,
+	"audit_log_max_size_mb":         nil,
+	"audit_log_max_backups":         nil,
+	"audit_dedup_window":            nil,
+	"ca_subject":                    knownSubjectFields,
+	"server_x509_svid_subject":      knownSubjectFields,
+}
+
+// parseConfig decodes and validates the HCL configuration. All problems found
+// are reported together in a single InvalidArgument error.
+func parseConfig(hclConfiguration string) (*Config, error) {
+	config, problems, err := decodeConfig(hclConfiguration)
+	if err != nil {
+		return nil, err
+	}
+	if len(problems) > 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid configuration: %s", strings.Join(problems, "; "))
+	}
+	return config, nil
+}
+
+// decodeConfig decodes the HCL configuration and returns it along with a
+// description of each validation problem. An error is only returned when the
+// configuration cannot be decoded at all.
+func decodeConfig(hclConfiguration string) (*Config, []string, error) {
+	root, err := hcl.Parse(hclConfiguration)
+	if err != nil {
+		return nil, nil, status.Errorf(codes.InvalidArgument, "failed to decode configuration: %v", err)
+	}
+
+	config := new(Config)
+	if err := hcl.DecodeObject(config, root); err != nil {
+		return nil, nil, status.Errorf(codes.InvalidArgument, "failed to decode configuration: %v", err)
+	}
+
+	problems := unknownFields(root)
+	problems = append(problems, config.validate()...)
+	return config, problems, nil
+}
+
+// validate checks the semantic constraints of the configuration and returns
+// a description of each violation.
+func (c *Config) validate() []string {
+	if len(c.MySQLSPIFFEIDPathPrefixes) == 0 {
+		return []string{"mysql_spiffe_id_path_prefixes must contain at least one prefix"}
+	}
+
+	var problems []string
+	seen := make(map[string]struct{}, len(c.MySQLSPIFFEIDPathPrefixes))
+	for _, prefix := range c.MySQLSPIFFEIDPathPrefixes {
+		if prefix == "" {
+			problems = append(problems, "mysql_spiffe_id_path_prefixes must not contain an empty prefix")
+			continue
+		}
+		if _, ok := seen[prefix]; ok {
+			problems = append(problems, fmt.Sprintf("prefix %q is duplicated", prefix))
+			continue
+		}
+		seen[prefix] = struct{}{}
+
+		if !strings.HasPrefix(prefix, "/") {
+			problems = append(problems, fmt.Sprintf("prefix %q must be an absolute path", prefix))
+		}
+	}
+
+	if c.OverridesPollInterval != "" {
+		interval, err := time.ParseDuration(c.OverridesPollInterval)
+		switch {
+		case err != nil:
+			problems = append(problems, fmt.Sprintf("overrides_poll_interval is malformed: %v", err))
+		case interval <= 0:
+			problems = append(problems, "overrides_poll_interval must be positive")
+		case c.OverridesFile == "":
+			problems = append(problems, "overrides_poll_interval requires overrides_file")
+		default:
+			c.overridesPollInterval = interval
+		}
+	}
+
+	if c.AuditLogMaxSizeMB < 0 {
+		problems = append(problems, "audit_log_max_size_mb must not be negative")
+	}
+	if c.AuditLogMaxBackups < 0 {
+		problems = append(problems, "audit_log_max_backups must not be negative")
+	}
+	if c.AuditDedupWindow != "" {
+		window, err := time.ParseDuration(c.AuditDedupWindow)
+		switch {
+		case err != nil:
+			problems = append(problems, fmt.Sprintf("audit_dedup_window is malformed: %v", err))
+		case window < 0:
+			problems = append(problems, "audit_dedup_window must not be negative")
+		default:
+			c.auditDedupWindow = &window
+		}
+	}
+
+	// Overlapping prefixes make the matched rule depend on list order, so
+	// require every prefix to be disjoint from the others.
+	prefixes := make([]string, 0, len(seen))
+	for prefix := range seen {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	for i, prefix := range prefixes {
+		for _, other := range prefixes[i+1:] {
+			if strings.HasPrefix(other, prefix) {
+				problems = append(problems, fmt.Sprintf("prefix %q overlaps with prefix %q", other, prefix))
+			}
+		}
+	}
+
+	return problems
+}
+
+// unknownFields returns a description of each key in the HCL document that is
+// not understood by the plugin.
+func unknownFields(root *ast.File) []string {
+	list, ok := root.Node.(*ast.ObjectList)
+	if !ok {
+		return nil
+	}
+
+	var problems []string
+	for _, item := range list.Items {
+		if len(item.Keys) == 0 {
+			continue
+		}
+		key, _ := item.Keys[0].Token.Value().(string)
+		children, ok := knownConfigFields[key]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("unknown field %q", key))
+			continue
+		}
+
+		block, ok := item.Val.(*ast.ObjectType)
+		if !ok || children == nil {
+			continue
+		}
+		for _, child := range block.List.Items {
+			if len(child.Keys) == 0 {
+				continue
+			}
+			childKey, _ := child.Keys[0].Token.Value().(string)
+			if _, ok := children[childKey]; !ok {
+				problems = append(problems, fmt.Sprintf("unknown field %q in %s", childKey, key))
+			}
+		}
+	}
+	return problems
+}
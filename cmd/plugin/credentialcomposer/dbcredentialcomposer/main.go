@@ -2,21 +2,71 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"strings"
 	"sync"
+	"time"
 
-	"github.com/hashicorp/hcl"
+	"github.com/hashicorp/go-hclog"
 	"github.com/spiffe/go-spiffe/v2/spiffeid"
 	"github.com/spiffe/spire-plugin-sdk/pluginmain"
 	credentialcomposerv1 "github.com/spiffe/spire-plugin-sdk/proto/spire/plugin/server/credentialcomposer/v1"
 	configv1 "github.com/spiffe/spire-plugin-sdk/proto/spire/service/common/config/v1"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 )
 
 // Config defines the configuration for the plugin.
 type Config struct {
 	MySQLSPIFFEIDPathPrefixes []string `hcl:"mysql_spiffe_id_path_prefixes"`
+
+	// OverridesFile is an optional path to a JSON file mapping SPIFFE IDs to
+	// a MySQL username or a full subject, replacing the derived subject.
+	OverridesFile string `hcl:"overrides_file"`
+
+	// OverridesPollInterval is how often the overrides file is checked for
+	// changes. Defaults to 10s.
+	OverridesPollInterval string `hcl:"overrides_poll_interval"`
+
+	// AuditLogFile is an optional path to a JSON-lines file that audit events
+	// are written to, in addition to the plugin logger.
+	AuditLogFile string `hcl:"audit_log_file"`
+
+	// AuditLogMaxSizeMB is the size at which the audit log file is rotated.
+	// Defaults to 100.
+	AuditLogMaxSizeMB int `hcl:"audit_log_max_size_mb"`
+
+	// AuditLogMaxBackups is the number of rotated audit log files to keep.
+	// Defaults to 3.
+	AuditLogMaxBackups int `hcl:"audit_log_max_backups"`
+
+	// AuditDedupWindow is the window within which identical audit events are
+	// only emitted once. Defaults to 1h; "0s" disables deduplication.
+	AuditDedupWindow string `hcl:"audit_dedup_window"`
+
+	// CASubject optionally sets the subject of the SPIRE server X509 CA.
+	CASubject *SubjectConfig `hcl:"ca_subject"`
+
+	// ServerX509SVIDSubject optionally sets the subject of the SPIRE server
+	// X509-SVID.
+	ServerX509SVIDSubject *SubjectConfig `hcl:"server_x509_svid_subject"`
+
+	trustDomain           string
+	overridesPollInterval time.Duration
+	overrides             *overrideStore
+	auditDedupWindow      *time.Duration
+	audit                 *auditor
+	// inFlight are the calls using the overrides and auditor
+	inFlight sync.WaitGroup
+}
+
+// close releases the resources held by the configuration once the calls
+// using them finished.
+func (c *Config) close() {
+	c.inFlight.Wait()
+	c.overrides.close()
+	c.audit.close()
 }
 
 // Plugin implements the CredentialComposer plugin
@@ -30,6 +80,20 @@ type Plugin struct {
 	// Configuration should be set atomically
 	configMtx sync.RWMutex
 	config    *Config
+
+	log hclog.Logger
+}
+
+// SetLogger is called by the plugin framework to provide the logger.
+func (p *Plugin) SetLogger(log hclog.Logger) {
+	p.log = log
+}
+
+// Close releases the resources held by the configuration. It is called by the plugin framework
+// when the plugin is unloaded.
+func (p *Plugin) Close() error {
+	p.setConfig(nil)
+	return nil
 }
 
 // ComposeServerX509CA implements the CredentialComposer ComposeServerX509CA RPC. Composes the SPIRE Server X509 CA.
@@ -37,7 +101,23 @@ type Plugin struct {
 // NOT_IMPLEMENTED, the server will apply the default attributes. Otherwise, the returned attributes are used.
 // If a CA is produced that does not conform to the SPIFFE X509-SVID specification for signing certificates, it will be rejected.
 func (p *Plugin) ComposeServerX509CA(ctx context.Context, req *credentialcomposerv1.ComposeServerX509CARequest) (*credentialcomposerv1.ComposeServerX509CAResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "not implemented")
+	config, err := p.getConfig()
+	if err != nil {
+		return nil, err
+	}
+	if config.CASubject == nil {
+		return &credentialcomposerv1.ComposeServerX509CAResponse{}, nil
+	}
+
+	// Keep the default attributes supplied by the server and only replace the subject
+	attributes := proto.Clone(req.GetAttributes()).(*credentialcomposerv1.X509CAAttributes)
+	if attributes == nil {
+		attributes = new(credentialcomposerv1.X509CAAttributes)
+	}
+	attributes.Subject = config.CASubject.distinguishedName(config.trustDomain, caCommonNameFormat)
+	return &credentialcomposerv1.ComposeServerX509CAResponse{
+		Attributes: attributes,
+	}, nil
 }
 
 // ComposeServerX509SVID implements the CredentialComposer ComposeServerX509SVID RPC. Composes the SPIRE Server X509-SVID.
@@ -46,7 +126,23 @@ func (p *Plugin) ComposeServerX509CA(ctx context.Context, req *credentialcompose
 // used. If an X509-SVID is produced that does not conform to the SPIFFE X509-SVID specification for leaf certificates,
 // it will be rejected. This function cannot be used to modify the SPIFFE ID of the X509-SVID.
 func (p *Plugin) ComposeServerX509SVID(ctx context.Context, req *credentialcomposerv1.ComposeServerX509SVIDRequest) (*credentialcomposerv1.ComposeServerX509SVIDResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "not implemented")
+	config, err := p.getConfig()
+	if err != nil {
+		return nil, err
+	}
+	if config.ServerX509SVIDSubject == nil {
+		return &credentialcomposerv1.ComposeServerX509SVIDResponse{}, nil
+	}
+
+	// Keep the default attributes supplied by the server and only replace the subject
+	attributes := proto.Clone(req.GetAttributes()).(*credentialcomposerv1.X509SVIDAttributes)
+	if attributes == nil {
+		attributes = new(credentialcomposerv1.X509SVIDAttributes)
+	}
+	attributes.Subject = config.ServerX509SVIDSubject.distinguishedName(config.trustDomain, serverCommonNameFormat)
+	return &credentialcomposerv1.ComposeServerX509SVIDResponse{
+		Attributes: attributes,
+	}, nil
 }
 
 // ComposeAgentX509SVID implements the CredentialComposer ComposeAgentX509SVID RPC. Composes the SPIRE Agent X509-SVID.
@@ -64,42 +160,64 @@ func (p *Plugin) ComposeAgentX509SVID(ctx context.Context, req *credentialcompos
 // If an X509-SVID is produced that does not conform to the SPIFFE X509-SVID specification for leaf certificates, it will
 // be rejected. This function cannot be used to modify the SPIFFE ID of the X509-SVID.
 func (p *Plugin) ComposeWorkloadX509SVID(ctx context.Context, req *credentialcomposerv1.ComposeWorkloadX509SVIDRequest) (*credentialcomposerv1.ComposeWorkloadX509SVIDResponse, error) {
-	config, err := p.getConfig()
+	config, release, err := p.acquireConfig()
 	if err != nil {
 		return nil, err
 	}
+	defer release()
 
 	// Extract SPIFFE ID Path from request
 	spiffeIDRaw := req.GetSpiffeId()
 	spiffeID, err := spiffeid.FromString(spiffeIDRaw)
 	if err != nil {
-		return nil, err
+		return nil, status.Errorf(codes.InvalidArgument, "malformed SPIFFE ID %q: %v", spiffeIDRaw, err)
+	}
+
+	subject, rule := composeSubject(config, spiffeID)
+	if subject == nil {
+		return &credentialcomposerv1.ComposeWorkloadX509SVIDResponse{}, nil
+	}
+
+	config.audit.record(spiffeID.String(), rule, subject)
+	return &credentialcomposerv1.ComposeWorkloadX509SVIDResponse{
+		Attributes: &credentialcomposerv1.X509SVIDAttributes{
+			Subject: subject,
+		},
+	}, nil
+}
+
+// composeSubject returns the subject for the SPIFFE ID along with the rule that
+// produced it, or nil if the SPIFFE ID doesn't belong to a MySQL client.
+func composeSubject(config *Config, spiffeID spiffeid.ID) (*credentialcomposerv1.DistinguishedName, string) {
+	// Per-identity overrides take precedence over the subject derived from the path
+	if override, ok := config.overrides.lookup(spiffeID); ok {
+		return override.distinguishedName(), auditRuleOverride
 	}
-	path := spiffeID.Path()
 
 	// Check whether the path for the requested SPIFFEID contains
 	// any of the configured MySQLSPIFFEIDPathPrefixes
+	path := spiffeID.Path()
 	for _, mySQLPathPrefix := range config.MySQLSPIFFEIDPathPrefixes {
 		if strings.HasPrefix(path, mySQLPathPrefix) {
 			// Interpret the last path component to be the MySQL username.
 			// Set the MySQL username as the Subject CN of the X.509-SVID so that it can be used for authentication to MySQL.
 			pathComponents := strings.Split(path, "/")
 			mySQLUsername := pathComponents[len(pathComponents)-1]
-			resp := &credentialcomposerv1.ComposeWorkloadX509SVIDResponse{
-				Attributes: &credentialcomposerv1.X509SVIDAttributes{
-					Subject: &credentialcomposerv1.DistinguishedName{
-						Country:      []string{"US"},
-						Organization: []string{"SPIRE"},
-						CommonName:   mySQLUsername,
-					},
-				},
-			}
-
-			return resp, nil
+			return mySQLSubject(mySQLUsername), fmt.Sprintf(auditRulePathPrefixPattern, mySQLPathPrefix)
 		}
 	}
 
-	return &credentialcomposerv1.ComposeWorkloadX509SVIDResponse{}, nil
+	return nil, ""
+}
+
+// mySQLSubject returns the subject used to authenticate as the MySQL user
+// with a `REQUIRE SUBJECT '/C=US/O=SPIRE/CN=<username>'` clause.
+func mySQLSubject(mySQLUsername string) *credentialcomposerv1.DistinguishedName {
+	return &credentialcomposerv1.DistinguishedName{
+		Country:      []string{"US"},
+		Organization: []string{"SPIRE"},
+		CommonName:   mySQLUsername,
+	}
 }
 
 // ComposeWorkloadJWTSVID implements the CredentialComposer ComposeWorkloadJWTSVID RPC. Composes workload JWT-SVIDs.
@@ -114,21 +232,88 @@ func (p *Plugin) ComposeWorkloadJWTSVID(ctx context.Context, req *credentialcomp
 // Configure configures the plugin. This is invoked by SPIRE when the plugin is
 // first loaded. In the future, it may be invoked to reconfigure the plugin.
 // As such, it should replace the previous configuration atomically.
+// An invalid configuration is rejected with InvalidArgument and leaves any
+// previously applied configuration in place.
 func (p *Plugin) Configure(ctx context.Context, req *configv1.ConfigureRequest) (*configv1.ConfigureResponse, error) {
-	config := new(Config)
-	if err := hcl.Decode(config, req.HclConfiguration); err != nil {
-		return nil, status.Errorf(codes.InvalidArgument, "failed to decode configuration: %v", err)
+	config, err := parseConfig(req.HclConfiguration)
+	if err != nil {
+		return nil, err
+	}
+
+	config.trustDomain = req.GetCoreConfiguration().GetTrustDomain()
+	if config.trustDomain == "" && (config.CASubject != nil || config.ServerX509SVIDSubject != nil) {
+		return nil, status.Error(codes.InvalidArgument, "trust domain is required to compose server subjects")
+	}
+
+	if config.OverridesFile != "" {
+		interval := config.overridesPollInterval
+		if interval == 0 {
+			interval = defaultOverridesPollInterval
+		}
+		config.overrides, err = newOverrideStore(config.OverridesFile, interval, p.logger())
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "failed to load overrides file: %v", err)
+		}
+	}
+
+	config.audit, err = newConfigAuditor(config, p.currentAuditor(), p.logger())
+	if err != nil {
+		config.overrides.close()
+		return nil, status.Errorf(codes.InvalidArgument, "failed to open audit log file: %v", err)
 	}
 
 	p.setConfig(config)
 	return &configv1.ConfigureResponse{}, nil
 }
 
-// setConfig replaces the configuration atomically under a write lock.
+// ValidateResponse is the result of validating a configuration without
+// applying it. It has the fields of the response of the config service
+// Validate RPC.
+type ValidateResponse struct {
+	// Valid is true when the configuration would be accepted by Configure.
+	Valid bool
+	// Notes describes each problem found in the configuration.
+	Notes []string
+}
+
+// Validate checks the configuration the same way Configure does, without
+// applying it, for `spire-server validate`. The config service of
+// spire-plugin-sdk v1.8.1 has no Validate RPC yet: once the SDK is bumped to
+// a release that has it, the RPC only has to pass its request, which has the
+// same fields as ConfigureRequest, to Validate.
+func (p *Plugin) Validate(ctx context.Context, req *configv1.ConfigureRequest) (*ValidateResponse, error) {
+	config, problems, err := decodeConfig(req.HclConfiguration)
+	if err != nil {
+		return &ValidateResponse{Notes: []string{status.Convert(err).Message()}}, nil
+	}
+
+	if req.GetCoreConfiguration().GetTrustDomain() == "" && (config.CASubject != nil || config.ServerX509SVIDSubject != nil) {
+		problems = append(problems, "trust domain is required to compose server subjects")
+	}
+	if len(problems) == 0 && config.OverridesFile != "" {
+		if _, err := loadOverridesFile(config.OverridesFile); err != nil {
+			problems = append(problems, fmt.Sprintf("failed to load overrides file: %v", err))
+		}
+	}
+
+	return &ValidateResponse{
+		Valid: len(problems) == 0,
+		Notes: problems,
+	}, nil
+}
+
+// setConfig replaces the configuration atomically under a write lock and
+// releases the resources held by the previous configuration, once the calls
+// still using it finished.
 func (p *Plugin) setConfig(config *Config) {
 	p.configMtx.Lock()
+	prev := p.config
 	p.config = config
 	p.configMtx.Unlock()
+
+	if prev != nil {
+		prev.close()
+	}
 }
 
 // getConfig gets the configuration under a read lock.
@@ -141,6 +326,39 @@ func (p *Plugin) getConfig() (*Config, error) {
 	return p.config, nil
 }
 
+// acquireConfig is getConfig for calls using the resources of the
+// configuration, which are kept open until the call runs release.
+func (p *Plugin) acquireConfig() (*Config, func(), error) {
+	p.configMtx.RLock()
+	defer p.configMtx.RUnlock()
+	if p.config == nil {
+		return nil, nil, status.Error(codes.FailedPrecondition, "not configured")
+	}
+	// The configuration is only closed once replaced, under the write lock,
+	// so this can't race with its close waiting for the calls in flight
+	p.config.inFlight.Add(1)
+	return p.config, p.config.inFlight.Done, nil
+}
+
+// currentAuditor returns the auditor of the current configuration, if any.
+func (p *Plugin) currentAuditor() *auditor {
+	p.configMtx.RLock()
+	defer p.configMtx.RUnlock()
+	if p.config == nil {
+		return nil
+	}
+	return p.config.audit
+}
+
+// logger returns the logger provided by the plugin framework, or a no-op
+// logger when the plugin is used outside of it.
+func (p *Plugin) logger() hclog.Logger {
+	if p.log == nil {
+		return hclog.NewNullLogger()
+	}
+	return p.log
+}
+
 func main() {
 	plugin := new(Plugin)
 	// Serve the plugin. This function call will not return. If there is a
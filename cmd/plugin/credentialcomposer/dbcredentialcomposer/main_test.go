@@ -0,0 +1,739 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/spiffe/spire-plugin-sdk/pluginsdk"
+	"github.com/spiffe/spire-plugin-sdk/plugintest"
+	credentialcomposerv1 "github.com/spiffe/spire-plugin-sdk/proto/spire/plugin/server/credentialcomposer/v1"
+	configv1 "github.com/spiffe/spire-plugin-sdk/proto/spire/service/common/config/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+const testConfig = `mysql_spiffe_id_path_prefixes = ["/mysql/client/"]`
+
+func TestConfigure(t *testing.T) {
+	for _, tt := range []struct {
+		name         string
+		hclConfig    string
+		expectCode   codes.Code
+		expectConfig *Config
+	}{
+		{
+			name:       "malformed HCL",
+			hclConfig:  `mysql_spiffe_id_path_prefixes = [`,
+			expectCode: codes.InvalidArgument,
+		},
+		{
+			name:       "unknown field",
+			hclConfig:  testConfig + "\nmysql_spiffe_id_prefixes = [\"/db/\"]",
+			expectCode: codes.InvalidArgument,
+		},
+		{
+			name:       "missing prefixes",
+			hclConfig:  ``,
+			expectCode: codes.InvalidArgument,
+		},
+		{
+			name:       "empty prefix list",
+			hclConfig:  `mysql_spiffe_id_path_prefixes = []`,
+			expectCode: codes.InvalidArgument,
+		},
+		{
+			name:       "empty prefix",
+			hclConfig:  `mysql_spiffe_id_path_prefixes = [""]`,
+			expectCode: codes.InvalidArgument,
+		},
+		{
+			name:       "duplicate prefix",
+			hclConfig:  `mysql_spiffe_id_path_prefixes = ["/db/", "/db/"]`,
+			expectCode: codes.InvalidArgument,
+		},
+		{
+			name:       "overlapping prefixes",
+			hclConfig:  `mysql_spiffe_id_path_prefixes = ["/mysql/", "/mysql/client/"]`,
+			expectCode: codes.InvalidArgument,
+		},
+		{
+			name:       "relative prefix",
+			hclConfig:  `mysql_spiffe_id_path_prefixes = ["mysql/client/"]`,
+			expectCode: codes.InvalidArgument,
+		},
+		{
+			name:         "single prefix",
+			hclConfig:    testConfig,
+			expectConfig: &Config{MySQLSPIFFEIDPathPrefixes: []string{"/mysql/client/"}},
+		},
+		{
+			name:         "multiple prefixes",
+			hclConfig:    `mysql_spiffe_id_path_prefixes = ["/mysql/client/", "/db/"]`,
+			expectConfig: &Config{MySQLSPIFFEIDPathPrefixes: []string{"/mysql/client/", "/db/"}},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			p := new(Plugin)
+			_, err := p.Configure(context.Background(), &configv1.ConfigureRequest{HclConfiguration: tt.hclConfig})
+			assertCode(t, err, tt.expectCode)
+			if tt.expectCode != codes.OK {
+				return
+			}
+
+			config, err := p.getConfig()
+			if err != nil {
+				t.Fatalf("failed to get config: %v", err)
+			}
+			assertStrings(t, tt.expectConfig.MySQLSPIFFEIDPathPrefixes, config.MySQLSPIFFEIDPathPrefixes)
+		})
+	}
+}
+
+func TestReconfigureWithInvalidConfigKeepsPrevious(t *testing.T) {
+	p := new(Plugin)
+	if _, err := p.Configure(context.Background(), &configv1.ConfigureRequest{HclConfiguration: testConfig}); err != nil {
+		t.Fatalf("failed to configure plugin: %v", err)
+	}
+
+	_, err := p.Configure(context.Background(), &configv1.ConfigureRequest{HclConfiguration: `mysql_spiffe_id_path_prefixes = [""]`})
+	assertCode(t, err, codes.InvalidArgument)
+
+	config, err := p.getConfig()
+	if err != nil {
+		t.Fatalf("failed to get config: %v", err)
+	}
+	assertStrings(t, []string{"/mysql/client/"}, config.MySQLSPIFFEIDPathPrefixes)
+}
+
+func TestConfigureReportsAllProblems(t *testing.T) {
+	p := new(Plugin)
+	_, err := p.Configure(context.Background(), &configv1.ConfigureRequest{
+		HclConfiguration: "mysql_spiffe_id_path_prefixes = [\"db\", \"db\"]\nextra = true",
+	})
+	assertCode(t, err, codes.InvalidArgument)
+	if problems := strings.Split(status.Convert(err).Message(), "; "); len(problems) != 3 {
+		t.Fatalf("expected 3 problems; got %q", problems)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		hclConfig   string
+		trustDomain string
+		expectValid bool
+		expectNotes int
+	}{
+		{
+			name:        "valid",
+			hclConfig:   testConfig,
+			expectValid: true,
+		},
+		{
+			name:        "malformed HCL",
+			hclConfig:   `mysql_spiffe_id_path_prefixes = [`,
+			expectNotes: 1,
+		},
+		{
+			name:        "multiple problems",
+			hclConfig:   "mysql_spiffe_id_path_prefixes = [\"db\", \"db\"]\nextra = true",
+			expectNotes: 3,
+		},
+		{
+			name:        "server subject without trust domain",
+			hclConfig:   testConfig + "\nca_subject {\n  common_name = \"ca\"\n}",
+			expectNotes: 1,
+		},
+		{
+			name:        "server subject with trust domain",
+			hclConfig:   testConfig + "\nca_subject {\n  common_name = \"ca\"\n}",
+			trustDomain: "example.org",
+			expectValid: true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			p := new(Plugin)
+			resp, err := p.Validate(context.Background(), &configv1.ConfigureRequest{
+				HclConfiguration:  tt.hclConfig,
+				CoreConfiguration: &configv1.CoreConfiguration{TrustDomain: tt.trustDomain},
+			})
+			if err != nil {
+				t.Fatalf("validate failed unexpectedly: %v", err)
+			}
+			if resp.Valid != tt.expectValid {
+				t.Fatalf("expected valid=%t; got %t (notes=%q)", tt.expectValid, resp.Valid, resp.Notes)
+			}
+			if len(resp.Notes) != tt.expectNotes {
+				t.Fatalf("expected %d notes; got %q", tt.expectNotes, resp.Notes)
+			}
+			if _, err := p.getConfig(); status.Code(err) != codes.FailedPrecondition {
+				t.Fatal("validate should not apply the configuration")
+			}
+		})
+	}
+}
+
+func TestComposeWorkloadX509SVID(t *testing.T) {
+	for _, tt := range []struct {
+		name         string
+		hclConfig    string
+		spiffeID     string
+		expectCode   codes.Code
+		expectResult *credentialcomposerv1.X509SVIDAttributes
+	}{
+		{
+			name:       "not configured",
+			spiffeID:   "spiffe://example.org/mysql/client/spire-mysql-client",
+			expectCode: codes.FailedPrecondition,
+		},
+		{
+			name:       "malformed SPIFFE ID",
+			hclConfig:  testConfig,
+			spiffeID:   "not-a-spiffe-id",
+			expectCode: codes.InvalidArgument,
+		},
+		{
+			name:      "matching prefix",
+			hclConfig: testConfig,
+			spiffeID:  "spiffe://example.org/mysql/client/spire-mysql-client",
+			expectResult: &credentialcomposerv1.X509SVIDAttributes{
+				Subject: &credentialcomposerv1.DistinguishedName{
+					Country:      []string{"US"},
+					Organization: []string{"SPIRE"},
+					CommonName:   "spire-mysql-client",
+				},
+			},
+		},
+		{
+			name:      "matching nested prefix",
+			hclConfig: testConfig,
+			spiffeID:  "spiffe://example.org/mysql/client/team/mysql-tls-reloader",
+			expectResult: &credentialcomposerv1.X509SVIDAttributes{
+				Subject: &credentialcomposerv1.DistinguishedName{
+					Country:      []string{"US"},
+					Organization: []string{"SPIRE"},
+					CommonName:   "mysql-tls-reloader",
+				},
+			},
+		},
+		{
+			name:      "non-matching prefix",
+			hclConfig: testConfig,
+			spiffeID:  "spiffe://example.org/mysql/server",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			p := new(Plugin)
+			if tt.hclConfig != "" {
+				if _, err := p.Configure(context.Background(), &configv1.ConfigureRequest{HclConfiguration: tt.hclConfig}); err != nil {
+					t.Fatalf("failed to configure plugin: %v", err)
+				}
+			}
+
+			resp, err := p.ComposeWorkloadX509SVID(context.Background(), &credentialcomposerv1.ComposeWorkloadX509SVIDRequest{
+				SpiffeId: tt.spiffeID,
+			})
+			assertCode(t, err, tt.expectCode)
+			if tt.expectCode != codes.OK {
+				return
+			}
+			assertAttributes(t, tt.expectResult, resp.GetAttributes())
+		})
+	}
+}
+
+func TestPluginLoadedBySPIRE(t *testing.T) {
+	for _, tt := range []struct {
+		name         string
+		hclConfig    string
+		spiffeID     string
+		expectCode   codes.Code
+		expectResult *credentialcomposerv1.X509SVIDAttributes
+	}{
+		{
+			name:       "not configured",
+			spiffeID:   "spiffe://example.org/mysql/client/spire-mysql-client",
+			expectCode: codes.FailedPrecondition,
+		},
+		{
+			name:       "malformed SPIFFE ID",
+			hclConfig:  testConfig,
+			spiffeID:   "spiffe://example.org/mysql/client/",
+			expectCode: codes.InvalidArgument,
+		},
+		{
+			name:      "matching prefix",
+			hclConfig: testConfig,
+			spiffeID:  "spiffe://example.org/mysql/client/spire-mysql-client",
+			expectResult: &credentialcomposerv1.X509SVIDAttributes{
+				Subject: &credentialcomposerv1.DistinguishedName{
+					Country:      []string{"US"},
+					Organization: []string{"SPIRE"},
+					CommonName:   "spire-mysql-client",
+				},
+			},
+		},
+		{
+			name:      "non-matching prefix",
+			hclConfig: testConfig,
+			spiffeID:  "spiffe://example.org/sample-service",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			composerClient, configClient := loadPlugin(t)
+			if tt.hclConfig != "" {
+				_, err := configClient.Configure(context.Background(), &configv1.ConfigureRequest{
+					CoreConfiguration: &configv1.CoreConfiguration{TrustDomain: "example.org"},
+					HclConfiguration:  tt.hclConfig,
+				})
+				if err != nil {
+					t.Fatalf("failed to configure plugin: %v", err)
+				}
+			}
+
+			resp, err := composerClient.ComposeWorkloadX509SVID(context.Background(), &credentialcomposerv1.ComposeWorkloadX509SVIDRequest{
+				SpiffeId: tt.spiffeID,
+				Attributes: &credentialcomposerv1.X509SVIDAttributes{
+					Subject: &credentialcomposerv1.DistinguishedName{
+						Country:      []string{"US"},
+						Organization: []string{"SPIFFE"},
+					},
+				},
+			})
+			assertCode(t, err, tt.expectCode)
+			if tt.expectCode != codes.OK {
+				return
+			}
+			assertAttributes(t, tt.expectResult, resp.GetAttributes())
+		})
+	}
+}
+
+// loadPlugin serves the plugin over the plugin SDK's go-plugin transport and
+// returns clients initialized the same way SPIRE server initializes them.
+func loadPlugin(t *testing.T) (*credentialcomposerv1.CredentialComposerPluginClient, *configv1.ConfigServiceClient) {
+	plugin := new(Plugin)
+	composerClient := new(credentialcomposerv1.CredentialComposerPluginClient)
+	configClient := new(configv1.ConfigServiceClient)
+	plugintest.ServeInBackground(t, plugintest.Config{
+		PluginServer:   credentialcomposerv1.CredentialComposerPluginServer(plugin),
+		PluginClient:   composerClient,
+		ServiceServers: []pluginsdk.ServiceServer{configv1.ConfigServiceServer(plugin)},
+		ServiceClients: []pluginsdk.ServiceClient{configClient},
+	})
+	return composerClient, configClient
+}
+
+func assertCode(t *testing.T, err error, expected codes.Code) {
+	t.Helper()
+	if actual := status.Code(err); actual != expected {
+		t.Fatalf("expected code %s; got %s (err=%v)", expected, actual, err)
+	}
+}
+
+func assertAttributes(t *testing.T, expected, actual *credentialcomposerv1.X509SVIDAttributes) {
+	t.Helper()
+	if !proto.Equal(expected, actual) {
+		t.Fatalf("expected attributes %v; got %v", expected, actual)
+	}
+}
+
+func assertStrings(t *testing.T, expected, actual []string) {
+	t.Helper()
+	if len(expected) != len(actual) {
+		t.Fatalf("expected %q; got %q", expected, actual)
+	}
+	for i := range expected {
+		if expected[i] != actual[i] {
+			t.Fatalf("expected %q; got %q", expected, actual)
+		}
+	}
+}
+
+func TestOverrides(t *testing.T) {
+	overridesFile := filepath.Join(t.TempDir(), "overrides.json")
+	writeFile(t, overridesFile, `{
+		"spiffe://example.org/mysql/client/sample-service": {"username": "legacy_app"},
+		"spiffe://example.org/reporting": {"subject": {"organization": ["Acme"], "organizational_unit": ["BI"], "common_name": "reporting"}}
+	}`)
+
+	p := new(Plugin)
+	t.Cleanup(func() { p.Close() })
+	_, err := p.Configure(context.Background(), &configv1.ConfigureRequest{
+		HclConfiguration: testConfig + "\noverrides_file = \"" + overridesFile + "\"\noverrides_poll_interval = \"10ms\"",
+	})
+	if err != nil {
+		t.Fatalf("failed to configure plugin: %v", err)
+	}
+
+	assertSubject(t, p, "spiffe://example.org/mysql/client/sample-service", mySQLSubject("legacy_app"))
+	assertSubject(t, p, "spiffe://example.org/reporting", &credentialcomposerv1.DistinguishedName{
+		Organization:       []string{"Acme"},
+		OrganizationalUnit: []string{"BI"},
+		CommonName:         "reporting",
+	})
+	assertSubject(t, p, "spiffe://example.org/mysql/client/spire-mysql-client", mySQLSubject("spire-mysql-client"))
+
+	// Changes to the file are picked up without reconfiguring the plugin
+	writeFile(t, overridesFile, `{"spiffe://example.org/mysql/client/sample-service": {"username": "remapped_app"}}`)
+	waitForSubject(t, p, "spiffe://example.org/mysql/client/sample-service", mySQLSubject("remapped_app"))
+	assertSubject(t, p, "spiffe://example.org/reporting", nil)
+
+	// An invalid file keeps the previous overrides in place
+	writeFile(t, overridesFile, `{"not-a-spiffe-id": {"username": "broken"}}`)
+	time.Sleep(50 * time.Millisecond)
+	assertSubject(t, p, "spiffe://example.org/mysql/client/sample-service", mySQLSubject("remapped_app"))
+}
+
+func TestOverridesFileInvalid(t *testing.T) {
+	overridesFile := filepath.Join(t.TempDir(), "overrides.json")
+	writeFile(t, overridesFile, `{"spiffe://example.org/app": {}}`)
+
+	p := new(Plugin)
+	_, err := p.Configure(context.Background(), &configv1.ConfigureRequest{
+		HclConfiguration: testConfig + "\noverrides_file = \"" + overridesFile + "\"",
+	})
+	assertCode(t, err, codes.InvalidArgument)
+
+	resp, err := p.Validate(context.Background(), &configv1.ConfigureRequest{
+		HclConfiguration: testConfig + "\noverrides_file = \"" + overridesFile + "\"",
+	})
+	if err != nil {
+		t.Fatalf("validate failed unexpectedly: %v", err)
+	}
+	if resp.Valid {
+		t.Fatal("expected configuration with an invalid overrides file to be invalid")
+	}
+}
+
+func assertSubject(t *testing.T, p *Plugin, spiffeID string, expected *credentialcomposerv1.DistinguishedName) {
+	t.Helper()
+	resp, err := p.ComposeWorkloadX509SVID(context.Background(), &credentialcomposerv1.ComposeWorkloadX509SVIDRequest{SpiffeId: spiffeID})
+	if err != nil {
+		t.Fatalf("failed to compose X509-SVID: %v", err)
+	}
+	if actual := resp.GetAttributes().GetSubject(); !proto.Equal(expected, actual) {
+		t.Fatalf("expected subject %v for %s; got %v", expected, spiffeID, actual)
+	}
+}
+
+func waitForSubject(t *testing.T, p *Plugin, spiffeID string, expected *credentialcomposerv1.DistinguishedName) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		resp, err := p.ComposeWorkloadX509SVID(context.Background(), &credentialcomposerv1.ComposeWorkloadX509SVIDRequest{SpiffeId: spiffeID})
+		if err == nil && proto.Equal(expected, resp.GetAttributes().GetSubject()) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assertSubject(t, p, spiffeID, expected)
+}
+
+func writeFile(t *testing.T, path, data string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatalf("failed to write %s: %v", path, err)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	auditLogFile := filepath.Join(t.TempDir(), "audit.log")
+
+	p := new(Plugin)
+	t.Cleanup(func() { p.Close() })
+	_, err := p.Configure(context.Background(), &configv1.ConfigureRequest{
+		HclConfiguration: testConfig + "\naudit_log_file = \"" + auditLogFile + "\"\naudit_dedup_window = \"1h\"",
+	})
+	if err != nil {
+		t.Fatalf("failed to configure plugin: %v", err)
+	}
+
+	// Repeated compositions within the dedup window are only audited once, and
+	// identities that aren't MySQL clients are not audited at all
+	for _, spiffeID := range []string{
+		"spiffe://example.org/mysql/client/spire-mysql-client",
+		"spiffe://example.org/mysql/client/spire-mysql-client",
+		"spiffe://example.org/mysql/client/mysql-tls-reloader",
+		"spiffe://example.org/sample-service",
+	} {
+		if _, err := p.ComposeWorkloadX509SVID(context.Background(), &credentialcomposerv1.ComposeWorkloadX509SVIDRequest{SpiffeId: spiffeID}); err != nil {
+			t.Fatalf("failed to compose X509-SVID: %v", err)
+		}
+	}
+
+	// Reconfiguring keeps the events emitted within the dedup window
+	_, err = p.Configure(context.Background(), &configv1.ConfigureRequest{
+		HclConfiguration: testConfig + "\naudit_log_file = \"" + auditLogFile + "\"\naudit_dedup_window = \"1h\"",
+	})
+	if err != nil {
+		t.Fatalf("failed to reconfigure plugin: %v", err)
+	}
+	if _, err := p.ComposeWorkloadX509SVID(context.Background(), &credentialcomposerv1.ComposeWorkloadX509SVIDRequest{SpiffeId: "spiffe://example.org/mysql/client/spire-mysql-client"}); err != nil {
+		t.Fatalf("failed to compose X509-SVID: %v", err)
+	}
+
+	data, err := os.ReadFile(auditLogFile)
+	if err != nil {
+		t.Fatalf("failed to read audit log: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 audit events; got %q", lines)
+	}
+
+	var event auditEvent
+	if err := json.Unmarshal([]byte(lines[0]), &event); err != nil {
+		t.Fatalf("failed to unmarshal audit event: %v", err)
+	}
+	if event.SPIFFEID != "spiffe://example.org/mysql/client/spire-mysql-client" ||
+		event.Rule != "path_prefix:/mysql/client/" ||
+		event.Subject != "/C=US/O=SPIRE/CN=spire-mysql-client" ||
+		event.Time.IsZero() {
+		t.Fatalf("unexpected audit event: %+v", event)
+	}
+}
+
+func TestReconfigureAuditLog(t *testing.T) {
+	dir := t.TempDir()
+	p := new(Plugin)
+	t.Cleanup(func() { p.Close() })
+	configure := func(auditLogFile string) error {
+		_, err := p.Configure(context.Background(), &configv1.ConfigureRequest{
+			HclConfiguration: testConfig + "\naudit_log_file = \"" + filepath.Join(dir, auditLogFile) + "\"",
+		})
+		return err
+	}
+	if err := configure("audit.log"); err != nil {
+		t.Fatalf("failed to configure plugin: %v", err)
+	}
+	first, err := p.getConfig()
+	if err != nil {
+		t.Fatalf("failed to get config: %v", err)
+	}
+
+	// The same path shares the open file rather than opening it again
+	if err := configure("audit.log"); err != nil {
+		t.Fatalf("failed to reconfigure plugin: %v", err)
+	}
+	second, err := p.getConfig()
+	if err != nil {
+		t.Fatalf("failed to get config: %v", err)
+	}
+	if second.audit.file != first.audit.file {
+		t.Fatal("expected the audit log file to be reused")
+	}
+
+	// A call in flight keeps auditing to the previous file until it finishes
+	config, release, err := p.acquireConfig()
+	if err != nil {
+		t.Fatalf("failed to acquire config: %v", err)
+	}
+	configured := make(chan error, 1)
+	go func() {
+		configured <- configure("other.log")
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if err := config.audit.file.writeLine([]byte("in flight")); err != nil {
+		t.Fatalf("expected the previous audit log file to stay open: %v", err)
+	}
+	select {
+	case <-configured:
+		t.Fatal("expected reconfiguring to wait for the call in flight")
+	default:
+	}
+	release()
+	if err := <-configured; err != nil {
+		t.Fatalf("failed to reconfigure plugin: %v", err)
+	}
+	if err := config.audit.file.writeLine([]byte("closed")); err == nil {
+		t.Fatal("expected the previous audit log file to be closed")
+	}
+}
+
+func TestAuditorDedupWindow(t *testing.T) {
+	now := time.Now()
+	a := newAuditor(hclog.NewNullLogger(), nil, time.Minute)
+	a.now = func() time.Time { return now }
+
+	key := auditEvent{SPIFFEID: "spiffe://example.org/mysql/client/app", Rule: auditRuleOverride, Subject: "/CN=app"}
+	for _, step := range []struct {
+		advance    time.Duration
+		expectEmit bool
+	}{
+		{0, true},
+		{30 * time.Second, false},
+		{29 * time.Second, false},
+		{time.Second, true},
+	} {
+		now = now.Add(step.advance)
+		if emitted := a.shouldEmit(key, now); emitted != step.expectEmit {
+			t.Fatalf("expected emit=%t after %s; got %t", step.expectEmit, step.advance, emitted)
+		}
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	r, err := openRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatalf("failed to open rotating file: %v", err)
+	}
+	t.Cleanup(func() { r.close() })
+
+	for _, line := range []string{"first", "second", "third", "fourth"} {
+		if err := r.writeLine([]byte(line)); err != nil {
+			t.Fatalf("failed to write line: %v", err)
+		}
+	}
+
+	for path, expected := range map[string]string{
+		path:        "fourth\n",
+		path + ".1": "third\n",
+		path + ".2": "second\n",
+	} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("failed to read %s: %v", path, err)
+		}
+		if string(data) != expected {
+			t.Fatalf("expected %q in %s; got %q", expected, path, data)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("expected oldest backup to be dropped; got %v", err)
+	}
+}
+
+func TestRotatingFileReopenFails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	r, err := openRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatalf("failed to open rotating file: %v", err)
+	}
+	t.Cleanup(func() { r.close() })
+
+	if err := r.writeLine([]byte("first")); err != nil {
+		t.Fatalf("failed to write line: %v", err)
+	}
+	// The rotation moves the file, then fails to reopen it once
+	errOpen := errors.New("too many open files")
+	r.openFile = func(string, int, os.FileMode) (*os.File, error) {
+		r.openFile = os.OpenFile
+		return nil, errOpen
+	}
+	if err := r.writeLine([]byte("second")); !errors.Is(err, errOpen) {
+		t.Fatalf("expected the write to fail with %v; got %v", errOpen, err)
+	}
+
+	// Auditing resumes with the next write
+	if err := r.writeLine([]byte("third")); err != nil {
+		t.Fatalf("failed to write line after the reopen failed: %v", err)
+	}
+	for path, expected := range map[string]string{
+		path:        "third\n",
+		path + ".1": "first\n",
+	} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("failed to read %s: %v", path, err)
+		}
+		if string(data) != expected {
+			t.Fatalf("expected %q in %s; got %q", expected, path, data)
+		}
+	}
+}
+
+func TestComposeServerSubjects(t *testing.T) {
+	composerClient, configClient := loadPlugin(t)
+	_, err := configClient.Configure(context.Background(), &configv1.ConfigureRequest{
+		CoreConfiguration: &configv1.CoreConfiguration{TrustDomain: "example.org"},
+		HclConfiguration: testConfig + `
+ca_subject {
+  country = ["US"]
+  organization = ["SPIRE"]
+  organizational_unit = ["MySQL"]
+}
+server_x509_svid_subject = {
+  organization = ["SPIRE"]
+  common_name = "spire-server"
+}`,
+	})
+	if err != nil {
+		t.Fatalf("failed to configure plugin: %v", err)
+	}
+
+	caResp, err := composerClient.ComposeServerX509CA(context.Background(), &credentialcomposerv1.ComposeServerX509CARequest{
+		Attributes: &credentialcomposerv1.X509CAAttributes{
+			Subject:           &credentialcomposerv1.DistinguishedName{Country: []string{"US"}, Organization: []string{"SPIFFE"}},
+			PolicyIdentifiers: []string{"1.2.3.4"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to compose X509 CA: %v", err)
+	}
+	expectCA := &credentialcomposerv1.X509CAAttributes{
+		Subject: &credentialcomposerv1.DistinguishedName{
+			Country:            []string{"US"},
+			Organization:       []string{"SPIRE"},
+			OrganizationalUnit: []string{"MySQL"},
+			CommonName:         "example.org SPIRE CA",
+		},
+		PolicyIdentifiers: []string{"1.2.3.4"},
+	}
+	if !proto.Equal(expectCA, caResp.GetAttributes()) {
+		t.Fatalf("expected CA attributes %v; got %v", expectCA, caResp.GetAttributes())
+	}
+
+	svidResp, err := composerClient.ComposeServerX509SVID(context.Background(), &credentialcomposerv1.ComposeServerX509SVIDRequest{
+		Attributes: &credentialcomposerv1.X509SVIDAttributes{DnsSans: []string{"spire-server"}},
+	})
+	if err != nil {
+		t.Fatalf("failed to compose server X509-SVID: %v", err)
+	}
+	assertAttributes(t, &credentialcomposerv1.X509SVIDAttributes{
+		Subject: &credentialcomposerv1.DistinguishedName{
+			Organization: []string{"SPIRE"},
+			CommonName:   "spire-server",
+		},
+		DnsSans: []string{"spire-server"},
+	}, svidResp.GetAttributes())
+
+	_, err = composerClient.ComposeAgentX509SVID(context.Background(), &credentialcomposerv1.ComposeAgentX509SVIDRequest{})
+	assertCode(t, err, codes.Unimplemented)
+}
+
+func TestComposeServerSubjectsNotConfigured(t *testing.T) {
+	p := new(Plugin)
+	_, err := p.Configure(context.Background(), &configv1.ConfigureRequest{HclConfiguration: testConfig})
+	if err != nil {
+		t.Fatalf("failed to configure plugin: %v", err)
+	}
+
+	caResp, err := p.ComposeServerX509CA(context.Background(), &credentialcomposerv1.ComposeServerX509CARequest{})
+	if err != nil || caResp.GetAttributes() != nil {
+		t.Fatalf("expected empty response; got %v (err=%v)", caResp, err)
+	}
+	svidResp, err := p.ComposeServerX509SVID(context.Background(), &credentialcomposerv1.ComposeServerX509SVIDRequest{})
+	if err != nil || svidResp.GetAttributes() != nil {
+		t.Fatalf("expected empty response; got %v (err=%v)", svidResp, err)
+	}
+
+	_, err = p.Configure(context.Background(), &configv1.ConfigureRequest{
+		HclConfiguration: testConfig + "\nca_subject { organisation = [\"SPIRE\"] }",
+	})
+	assertCode(t, err, codes.InvalidArgument)
+
+	_, err = p.Configure(context.Background(), &configv1.ConfigureRequest{
+		HclConfiguration: testConfig + "\nca_subject { organization = [\"SPIRE\"] }",
+	})
+	assertCode(t, err, codes.InvalidArgument)
+}
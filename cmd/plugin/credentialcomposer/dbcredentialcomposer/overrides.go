@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	credentialcomposerv1 "github.com/spiffe/spire-plugin-sdk/proto/spire/plugin/server/credentialcomposer/v1"
+)
+
+const defaultOverridesPollInterval = 10 * time.Second
+
+// Override replaces the subject derived from the SPIFFE ID path for a single
+// identity. Exactly one of Username or Subject must be set.
+type Override struct {
+	// Username is used as the Subject CN in place of the last path component
+	// of the SPIFFE ID.
+	Username string `json:"username,omitempty"`
+
+	// Subject replaces the whole Subject distinguished name.
+	Subject *Subject `json:"subject,omitempty"`
+}
+
+// Subject is the distinguished name set on an overridden X.509-SVID.
+type Subject struct {
+	Country            []string `json:"country,omitempty"`
+	Organization       []string `json:"organization,omitempty"`
+	OrganizationalUnit []string `json:"organizational_unit,omitempty"`
+	CommonName         string   `json:"common_name"`
+}
+
+// distinguishedName returns the subject to set on the X.509-SVID of an
+// identity matched by the override.
+func (o Override) distinguishedName() *credentialcomposerv1.DistinguishedName {
+	if o.Subject == nil {
+		return mySQLSubject(o.Username)
+	}
+	return &credentialcomposerv1.DistinguishedName{
+		Country:            o.Subject.Country,
+		Organization:       o.Subject.Organization,
+		OrganizationalUnit: o.Subject.OrganizationalUnit,
+		CommonName:         o.Subject.CommonName,
+	}
+}
+
+// overrideStore holds the overrides loaded from the overrides file, keyed by
+// SPIFFE ID, and reloads them whenever the file changes.
+type overrideStore struct {
+	path string
+	log  hclog.Logger
+
+	mu        sync.RWMutex
+	overrides map[string]Override
+	modTime   time.Time
+	size      int64
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// newOverrideStore loads the overrides file and starts polling it for changes
+// every interval. The initial load must succeed; later failures are logged and
+// the last good set of overrides is kept.
+func newOverrideStore(path string, interval time.Duration, log hclog.Logger) (*overrideStore, error) {
+	s := &overrideStore{
+		path: path,
+		log:  log,
+		done: make(chan struct{}),
+	}
+	if _, err := s.reload(); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	go s.watch(ctx, interval)
+	return s, nil
+}
+
+// lookup returns the override configured for the SPIFFE ID, if any.
+func (s *overrideStore) lookup(id spiffeid.ID) (Override, bool) {
+	if s == nil {
+		return Override{}, false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	override, ok := s.overrides[id.String()]
+	return override, ok
+}
+
+// close stops watching the overrides file.
+func (s *overrideStore) close() {
+	if s == nil {
+		return
+	}
+	s.cancel()
+	<-s.done
+}
+
+func (s *overrideStore) watch(ctx context.Context, interval time.Duration) {
+	defer close(s.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reloaded, err := s.reload()
+			switch {
+			case err != nil:
+				s.log.Error("Failed to reload overrides file; keeping previous overrides", "path", s.path, "error", err)
+			case reloaded:
+				s.log.Info("Reloaded overrides file", "path", s.path, "overrides", s.count())
+			}
+		}
+	}
+}
+
+// reload reads the overrides file if it changed since it was last loaded. It
+// reports whether a new set of overrides was applied.
+func (s *overrideStore) reload() (bool, error) {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return false, err
+	}
+
+	s.mu.RLock()
+	unchanged := s.overrides != nil && info.ModTime().Equal(s.modTime) && info.Size() == s.size
+	s.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	overrides, err := loadOverridesFile(s.path)
+	if err != nil {
+		return false, err
+	}
+
+	s.mu.Lock()
+	s.overrides = overrides
+	s.modTime = info.ModTime()
+	s.size = info.Size()
+	s.mu.Unlock()
+	return true, nil
+}
+
+func (s *overrideStore) count() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.overrides)
+}
+
+// loadOverridesFile reads and parses the overrides file at path.
+func loadOverridesFile(path string) (map[string]Override, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	overrides, err := parseOverrides(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid overrides file %s: %w", path, err)
+	}
+	return overrides, nil
+}
+
+// parseOverrides decodes a JSON object mapping SPIFFE IDs to overrides.
+func parseOverrides(data []byte) (map[string]Override, error) {
+	var raw map[string]Override
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+
+	overrides := make(map[string]Override, len(raw))
+	for rawID, override := range raw {
+		id, err := spiffeid.FromString(rawID)
+		if err != nil {
+			return nil, fmt.Errorf("malformed SPIFFE ID %q: %w", rawID, err)
+		}
+
+		switch {
+		case override.Username == "" && override.Subject == nil:
+			return nil, fmt.Errorf("override for %q must set username or subject", rawID)
+		case override.Username != "" && override.Subject != nil:
+			return nil, fmt.Errorf("override for %q must not set both username and subject", rawID)
+		case override.Subject != nil && override.Subject.CommonName == "":
+			return nil, fmt.Errorf("override for %q must set subject common_name", rawID)
+		}
+
+		if _, ok := overrides[id.String()]; ok {
+			return nil, fmt.Errorf("duplicate override for %q", id)
+		}
+		overrides[id.String()] = override
+	}
+	return overrides, nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+
+	credentialcomposerv1 "github.com/spiffe/spire-plugin-sdk/proto/spire/plugin/server/credentialcomposer/v1"
+)
+
+const (
+	// caCommonNameFormat and serverCommonNameFormat derive the CN from the
+	// trust domain when the subject configuration doesn't set one.
+	caCommonNameFormat     = "%s SPIRE CA"
+	serverCommonNameFormat = "%s SPIRE Server"
+)
+
+// SubjectConfig configures the subject of the SPIRE server CA or X509-SVID.
+type SubjectConfig struct {
+	Country            []string `hcl:"country"`
+	Organization       []string `hcl:"organization"`
+	OrganizationalUnit []string `hcl:"organizational_unit"`
+
+	// CommonName defaults to a name derived from the trust domain.
+	CommonName string `hcl:"common_name"`
+}
+
+// knownSubjectFields lists the keys understood in a subject block.
+var knownSubjectFields = map[string]struct{}{
+	"country":             {},
+	"organization":        {},
+	"organizational_unit": {},
+	"common_name":         {},
+}
+
+// distinguishedName returns the configured subject, deriving the CN from the
+// trust domain with commonNameFormat if no CN is configured.
+func (c *SubjectConfig) distinguishedName(trustDomain, commonNameFormat string) *credentialcomposerv1.DistinguishedName {
+	commonName := c.CommonName
+	if commonName == "" {
+		commonName = fmt.Sprintf(commonNameFormat, trustDomain)
+	}
+	return &credentialcomposerv1.DistinguishedName{
+		Country:            c.Country,
+		Organization:       c.Organization,
+		OrganizationalUnit: c.OrganizationalUnit,
+		CommonName:         commonName,
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/rturner3/spire-mysql-demo/pkg/auth"
+	"github.com/rturner3/spire-mysql-demo/pkg/command"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+)
+
+// newX509Source returns a source of the service's X.509-SVID and trust
+// bundles for the mTLS listeners.
+func newX509Source(ctx context.Context, lifecycle *command.Lifecycle, client *workloadapi.Client) (*workloadapi.X509Source, error) {
+	// The source keeps the served SVID and trust bundles up to date as SPIRE rotates them
+	source, err := workloadapi.NewX509Source(ctx, workloadapi.WithClient(client))
+	if err != nil {
+		return nil, fmt.Errorf("unable to create X.509 source: %w", err)
+	}
+	lifecycle.CloseOnShutdown("X.509 source", source)
+	return source, nil
+}
+
+// serveMTLS serves the API over SPIFFE mTLS with the service's X.509-SVID,
+// authorizing callers with the policy.
+func serveMTLS(c *config, lifecycle *command.Lifecycle, source *workloadapi.X509Source, policy *auth.Policy, handler http.Handler) error {
+	ln, err := net.Listen("tcp", c.mtlsListenAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for users API (mTLS) on %s: %w", c.mtlsListenAddr, err)
+	}
+	srv := &http.Server{
+		Handler: auth.MTLSMiddleware(policy, handler),
+	}
+	lifecycle.Serve("users API (mTLS)", srv, tls.NewListener(ln, auth.MTLSServerConfig(source, policy)))
+	return nil
+}
+
+// newJWTHandler wraps handler to require JWT-SVID bearer authentication for
+// the configured audiences, authorizing callers with the policy.
+func newJWTHandler(ctx context.Context, c *config, lifecycle *command.Lifecycle, client *workloadapi.Client, policy *auth.Policy, handler http.Handler) (http.Handler, error) {
+	var audience []string
+	for _, aud := range strings.Split(c.jwtAudience, ",") {
+		if aud = strings.TrimSpace(aud); aud != "" {
+			audience = append(audience, aud)
+		}
+	}
+	if len(audience) == 0 {
+		return nil, fmt.Errorf("invalid JWT audience %q", c.jwtAudience)
+	}
+
+	// The source keeps the JWT bundles up to date as SPIRE rotates the signing keys
+	source, err := workloadapi.NewJWTSource(ctx, workloadapi.WithClient(client))
+	if err != nil {
+		return nil, fmt.Errorf("unable to create JWT source: %w", err)
+	}
+	lifecycle.CloseOnShutdown("JWT source", source)
+
+	log.Printf("Requiring JWT-SVIDs for audience %v on the plain HTTP listener", audience)
+	return auth.JWTMiddleware(source, audience, policy, handler), nil
+}
+
+// withProbes serves the health and readiness probes without authentication,
+// which the kubelet can't provide, and the rest of the API with handler.
+func withProbes(h *handler, handler http.Handler) http.Handler {
+	mux := http.NewServeMux()
+	h.registerProbes(mux)
+	mux.Handle("/", handler)
+	return mux
+}
+
+// loadPolicy loads the authorization policy file, defaulting to allowing any
+// caller in the service's trust domain.
+func loadPolicy(c *config, x509Context *workloadapi.X509Context) (*auth.Policy, error) {
+	if c.authzPolicyFile != "" {
+		return auth.LoadPolicyFile(c.authzPolicyFile)
+	}
+
+	svid := x509Context.DefaultSVID()
+	if svid == nil {
+		return nil, fmt.Errorf("no X.509-SVID to derive the trust domain from")
+	}
+	td := svid.ID.TrustDomain()
+	log.Printf("No authorization policy file; allowing any caller in trust domain %q", td)
+	return auth.MemberOfPolicy(td), nil
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rturner3/spire-mysql-demo/pkg/store"
+	"github.com/rturner3/spire-mysql-demo/pkg/usersapi"
+)
+
+// errMalformedRow is reported for rows of a batch create request that can't be
+// decoded.
+var errMalformedRow = errors.New("malformed row")
+
+// rowReader reads the names of the users to create from a batch create
+// request body, one row at a time. It returns io.EOF after the last row, a
+// rowError for a row that can't be decoded, and any other error when the body
+// can't be read any further.
+type rowReader interface {
+	next() (string, error)
+}
+
+// rowError is returned for a row that can't be decoded; the rows after it can
+// still be read.
+type rowError struct {
+	err error
+}
+
+func (e rowError) Error() string {
+	return e.err.Error()
+}
+
+type ndjsonRowReader struct {
+	scanner *bufio.Scanner
+}
+
+func (r *ndjsonRowReader) next() (string, error) {
+	for r.scanner.Scan() {
+		line := strings.TrimSpace(r.scanner.Text())
+		if line == "" {
+			continue
+		}
+		var req usersapi.CreateUserRequest
+		if err := json.Unmarshal([]byte(line), &req); err != nil {
+			return "", rowError{errMalformedRow}
+		}
+		return req.Name, nil
+	}
+	if err := r.scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", io.EOF
+}
+
+type csvRowReader struct {
+	reader  *csv.Reader
+	nameCol int
+}
+
+func newCSVRowReader(body io.Reader) (*csvRowReader, error) {
+	reader := csv.NewReader(body)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("malformed CSV header: %w", err)
+	}
+	for i, col := range header {
+		if strings.EqualFold(strings.TrimSpace(col), "name") {
+			return &csvRowReader{reader: reader, nameCol: i}, nil
+		}
+	}
+	return nil, errors.New("CSV header has no name column")
+}
+
+func (r *csvRowReader) next() (string, error) {
+	record, err := r.reader.Read()
+	var parseErr *csv.ParseError
+	switch {
+	case errors.As(err, &parseErr):
+		return "", rowError{errMalformedRow}
+	case err != nil:
+		return "", err
+	case r.nameCol >= len(record):
+		return "", rowError{errors.New("row has no name column")}
+	}
+	return record[r.nameCol], nil
+}
+
+// newRowReader returns a reader for the rows of the request body, by its
+// content type.
+func newRowReader(req *http.Request) (rowReader, int, error) {
+	mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil {
+		mediaType = ""
+	}
+	switch mediaType {
+	case usersapi.NDJSONContentType:
+		return &ndjsonRowReader{scanner: bufio.NewScanner(req.Body)}, 0, nil
+	case usersapi.CSVContentType:
+		reader, err := newCSVRowReader(req.Body)
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		return reader, 0, nil
+	default:
+		return nil, http.StatusUnsupportedMediaType, fmt.Errorf("content type must be %s or %s", usersapi.NDJSONContentType, usersapi.CSVContentType)
+	}
+}
+
+// rowsPerBatch returns the number of users created per INSERT and flushed per
+// response chunk.
+func (h *handler) rowsPerBatch() int {
+	if h.batchSize <= 0 {
+		return store.DefaultBatchSize
+	}
+	return h.batchSize
+}
+
+// batchCreate creates the users of the request body in batches, streaming the
+// result of each row as NDJSON as soon as its batch is done.
+func (h *handler) batchCreate(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	rows, status, err := newRowReader(r)
+	if err != nil {
+		writeStatusErr(w, status, err)
+		return
+	}
+
+	// Results are flushed while the rest of the body is still being read,
+	// which HTTP/1 only allows in full duplex; HTTP/2 always is
+	if err := http.NewResponseController(w).EnableFullDuplex(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		log.Printf("Failed to enable full duplex for batch create: %v", err)
+	}
+	w.Header().Set("Content-Type", usersapi.NDJSONContentType)
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+
+	row := 0
+	for done := false; !done; {
+		// Results are written in the order of the rows, so invalid rows are
+		// reported along with the batch they were read in
+		results := make([]usersapi.BatchCreateResult, 0, h.rowsPerBatch())
+		var users []store.User
+		var userResults []int
+		for len(results) < h.rowsPerBatch() {
+			name, err := rows.next()
+			if errors.Is(err, io.EOF) {
+				done = true
+				break
+			}
+			row++
+			var rowErr rowError
+			if errors.As(err, &rowErr) {
+				results = append(results, usersapi.BatchCreateResult{Row: row, Error: rowErr.Error(), Code: usersapi.CodeInvalidArgument})
+				continue
+			}
+			if err != nil {
+				// The rest of the body can't be read, so report it on the row
+				// it stopped at
+				log.Printf("Failed to read batch create request body: %v", err)
+				results = append(results, usersapi.BatchCreateResult{Row: row, Error: fmt.Sprintf("failed to read request body: %v", err), Code: usersapi.CodeInvalidArgument})
+				done = true
+				break
+			}
+			if err := usersapi.ValidateName(name); err != nil {
+				results = append(results, usersapi.BatchCreateResult{Row: row, Error: err.Error(), Code: usersapi.CodeInvalidArgument})
+				continue
+			}
+			userResults = append(userResults, len(results))
+			users = append(users, store.User{Name: name})
+			results = append(results, usersapi.BatchCreateResult{Row: row})
+		}
+
+		if len(users) > 0 {
+			for i, created := range h.dbStore.CreateUsers(r.Context(), users) {
+				result := &results[userResults[i]]
+				if created.Err != nil {
+					_, body := storeError(created.Err)
+					result.Error, result.Code = body.Error, body.Code
+					continue
+				}
+				user := apiUser(created.User)
+				result.User = &user
+			}
+		}
+		for _, result := range results {
+			if err := enc.Encode(result); err != nil {
+				log.Printf("Failed to write batch create result: %v", err)
+				return
+			}
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+// csvExportHeader names the columns of a CSV export.
+var csvExportHeader = []string{"id", "name", "created_by", "version", "created_at", "updated_at"}
+
+// csvExportRecord returns the CSV export row of the user, with times in RFC 3339.
+func csvExportRecord(user store.User) []string {
+	return []string{
+		strconv.Itoa(user.ID),
+		user.Name,
+		user.CreatedBy,
+		strconv.FormatInt(user.Version, 10),
+		user.CreatedAt.UTC().Format(time.RFC3339),
+		user.UpdatedAt.UTC().Format(time.RFC3339),
+	}
+}
+
+// export streams all users as NDJSON or CSV.
+func (h *handler) export(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var write func(store.User) error
+	var start func() error
+	switch format := r.URL.Query().Get(usersapi.FormatParam); format {
+	case "", usersapi.FormatNDJSON:
+		enc := json.NewEncoder(w)
+		start = func() error {
+			w.Header().Set("Content-Type", usersapi.NDJSONContentType)
+			return nil
+		}
+		write = func(user store.User) error {
+			return enc.Encode(apiUser(user))
+		}
+	case usersapi.FormatCSV:
+		csvWriter := csv.NewWriter(w)
+		start = func() error {
+			w.Header().Set("Content-Type", usersapi.CSVContentType)
+			if err := csvWriter.Write(csvExportHeader); err != nil {
+				return err
+			}
+			csvWriter.Flush()
+			return csvWriter.Error()
+		}
+		write = func(user store.User) error {
+			if err := csvWriter.Write(csvExportRecord(user)); err != nil {
+				return err
+			}
+			csvWriter.Flush()
+			return csvWriter.Error()
+		}
+	default:
+		writeStatusErr(w, http.StatusBadRequest, fmt.Errorf("unsupported format %q; must be %s or %s", format, usersapi.FormatNDJSON, usersapi.FormatCSV))
+		return
+	}
+
+	// The status is only sent with the first user, so that failing to read
+	// the first batch is still reported as an error
+	started := false
+	startOnce := func() error {
+		if started {
+			return nil
+		}
+		started = true
+		return start()
+	}
+	flusher, _ := w.(http.Flusher)
+	exported := 0
+	err := h.dbStore.ExportUsers(r.Context(), func(user store.User) error {
+		if err := startOnce(); err != nil {
+			return err
+		}
+		if err := write(user); err != nil {
+			return err
+		}
+		if exported++; flusher != nil && exported%h.rowsPerBatch() == 0 {
+			flusher.Flush()
+		}
+		return nil
+	})
+	switch {
+	case err != nil && !started:
+		writeStoreErr(w, err)
+	case err != nil:
+		// Abort the response so that the client sees a truncated export fail
+		// rather than end as if it were complete
+		log.Printf("Failed to export users after %d users: %v", exported, err)
+		panic(http.ErrAbortHandler)
+	default:
+		if err := startOnce(); err != nil {
+			log.Printf("Failed to write users export: %v", err)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rturner3/spire-mysql-demo/pkg/store"
+	"github.com/rturner3/spire-mysql-demo/pkg/usersapi"
+)
+
+func TestBatchCreateRejectsInvalidRequests(t *testing.T) {
+	mux := http.NewServeMux()
+	// Invalid requests must be rejected before reaching the store
+	(&handler{}).register(mux)
+
+	for _, tt := range []struct {
+		name         string
+		method       string
+		path         string
+		contentType  string
+		body         string
+		expectStatus int
+	}{
+		{name: "unsupported content type", method: http.MethodPost, path: usersapi.BatchCreatePath, contentType: "application/json", body: `[]`, expectStatus: http.StatusUnsupportedMediaType},
+		{name: "CSV without name column", method: http.MethodPost, path: usersapi.BatchCreatePath, contentType: usersapi.CSVContentType, body: "id\n1\n", expectStatus: http.StatusBadRequest},
+		{name: "batch create method not allowed", method: http.MethodGet, path: usersapi.BatchCreatePath, expectStatus: http.StatusMethodNotAllowed},
+		{name: "unsupported export format", method: http.MethodGet, path: usersapi.ExportPath + "?format=xml", expectStatus: http.StatusBadRequest},
+		{name: "export method not allowed", method: http.MethodPost, path: usersapi.ExportPath, expectStatus: http.StatusMethodNotAllowed},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", tt.contentType)
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+			if rec.Code != tt.expectStatus {
+				t.Fatalf("expected status %d; got %d: %s", tt.expectStatus, rec.Code, rec.Body)
+			}
+		})
+	}
+}
+
+func TestBatchCreateReportsInvalidRows(t *testing.T) {
+	mux := http.NewServeMux()
+	// Only invalid rows, which must be reported without reaching the store
+	(&handler{batchSize: 2}).register(mux)
+
+	for _, tt := range []struct {
+		name        string
+		contentType string
+		body        string
+		expectRows  []int
+	}{
+		{
+			name:        "NDJSON",
+			contentType: usersapi.NDJSONContentType + "; charset=utf-8",
+			body:        "{\"name\":\"\"}\n\n{\"name\":\n{\"name\":\"" + strings.Repeat("a", usersapi.MaxNameLength+1) + "\"}\n",
+			expectRows:  []int{1, 2, 3},
+		},
+		{
+			name:        "CSV",
+			contentType: usersapi.CSVContentType,
+			body:        "id,name\n1,\n2,\"unterminated\n",
+			expectRows:  []int{1, 2},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, usersapi.BatchCreatePath, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", tt.contentType)
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("expected status %d; got %d: %s", http.StatusOK, rec.Code, rec.Body)
+			}
+			if ct := rec.Header().Get("Content-Type"); ct != usersapi.NDJSONContentType {
+				t.Fatalf("expected NDJSON content type; got %q", ct)
+			}
+
+			var rows []int
+			dec := json.NewDecoder(rec.Body)
+			for dec.More() {
+				var result usersapi.BatchCreateResult
+				if err := dec.Decode(&result); err != nil {
+					t.Fatalf("failed to decode result: %v", err)
+				}
+				if result.Error == "" || result.User != nil {
+					t.Fatalf("expected row %d to fail; got %+v", result.Row, result)
+				}
+				rows = append(rows, result.Row)
+			}
+			if !reflect.DeepEqual(rows, tt.expectRows) {
+				t.Fatalf("expected results for rows %v; got %v", tt.expectRows, rows)
+			}
+		})
+	}
+}
+
+func TestBatchCreateReadsBodyAfterFlushing(t *testing.T) {
+	mux := http.NewServeMux()
+	// Only invalid rows, which must be reported without reaching the store
+	(&handler{batchSize: 2}).register(mux)
+	// A real HTTP/1 server, which unlike the recorder stops reading the
+	// request body once the response is flushed, unless in full duplex
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	// More rows than fit in the first read of the body, let alone one batch
+	const numRows = 500
+	row := "{\"name\":\"" + strings.Repeat("a", usersapi.MaxNameLength+1) + "\"}\n"
+	resp, err := http.Post(server.URL+usersapi.BatchCreatePath, usersapi.NDJSONContentType, strings.NewReader(strings.Repeat(row, numRows)))
+	if err != nil {
+		t.Fatalf("failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d; got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	rows := 0
+	dec := json.NewDecoder(resp.Body)
+	for dec.More() {
+		var result usersapi.BatchCreateResult
+		if err := dec.Decode(&result); err != nil {
+			t.Fatalf("failed to decode result: %v", err)
+		}
+		if rows++; result.Row != rows || !strings.Contains(result.Error, "name") {
+			t.Fatalf("expected row %d to fail validation; got %+v", rows, result)
+		}
+	}
+	if rows != numRows {
+		t.Fatalf("expected %d results; got %d", numRows, rows)
+	}
+}
+
+func TestExportCSVRecord(t *testing.T) {
+	expectHeader := []string{"id", "name", "created_by", "version", "created_at", "updated_at"}
+	if !reflect.DeepEqual(csvExportHeader, expectHeader) {
+		t.Fatalf("expected CSV header %q; got %q", expectHeader, csvExportHeader)
+	}
+
+	createdAt := time.Date(2024, 1, 2, 3, 4, 5, 600, time.FixedZone("CET", 3600))
+	user := store.User{ID: 4, Name: "David", CreatedBy: "spiffe://example.org/writer", Version: 2, CreatedAt: createdAt, UpdatedAt: createdAt.Add(time.Hour)}
+	expect := []string{"4", "David", "spiffe://example.org/writer", "2", "2024-01-02T02:04:05Z", "2024-01-02T03:04:05Z"}
+	if record := csvExportRecord(user); !reflect.DeepEqual(record, expect) {
+		t.Fatalf("expected CSV record %q; got %q", expect, record)
+	}
+}
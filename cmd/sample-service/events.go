@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/rturner3/spire-mysql-demo/pkg/command"
+	"github.com/rturner3/spire-mysql-demo/pkg/outbox"
+	"github.com/rturner3/spire-mysql-demo/pkg/store"
+)
+
+// webhookTimeout bounds each webhook request, so that a hung webhook is
+// retried rather than blocking the relay
+const webhookTimeout = 10 * time.Second
+
+// newEventsSink returns the sink set with -events-sink: a webhook for http
+// and https URLs, or an NDJSON file for file URLs.
+func newEventsSink(sink string) (outbox.Sink, error) {
+	u, err := url.Parse(sink)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return outbox.NewWebhookSink(sink, &http.Client{Timeout: webhookTimeout}), nil
+	case "file":
+		path := u.Path
+		if path == "" {
+			path = u.Opaque
+		}
+		if path == "" {
+			return nil, errors.New("file URL has no path")
+		}
+		return outbox.NewFileSink(path)
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q; must be http, https or file", u.Scheme)
+	}
+}
+
+// startRelay publishes the user change events of the store to the sink set
+// with -events-sink until shutdown.
+func startRelay(ctx context.Context, c *config, lifecycle *command.Lifecycle, dbStore *store.Store) error {
+	sink, err := newEventsSink(c.eventsSink)
+	if err != nil {
+		return fmt.Errorf("invalid -events-sink: %w", err)
+	}
+	if fileSink, ok := sink.(*outbox.FileSink); ok {
+		lifecycle.CloseOnShutdown("events file", fileSink)
+	}
+
+	relay := outbox.NewRelay(dbStore, sink, outbox.WithPollInterval(c.eventsPollInterval))
+	expvar.Publish("events", expvar.Func(func() any {
+		return relay.Stats()
+	}))
+
+	done := make(chan struct{})
+	lifecycle.OnShutdown("events relay", func(ctx context.Context) error {
+		select {
+		case <-done:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	log.Printf("Relaying user events to %s", c.eventsSink)
+	go func() {
+		defer close(done)
+		relay.Run(ctx)
+	}()
+	return nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/rturner3/spire-mysql-demo/pkg/outbox"
+)
+
+func TestNewEventsSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.ndjson")
+	for _, tt := range []struct {
+		sink       string
+		expectFile bool
+		expectErr  bool
+	}{
+		{sink: "https://events.example.org/users"},
+		{sink: "http://localhost:8080/users"},
+		{sink: "file://" + path, expectFile: true},
+		{sink: "file:" + path, expectFile: true},
+		{sink: "file://", expectErr: true},
+		{sink: "kafka://events:9092", expectErr: true},
+		{sink: path, expectErr: true},
+	} {
+		t.Run(tt.sink, func(t *testing.T) {
+			sink, err := newEventsSink(tt.sink)
+			if tt.expectErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to create sink: %v", err)
+			}
+			fileSink, ok := sink.(*outbox.FileSink)
+			if ok != tt.expectFile {
+				t.Fatalf("expected a file sink: %t; got %T", tt.expectFile, sink)
+			}
+			if ok {
+				fileSink.Close()
+			}
+		})
+	}
+}
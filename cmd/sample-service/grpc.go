@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/rturner3/spire-mysql-demo/pkg/auth"
+	"github.com/rturner3/spire-mysql-demo/pkg/command"
+	"github.com/rturner3/spire-mysql-demo/pkg/common"
+	"github.com/rturner3/spire-mysql-demo/pkg/store"
+	"github.com/rturner3/spire-mysql-demo/pkg/usersapi"
+	usersv1 "github.com/rturner3/spire-mysql-demo/proto/users/v1"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// serveGRPC serves the UsersService gRPC API over SPIFFE mTLS with the
+// service's X.509-SVID, authorizing callers with the policy.
+func serveGRPC(c *config, lifecycle *command.Lifecycle, source *workloadapi.X509Source, policy *auth.Policy, dbStore *store.Store) error {
+	ln, err := net.Listen("tcp", c.grpcListenAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for users gRPC API on %s: %w", c.grpcListenAddr, err)
+	}
+
+	srv := grpc.NewServer(
+		grpc.Creds(auth.MTLSServerCredentials(source, policy)),
+		grpc.ChainUnaryInterceptor(auth.UnaryServerInterceptor(policy), attributeCallerInterceptor, readYourWritesInterceptor),
+	)
+	usersv1.RegisterUsersServiceServer(srv, &usersServer{dbStore: dbStore})
+
+	lifecycle.OnShutdown("users gRPC API", func(ctx context.Context) error {
+		return gracefulStop(ctx, srv)
+	})
+	log.Printf("Serving users gRPC API on %s", ln.Addr())
+	go func() {
+		if err := srv.Serve(ln); err != nil {
+			lifecycle.Fail(fmt.Errorf("users gRPC API failed: %w", err))
+		}
+	}()
+	return nil
+}
+
+// gracefulStop waits for in-flight RPCs to finish, stopping the server
+// forcefully if ctx is done first.
+func gracefulStop(ctx context.Context, srv *grpc.Server) error {
+	done := make(chan struct{})
+	go func() {
+		srv.GracefulStop()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		srv.Stop()
+		return ctx.Err()
+	}
+}
+
+// attributeCallerInterceptor attributes the store operations made while
+// handling a call to the caller authenticated by auth.UnaryServerInterceptor.
+func attributeCallerInterceptor(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if id, ok := auth.CallerID(ctx); ok {
+		ctx = store.WithCaller(ctx, id.String())
+	}
+	return handler(ctx, req)
+}
+
+// readYourWritesInterceptor reads from the MySQL primary for calls whose
+// metadata asks to observe their earlier writes, like the HTTP header does.
+func readYourWritesInterceptor(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if values := metadata.ValueFromIncomingContext(ctx, strings.ToLower(usersapi.ReadYourWritesHeader)); len(values) > 0 && values[0] == "true" {
+		ctx = store.WithReadYourWrites(ctx)
+	}
+	return handler(ctx, req)
+}
+
+// usersServer implements the UsersService gRPC API over the same store, and
+// DB pool rotation, as the HTTP handlers.
+type usersServer struct {
+	usersv1.UnimplementedUsersServiceServer
+
+	dbStore *store.Store
+}
+
+func (s *usersServer) ListUsers(ctx context.Context, req *usersv1.ListUsersRequest) (*usersv1.ListUsersResponse, error) {
+	var opts []store.ListOption
+	if req.IncludeDeleted {
+		opts = append(opts, store.IncludeDeleted())
+	}
+	users, err := s.dbStore.ListUsers(ctx, opts...)
+	if err != nil {
+		return nil, storeStatus(err)
+	}
+
+	resp := &usersv1.ListUsersResponse{
+		Users: make([]*usersv1.User, 0, len(users)),
+	}
+	for _, user := range users {
+		resp.Users = append(resp.Users, userProto(user))
+	}
+	return resp, nil
+}
+
+func (s *usersServer) GetUser(ctx context.Context, req *usersv1.GetUserRequest) (*usersv1.GetUserResponse, error) {
+	user, err := s.dbStore.GetUser(ctx, int(req.Id))
+	if err != nil {
+		return nil, storeStatus(err)
+	}
+	return &usersv1.GetUserResponse{User: userProto(user)}, nil
+}
+
+func (s *usersServer) CreateUser(ctx context.Context, req *usersv1.CreateUserRequest) (*usersv1.CreateUserResponse, error) {
+	if err := usersapi.ValidateName(req.Name); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	user, err := s.dbStore.CreateUser(ctx, store.User{Name: req.Name})
+	if err != nil {
+		return nil, storeStatus(err)
+	}
+	return &usersv1.CreateUserResponse{User: userProto(user)}, nil
+}
+
+func (s *usersServer) UpdateUser(ctx context.Context, req *usersv1.UpdateUserRequest) (*usersv1.UpdateUserResponse, error) {
+	if err := usersapi.ValidateName(req.Name); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	user, err := s.dbStore.UpdateUser(ctx, store.User{ID: int(req.Id), Name: req.Name, Version: req.Version})
+	if err != nil {
+		return nil, storeStatus(err)
+	}
+	return &usersv1.UpdateUserResponse{User: userProto(user)}, nil
+}
+
+func (s *usersServer) DeleteUser(ctx context.Context, req *usersv1.DeleteUserRequest) (*usersv1.DeleteUserResponse, error) {
+	if err := s.dbStore.DeleteUser(ctx, int(req.Id), req.Version); err != nil {
+		return nil, storeStatus(err)
+	}
+	return &usersv1.DeleteUserResponse{}, nil
+}
+
+func userProto(user store.User) *usersv1.User {
+	pb := &usersv1.User{
+		Id:         int32(user.ID),
+		Name:       user.Name,
+		CreatedBy:  user.CreatedBy,
+		Version:    user.Version,
+		CreateTime: timestamppb.New(user.CreatedAt),
+		UpdateTime: timestamppb.New(user.UpdatedAt),
+	}
+	if user.DeletedAt != nil {
+		pb.DeleteTime = timestamppb.New(*user.DeletedAt)
+	}
+	return pb
+}
+
+// storeStatus converts a store error to a gRPC status.
+func storeStatus(err error) error {
+	var connErr *common.ConnError
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, store.ErrVersionMismatch):
+		return status.Error(codes.Aborted, err.Error())
+	case errors.Is(err, store.ErrCircuitOpen), errors.Is(err, store.ErrOverloaded):
+		return status.Error(codes.Unavailable, err.Error())
+	case errors.Is(err, store.ErrTimeout):
+		return status.Error(codes.DeadlineExceeded, store.ErrTimeout.Error())
+	case errors.As(err, &connErr):
+		log.Printf("Failed to connect to MySQL: %v", err)
+		return status.Error(codes.Unavailable, connErr.Kind.Error())
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	default:
+		log.Printf("Internal error: %v", err)
+		return status.Error(codes.Internal, "failed to access the users store")
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/rturner3/spire-mysql-demo/pkg/common"
+	"github.com/rturner3/spire-mysql-demo/pkg/store"
+	"github.com/rturner3/spire-mysql-demo/pkg/usersapi"
+	usersv1 "github.com/rturner3/spire-mysql-demo/proto/users/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestUsersServerRejectsInvalidNames(t *testing.T) {
+	// Invalid requests must be rejected before reaching the store
+	s := &usersServer{}
+
+	for _, name := range []string{"", strings.Repeat("a", usersapi.MaxNameLength+1)} {
+		_, err := s.CreateUser(context.Background(), &usersv1.CreateUserRequest{Name: name})
+		if code := status.Code(err); code != codes.InvalidArgument {
+			t.Fatalf("expected CreateUser(%q) to fail with %s; got %v", name, codes.InvalidArgument, err)
+		}
+		_, err = s.UpdateUser(context.Background(), &usersv1.UpdateUserRequest{Id: 1, Name: name})
+		if code := status.Code(err); code != codes.InvalidArgument {
+			t.Fatalf("expected UpdateUser(%q) to fail with %s; got %v", name, codes.InvalidArgument, err)
+		}
+	}
+}
+
+func TestStoreStatus(t *testing.T) {
+	for _, tt := range []struct {
+		err        error
+		expectCode codes.Code
+	}{
+		{err: store.ErrNotFound, expectCode: codes.NotFound},
+		{err: store.ErrVersionMismatch, expectCode: codes.Aborted},
+		{err: store.ErrCircuitOpen, expectCode: codes.Unavailable},
+		{err: store.ErrOverloaded, expectCode: codes.Unavailable},
+		{err: fmt.Errorf("%w: ListUsers exceeded 10s: %w", store.ErrTimeout, errors.New("i/o timeout")), expectCode: codes.DeadlineExceeded},
+		{err: fmt.Errorf("query: %w", context.DeadlineExceeded), expectCode: codes.DeadlineExceeded},
+		{err: context.Canceled, expectCode: codes.Canceled},
+		{err: &common.ConnError{Kind: common.ErrSVIDExpired, Err: errors.New("x509: certificate has expired")}, expectCode: codes.Unavailable},
+		{err: errors.New("connection refused"), expectCode: codes.Internal},
+	} {
+		if code := status.Code(storeStatus(tt.err)); code != tt.expectCode {
+			t.Fatalf("expected %v to map to %s; got %s", tt.err, tt.expectCode, code)
+		}
+	}
+}
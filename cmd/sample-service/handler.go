@@ -0,0 +1,358 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/rturner3/spire-mysql-demo/pkg/common"
+	"github.com/rturner3/spire-mysql-demo/pkg/store"
+	"github.com/rturner3/spire-mysql-demo/pkg/usersapi"
+	"github.com/rturner3/spire-mysql-demo/pkg/watch"
+)
+
+const (
+	// varsPath serves the process metrics published with expvar, e.g. the
+	// store's DB swap statistics
+	varsPath = "/debug/vars"
+	// healthPath serves the store's health, with a 503 status while its
+	// circuit breaker is open
+	healthPath = "/healthz"
+	// readyPath answers as soon as the API is served, whatever the store's
+	// health, for the readiness probe
+	readyPath = "/readyz"
+
+	// retryAfter is the number of seconds clients are asked to wait before
+	// retrying requests failed fast by the store
+	retryAfter = "1"
+)
+
+type handler struct {
+	dbStore *store.Store
+
+	// batchSize is the number of users created per INSERT by batch create
+	// requests
+	batchSize int
+	// hub streams the user change events to watchers
+	hub *watch.Hub
+}
+
+// register adds the API handlers to mux.
+func (h *handler) register(mux *http.ServeMux) {
+	mux.HandleFunc(usersapi.UsersPath, func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodGet:
+			h.list(w, req)
+		case http.MethodPost:
+			h.create(w, req)
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			writeStatusErr(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", req.Method))
+		}
+	})
+	mux.HandleFunc(usersapi.UsersPath+"/", func(w http.ResponseWriter, req *http.Request) {
+		id, err := strconv.Atoi(strings.TrimPrefix(req.URL.Path, usersapi.UsersPath+"/"))
+		if err != nil {
+			writeStatusErr(w, http.StatusNotFound, store.ErrNotFound)
+			return
+		}
+		switch req.Method {
+		case http.MethodGet:
+			h.get(w, req, id)
+		case http.MethodPut:
+			h.update(w, req, id)
+		case http.MethodDelete:
+			h.delete(w, req, id)
+		default:
+			w.Header().Set("Allow", "GET, PUT, DELETE")
+			writeStatusErr(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", req.Method))
+		}
+	})
+	mux.HandleFunc(usersapi.BatchCreatePath, func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			writeStatusErr(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", req.Method))
+			return
+		}
+		h.batchCreate(w, req)
+	})
+	mux.HandleFunc(usersapi.ExportPath, func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			writeStatusErr(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", req.Method))
+			return
+		}
+		h.export(w, req)
+	})
+	mux.HandleFunc(usersapi.WatchPath, func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			writeStatusErr(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", req.Method))
+			return
+		}
+		h.watch(w, req)
+	})
+	mux.Handle(varsPath, expvar.Handler())
+	h.registerProbes(mux)
+	mux.HandleFunc(usersapi.OpenAPIPath, func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(usersapi.OpenAPISpec)
+	})
+}
+
+func (h *handler) list(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var opts []store.ListOption
+	if r.URL.Query().Get(usersapi.IncludeDeletedParam) == "true" {
+		opts = append(opts, store.IncludeDeleted())
+	}
+	users, err := h.dbStore.ListUsers(r.Context(), opts...)
+	if err != nil {
+		writeStoreErr(w, err)
+		return
+	}
+
+	apiUsers := make([]usersapi.User, 0, len(users))
+	for _, user := range users {
+		apiUsers = append(apiUsers, apiUser(user))
+	}
+	data, err := json.Marshal(apiUsers)
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+func (h *handler) create(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+
+	var req usersapi.CreateUserRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeStatusErr(w, http.StatusBadRequest, errors.New("malformed request body"))
+		return
+	}
+	if err := req.Validate(); err != nil {
+		writeStatusErr(w, http.StatusBadRequest, err)
+		return
+	}
+
+	user, err := h.dbStore.CreateUser(r.Context(), store.User{Name: req.Name})
+	if err != nil {
+		writeStoreErr(w, err)
+		return
+	}
+	w.Header().Set("Location", usersapi.UserPath(user.ID))
+	writeUser(w, http.StatusCreated, user)
+}
+
+func (h *handler) get(w http.ResponseWriter, r *http.Request, id int) {
+	w.Header().Set("Content-Type", "application/json")
+	user, err := h.dbStore.GetUser(r.Context(), id)
+	if err != nil {
+		writeStoreErr(w, err)
+		return
+	}
+	writeUser(w, http.StatusOK, user)
+}
+
+func (h *handler) update(w http.ResponseWriter, r *http.Request, id int) {
+	w.Header().Set("Content-Type", "application/json")
+	version, ok := ifMatchVersion(r)
+	if !ok {
+		writeStatusErr(w, http.StatusPreconditionFailed, store.ErrVersionMismatch)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+
+	var req usersapi.UpdateUserRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeStatusErr(w, http.StatusBadRequest, errors.New("malformed request body"))
+		return
+	}
+	if err := req.Validate(); err != nil {
+		writeStatusErr(w, http.StatusBadRequest, err)
+		return
+	}
+
+	user, err := h.dbStore.UpdateUser(r.Context(), store.User{ID: id, Name: req.Name, Version: version})
+	if err != nil {
+		writeStoreErr(w, err)
+		return
+	}
+	writeUser(w, http.StatusOK, user)
+}
+
+func (h *handler) delete(w http.ResponseWriter, r *http.Request, id int) {
+	w.Header().Set("Content-Type", "application/json")
+	version, ok := ifMatchVersion(r)
+	if !ok {
+		writeStatusErr(w, http.StatusPreconditionFailed, store.ErrVersionMismatch)
+		return
+	}
+	if err := h.dbStore.DeleteUser(r.Context(), id, version); err != nil {
+		writeStoreErr(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// registerProbes adds the health and readiness handlers to mux.
+func (h *handler) registerProbes(mux *http.ServeMux) {
+	mux.HandleFunc(healthPath, h.health)
+	mux.HandleFunc(readyPath, func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+// health writes the store's health.
+func (h *handler) health(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	health := h.dbStore.Health()
+	data, err := json.Marshal(health)
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+	if health.Healthy() {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(data)
+}
+
+// ifMatchVersion returns the version the request's If-Match header requires
+// the user to have, or 0 if it has none or "*", which any existing user
+// matches. It returns false if the header can't match any version.
+func ifMatchVersion(r *http.Request) (int64, bool) {
+	ifMatch := strings.TrimSpace(r.Header.Get("If-Match"))
+	if ifMatch == "" || ifMatch == "*" {
+		return 0, true
+	}
+	return usersapi.ParseETag(ifMatch)
+}
+
+// apiUser converts a store user to its API representation.
+func apiUser(user store.User) usersapi.User {
+	return usersapi.User{
+		ID:        user.ID,
+		Name:      user.Name,
+		CreatedBy: user.CreatedBy,
+		Version:   user.Version,
+		CreatedAt: user.CreatedAt,
+		UpdatedAt: user.UpdatedAt,
+		DeletedAt: user.DeletedAt,
+	}
+}
+
+// writeUser writes the user with the status, with its version as ETag.
+func writeUser(w http.ResponseWriter, status int, user store.User) {
+	data, err := json.Marshal(apiUser(user))
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+	w.Header().Set("ETag", usersapi.ETag(user.Version))
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// dbErrorCodes are the error codes of the kinds of MySQL connection failures.
+var dbErrorCodes = map[error]string{
+	common.ErrCertVerification: usersapi.CodeDBTLSVerification,
+	common.ErrServerIDMismatch: usersapi.CodeDBServerIDMismatch,
+	common.ErrSVIDExpired:      usersapi.CodeDBSVIDExpired,
+	common.ErrAccessDenied:     usersapi.CodeDBAccessDenied,
+	common.ErrNetwork:          usersapi.CodeDBUnreachable,
+}
+
+// storeError returns the status and error body a store error maps to. The
+// details of MySQL connection failures and internal errors are only logged, as
+// they may describe the service's certificates and network.
+func storeError(err error) (int, usersapi.Error) {
+	var connErr *common.ConnError
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		return http.StatusNotFound, usersapi.Error{Error: err.Error(), Code: usersapi.CodeNotFound}
+	case errors.Is(err, store.ErrVersionMismatch):
+		return http.StatusPreconditionFailed, usersapi.Error{Error: err.Error(), Code: usersapi.CodeVersionMismatch}
+	case errors.Is(err, store.ErrCircuitOpen):
+		return http.StatusServiceUnavailable, usersapi.Error{Error: err.Error(), Code: usersapi.CodeUnavailable}
+	case errors.Is(err, store.ErrOverloaded):
+		return http.StatusServiceUnavailable, usersapi.Error{Error: err.Error(), Code: usersapi.CodeOverloaded}
+	case errors.Is(err, store.ErrTimeout):
+		return http.StatusGatewayTimeout, usersapi.Error{Error: store.ErrTimeout.Error(), Code: usersapi.CodeTimeout}
+	case errors.As(err, &connErr):
+		log.Printf("Failed to connect to MySQL: %v", err)
+		return http.StatusServiceUnavailable, usersapi.Error{Error: connErr.Kind.Error(), Code: dbErrorCodes[connErr.Kind]}
+	default:
+		return internalError(err)
+	}
+}
+
+// internalError logs err and returns the status and error body it maps to.
+func internalError(err error) (int, usersapi.Error) {
+	log.Printf("Internal error: %v", err)
+	return http.StatusInternalServerError, usersapi.Error{Error: "internal error", Code: usersapi.CodeInternal}
+}
+
+// statusCodes are the error codes of the statuses written by writeStatusErr.
+var statusCodes = map[int]string{
+	http.StatusBadRequest:           usersapi.CodeInvalidArgument,
+	http.StatusNotFound:             usersapi.CodeNotFound,
+	http.StatusMethodNotAllowed:     usersapi.CodeMethodNotAllowed,
+	http.StatusPreconditionFailed:   usersapi.CodeVersionMismatch,
+	http.StatusUnsupportedMediaType: usersapi.CodeUnsupportedMediaType,
+	http.StatusNotImplemented:       usersapi.CodeNotImplemented,
+}
+
+// writeStoreErr writes a store error with the status and code it maps to.
+func writeStoreErr(w http.ResponseWriter, err error) {
+	status, body := storeError(err)
+	if status == http.StatusServiceUnavailable {
+		w.Header().Set("Retry-After", retryAfter)
+	}
+	writeError(w, status, body)
+}
+
+// writeErr logs err and writes an internal error, without its details.
+func writeErr(w http.ResponseWriter, err error) {
+	status, body := internalError(err)
+	writeError(w, status, body)
+}
+
+// writeStatusErr writes err with the status and the code of the status.
+func writeStatusErr(w http.ResponseWriter, status int, err error) {
+	code, ok := statusCodes[status]
+	if !ok {
+		code = usersapi.CodeInternal
+	}
+	writeError(w, status, usersapi.Error{Error: err.Error(), Code: code})
+}
+
+func writeError(w http.ResponseWriter, status int, body usersapi.Error) {
+	data, _ := json.Marshal(body)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
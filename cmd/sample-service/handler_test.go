@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rturner3/spire-mysql-demo/pkg/common"
+	"github.com/rturner3/spire-mysql-demo/pkg/store"
+	"github.com/rturner3/spire-mysql-demo/pkg/usersapi"
+)
+
+func TestHandlerRejectsInvalidRequests(t *testing.T) {
+	mux := http.NewServeMux()
+	// Invalid requests must be rejected before reaching the store
+	(&handler{}).register(mux)
+
+	for _, tt := range []struct {
+		name         string
+		method       string
+		path         string
+		ifMatch      string
+		body         string
+		expectStatus int
+		expectCode   string
+	}{
+		{name: "malformed body", method: http.MethodPost, body: `{"name":`, expectStatus: http.StatusBadRequest, expectCode: usersapi.CodeInvalidArgument},
+		{name: "missing name", method: http.MethodPost, body: `{}`, expectStatus: http.StatusBadRequest, expectCode: usersapi.CodeInvalidArgument},
+		{name: "name too long", method: http.MethodPost, body: `{"name":"` + strings.Repeat("a", usersapi.MaxNameLength+1) + `"}`, expectStatus: http.StatusBadRequest, expectCode: usersapi.CodeInvalidArgument},
+		{name: "method not allowed", method: http.MethodPut, expectStatus: http.StatusMethodNotAllowed, expectCode: usersapi.CodeMethodNotAllowed},
+		{name: "invalid user ID", method: http.MethodGet, path: usersapi.UsersPath + "/David", expectStatus: http.StatusNotFound, expectCode: usersapi.CodeNotFound},
+		{name: "user method not allowed", method: http.MethodPost, path: usersapi.UserPath(1), expectStatus: http.StatusMethodNotAllowed, expectCode: usersapi.CodeMethodNotAllowed},
+		{name: "update missing name", method: http.MethodPut, path: usersapi.UserPath(1), body: `{}`, expectStatus: http.StatusBadRequest, expectCode: usersapi.CodeInvalidArgument},
+		{name: "update weak ETag", method: http.MethodPut, path: usersapi.UserPath(1), ifMatch: `W/"1"`, body: `{"name":"David"}`, expectStatus: http.StatusPreconditionFailed, expectCode: usersapi.CodeVersionMismatch},
+		{name: "watch method not allowed", method: http.MethodPost, path: usersapi.WatchPath, expectStatus: http.StatusMethodNotAllowed, expectCode: usersapi.CodeMethodNotAllowed},
+		{name: "delete malformed ETag", method: http.MethodDelete, path: usersapi.UserPath(1), ifMatch: "1", expectStatus: http.StatusPreconditionFailed, expectCode: usersapi.CodeVersionMismatch},
+		{name: "unsupported export format", method: http.MethodGet, path: usersapi.ExportPath + "?format=xml", expectStatus: http.StatusBadRequest, expectCode: usersapi.CodeInvalidArgument},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path := tt.path
+			if path == "" {
+				path = usersapi.UsersPath
+			}
+			req := httptest.NewRequest(tt.method, path, strings.NewReader(tt.body))
+			if tt.ifMatch != "" {
+				req.Header.Set("If-Match", tt.ifMatch)
+			}
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+			if rec.Code != tt.expectStatus {
+				t.Fatalf("expected status %d; got %d: %s", tt.expectStatus, rec.Code, rec.Body)
+			}
+			var body usersapi.Error
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body.Code != tt.expectCode || body.Error == "" {
+				t.Fatalf("expected an error with code %q; got %s (err=%v)", tt.expectCode, rec.Body, err)
+			}
+		})
+	}
+}
+
+func TestHandlerServesOpenAPISpec(t *testing.T) {
+	mux := http.NewServeMux()
+	(&handler{}).register(mux)
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, usersapi.OpenAPIPath, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d; got %d", http.StatusOK, rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("expected JSON content type; got %q", ct)
+	}
+	if !bytes.Equal(rec.Body.Bytes(), usersapi.OpenAPISpec) {
+		t.Fatal("expected the OpenAPI document to be served")
+	}
+}
+
+func TestWriteStoreErr(t *testing.T) {
+	expired := &common.ConnError{Kind: common.ErrSVIDExpired, Err: errors.New(`x509svid: could not verify leaf certificate: x509: certificate has expired`)}
+	for _, tt := range []struct {
+		err              error
+		expectStatus     int
+		expectCode       string
+		expectRetryAfter bool
+	}{
+		{err: store.ErrNotFound, expectStatus: http.StatusNotFound, expectCode: usersapi.CodeNotFound},
+		{err: store.ErrVersionMismatch, expectStatus: http.StatusPreconditionFailed, expectCode: usersapi.CodeVersionMismatch},
+		{err: store.ErrCircuitOpen, expectStatus: http.StatusServiceUnavailable, expectCode: usersapi.CodeUnavailable, expectRetryAfter: true},
+		{err: store.ErrOverloaded, expectStatus: http.StatusServiceUnavailable, expectCode: usersapi.CodeOverloaded, expectRetryAfter: true},
+		{err: fmt.Errorf("%w: ListUsers exceeded 10s: %w", store.ErrTimeout, errors.New("i/o timeout")), expectStatus: http.StatusGatewayTimeout, expectCode: usersapi.CodeTimeout},
+		{err: fmt.Errorf("list users: %w", expired), expectStatus: http.StatusServiceUnavailable, expectCode: usersapi.CodeDBSVIDExpired, expectRetryAfter: true},
+		{err: &common.ConnError{Kind: common.ErrServerIDMismatch, Err: errors.New(`unexpected ID "spiffe://example.org/mysql/replica"`)}, expectStatus: http.StatusServiceUnavailable, expectCode: usersapi.CodeDBServerIDMismatch, expectRetryAfter: true},
+		{err: &common.ConnError{Kind: common.ErrAccessDenied, Err: errors.New("Error 1045 (28000): Access denied")}, expectStatus: http.StatusServiceUnavailable, expectCode: usersapi.CodeDBAccessDenied, expectRetryAfter: true},
+		{err: errors.New(`Error 1146: Table "Users" doesn't exist`), expectStatus: http.StatusInternalServerError, expectCode: usersapi.CodeInternal},
+	} {
+		rec := httptest.NewRecorder()
+		writeStoreErr(rec, tt.err)
+		if rec.Code != tt.expectStatus {
+			t.Fatalf("expected %v to be written with status %d; got %d", tt.err, tt.expectStatus, rec.Code)
+		}
+		if retryAfter := rec.Header().Get("Retry-After") != ""; retryAfter != tt.expectRetryAfter {
+			t.Fatalf("expected %v to be written with Retry-After %t; got %t", tt.err, tt.expectRetryAfter, retryAfter)
+		}
+		var body usersapi.Error
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body.Code != tt.expectCode {
+			t.Fatalf("expected %v to be written with code %q; got %s (err=%v)", tt.err, tt.expectCode, rec.Body, err)
+		}
+		// The details of connection failures and internal errors are only
+		// logged
+		if tt.expectCode == usersapi.CodeInternal || strings.HasPrefix(tt.expectCode, "db_") {
+			if strings.Contains(body.Error, "x509") || strings.Contains(body.Error, "Error 1") || strings.Contains(body.Error, "spiffe://") {
+				t.Fatalf("expected %v not to be written with its details; got %q", tt.err, body.Error)
+			}
+		}
+	}
+}
+
+func TestHandlerServesHealth(t *testing.T) {
+	mux := http.NewServeMux()
+	(&handler{dbStore: store.New(nil)}).register(mux)
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, healthPath, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d; got %d", http.StatusOK, rec.Code)
+	}
+	var health store.Health
+	if err := json.Unmarshal(rec.Body.Bytes(), &health); err != nil {
+		t.Fatalf("failed to decode health: %v", err)
+	}
+	if health.Circuit != store.CircuitClosed {
+		t.Fatalf("expected a closed circuit; got %+v", health)
+	}
+}
+
+func TestProbesSkipAuthentication(t *testing.T) {
+	h := &handler{dbStore: store.New(nil)}
+	// Stands in for the JWT-SVID middleware rejecting unauthenticated requests
+	handler := withProbes(h, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+
+	for path, expectStatus := range map[string]int{
+		healthPath:         http.StatusOK,
+		readyPath:          http.StatusOK,
+		usersapi.UsersPath: http.StatusUnauthorized,
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != expectStatus {
+			t.Fatalf("expected status %d for %s; got %d", expectStatus, path, rec.Code)
+		}
+	}
+}
+
+func TestAPIUser(t *testing.T) {
+	createdAt := time.Date(2024, 1, 2, 3, 4, 5, 6000, time.UTC)
+	deletedAt := createdAt.Add(time.Hour)
+	user := store.User{ID: 1, Name: "David", CreatedBy: "spiffe://example.org/client", Version: 3, CreatedAt: createdAt, UpdatedAt: deletedAt, DeletedAt: &deletedAt}
+
+	expected := usersapi.User{ID: 1, Name: "David", CreatedBy: "spiffe://example.org/client", Version: 3, CreatedAt: createdAt, UpdatedAt: deletedAt, DeletedAt: &deletedAt}
+	if got := apiUser(user); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %+v; got %+v", expected, got)
+	}
+}
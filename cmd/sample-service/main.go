@@ -2,27 +2,44 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"database/sql"
+	"expvar"
+	"flag"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"os"
-	"os/signal"
+	"strings"
 	"time"
 
+	"github.com/rturner3/spire-mysql-demo/pkg/auth"
+	"github.com/rturner3/spire-mysql-demo/pkg/command"
 	"github.com/rturner3/spire-mysql-demo/pkg/common"
+	"github.com/rturner3/spire-mysql-demo/pkg/outbox"
 	"github.com/rturner3/spire-mysql-demo/pkg/store"
+	"github.com/rturner3/spire-mysql-demo/pkg/usersapi"
+	"github.com/rturner3/spire-mysql-demo/pkg/watch"
 	"github.com/spiffe/go-spiffe/v2/workloadapi"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
 const (
-	usersAPIPath = "/api/v1/users"
+	// listenAddrEnv overrides the default address the API is served on
+	listenAddrEnv     = "LISTEN_ADDR"
+	defaultListenAddr = ":8888"
 
-	// SPIRE Agent socket path
-	socketPath = "unix:///run/spire/sockets/agent.sock"
+	// mtlsListenAddrEnv sets the address the API is served on over SPIFFE mTLS
+	mtlsListenAddrEnv = "MTLS_LISTEN_ADDR"
+
+	// grpcListenAddrEnv sets the address the gRPC API is served on over SPIFFE mTLS
+	grpcListenAddrEnv = "GRPC_LISTEN_ADDR"
+
+	// mysqlReplicasEnv sets the MySQL read replicas, as <addr>=<SPIFFE ID> pairs
+	mysqlReplicasEnv = "MYSQL_REPLICAS"
+
+	// eventsSinkEnv sets the sink user change events are published to
+	eventsSinkEnv = "EVENTS_SINK"
 
 	mysqlUser   = "spire-mysql-client"
 	mysqlDBName = "spiredemo"
@@ -30,116 +47,276 @@ const (
 	dbConnectionLifetime = 30 * time.Hour
 )
 
-type handler struct {
-	dbStore *store.Store
+// config holds the sample-service command-line configuration.
+type config struct {
+	bootstrap       command.Bootstrap
+	plainHTTP       bool
+	mtlsListenAddr  string
+	grpcListenAddr  string
+	jwtAudience     string
+	authzPolicyFile string
+
+	mysqlReplicas              string
+	replicaHealthCheckInterval time.Duration
+	dbDrainTimeout             time.Duration
+	batchSize                  int
+	storeTimeouts              string
+	breakerThreshold           int
+	breakerCooldown            time.Duration
+	maxInFlight                int
+
+	eventsSink         string
+	eventsPollInterval time.Duration
+	watchBufferSize    int
 }
 
-func (h *handler) list(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	users, err := h.dbStore.ListUsers(r.Context())
-	if err != nil {
-		writeErr(w, err)
-		return
-	}
+func (c *config) registerFlags(fs *flag.FlagSet) {
+	c.bootstrap.RegisterFlags(fs)
+	fs.BoolVar(&c.plainHTTP, "plain-http", true, fmt.Sprintf("Serve the API over plain HTTP on $%s (default %s)", listenAddrEnv, defaultListenAddr))
+	fs.StringVar(&c.mtlsListenAddr, "mtls-listen-addr", os.Getenv(mtlsListenAddrEnv), fmt.Sprintf("Address to serve the API on over SPIFFE mTLS, e.g. :8443 (defaults to $%s; disabled if empty)", mtlsListenAddrEnv))
+	fs.StringVar(&c.grpcListenAddr, "grpc-listen-addr", os.Getenv(grpcListenAddrEnv), fmt.Sprintf("Address to serve the UsersService gRPC API on over SPIFFE mTLS, e.g. :9443 (defaults to $%s; disabled if empty)", grpcListenAddrEnv))
+	fs.StringVar(&c.jwtAudience, "jwt-audience", "", "Comma-separated audiences to require JWT-SVID bearer authentication for on the plain HTTP listener, e.g. sample-service (disabled if empty)")
+	fs.StringVar(&c.mysqlReplicas, "mysql-replicas", os.Getenv(mysqlReplicasEnv), fmt.Sprintf("Comma-separated MySQL read replicas to read users from, as <addr>=<expected server SPIFFE ID>, e.g. mysql-1.mysql:3306=spiffe://example.org/mysql/replica (defaults to $%s; reads go to the primary if empty)", mysqlReplicasEnv))
+	fs.DurationVar(&c.replicaHealthCheckInterval, "replica-health-check-interval", 10*time.Second, "How often to health check the MySQL read replicas")
+	fs.DurationVar(&c.dbDrainTimeout, "db-drain-timeout", time.Minute, "How long to keep MySQL connections replaced after an SVID rotation open for the queries still using them")
+	fs.IntVar(&c.batchSize, "batch-size", store.DefaultBatchSize, "Number of users inserted per statement by batch create requests, and read per query by exports")
+	fs.StringVar(&c.storeTimeouts, "store-timeouts", "", "Comma-separated timeouts of store methods overriding the defaults, as <method>=<duration>, e.g. ListUsers=5s,CreateUsers=1m; 0 disables a timeout")
+	fs.IntVar(&c.breakerThreshold, "store-breaker-threshold", store.DefaultBreakerThreshold, "Number of consecutive MySQL connection or TLS failures that open the circuit breaker, failing requests fast with 503 (0 disables it)")
+	fs.DurationVar(&c.breakerCooldown, "store-breaker-cooldown", store.DefaultBreakerCooldown, "How long the open circuit breaker fails requests fast before letting one probe MySQL again")
+	fs.IntVar(&c.maxInFlight, "store-max-in-flight", 100, "Number of store operations that may be in flight at once, beyond which requests fail fast with 503 (0 doesn't limit them)")
+	fs.StringVar(&c.eventsSink, "events-sink", os.Getenv(eventsSinkEnv), fmt.Sprintf("Where to publish user change events: a webhook http(s) URL, or a file URL to append NDJSON to, e.g. file:///var/run/events.ndjson (defaults to $%s; disabled if empty)", eventsSinkEnv))
+	fs.DurationVar(&c.eventsPollInterval, "events-poll-interval", outbox.DefaultPollInterval, "How often to poll the MySQL outbox for user change events to publish")
+	fs.IntVar(&c.watchBufferSize, "watch-buffer-size", watch.DefaultBufferSize, "Number of recent user change events kept for watch streams to resume from")
+	fs.StringVar(&c.authzPolicyFile, "authz-policy-file", "", "JSON policy authorizing mTLS, gRPC and JWT-SVID callers per route and method (defaults to allowing any caller in the service's trust domain)")
+}
 
-	data, err := json.Marshal(users)
-	if err != nil {
-		writeErr(w, err)
-		return
-	}
+func main() {
+	c := new(config)
+	lifecycle := command.NewLifecycle()
+	c.registerFlags(flag.CommandLine)
+	lifecycle.RegisterFlags(flag.CommandLine)
+	flag.Parse()
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write(data)
+	// Runs until SIGINT or SIGTERM, then drains requests and closes the store
+	// and Workload API client
+	os.Exit(lifecycle.Run(func(ctx context.Context) error {
+		return run(ctx, c, lifecycle)
+	}))
 }
 
-func (h *handler) create(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		writeErr(w, err)
-		return
+func run(ctx context.Context, c *config, lifecycle *command.Lifecycle) error {
+	if !c.plainHTTP && c.mtlsListenAddr == "" && c.grpcListenAddr == "" {
+		return fmt.Errorf("no listener enabled; set -mtls-listen-addr, -grpc-listen-addr or -plain-http")
 	}
-
-	var user store.User
-	err = json.Unmarshal(body, &user)
+	replicas, err := common.ParseMySQLServers(c.mysqlReplicas)
 	if err != nil {
-		writeErr(w, err)
-		return
+		return fmt.Errorf("invalid -mysql-replicas: %w", err)
 	}
-
-	err = h.dbStore.CreateUser(r.Context(), user)
+	timeouts, err := parseStoreTimeouts(c.storeTimeouts)
 	if err != nil {
-		writeErr(w, err)
-		return
+		return fmt.Errorf("invalid -store-timeouts: %w", err)
 	}
 
-	w.WriteHeader(http.StatusCreated)
-	w.Write([]byte(`{"message": "user created"}`))
-}
-
-func main() {
-	ctx, cancel := context.WithCancel(context.Background())
-
-	// Wait for an os.Interrupt signal
-	go waitForCtrlC(cancel)
-
-	// Creates a new Workload API client, connecting to provided socket path
-	// Environment variable `SPIFFE_ENDPOINT_SOCKET` is used as default
-	client, err := workloadapi.New(ctx, workloadapi.WithAddr(socketPath))
+	// Creates a new Workload API client, connecting to the socket path given by the
+	// -workload-api-addr flag, then environment variable `SPIFFE_ENDPOINT_SOCKET`, then the default
+	client, err := c.bootstrap.NewWorkloadAPIClient(ctx)
 	if err != nil {
-		log.Fatalf("Unable to create workload API client: %v", err)
+		return fmt.Errorf("unable to create workload API client: %w", err)
 	}
-	defer client.Close()
+	lifecycle.CloseOnShutdown("Workload API client", client)
 
 	x509Context, err := client.FetchX509Context(ctx)
 	if err != nil {
-		log.Fatalf("Unable to fetch x509Context %v", err)
+		return fmt.Errorf("unable to fetch x509Context: %w", err)
 	}
 
-	db, err := common.NewMySQLDBWithSPIRETLSConfig(x509Context, mysqlUser, mysqlDBName, "")
+	db, replicaDBs, err := newDBs(x509Context, replicas)
 	if err != nil {
-		log.Fatalf("Failed to create MySQL Client: %v", err)
+		return fmt.Errorf("failed to create MySQL client: %w", err)
 	}
-	defer db.Close()
 
+	// Changes are streamed to watchers as soon as they're committed
+	hub := watch.NewHub(c.watchBufferSize)
+	storeOpts := []store.Option{
+		store.WithReplicas(replicaDBs...),
+		store.WithDrainTimeout(c.dbDrainTimeout),
+		store.WithBatchSize(c.batchSize),
+		store.WithEventHook(hub.Notify),
+		store.WithCircuitBreaker(c.breakerThreshold, c.breakerCooldown),
+		store.WithMaxInFlight(c.maxInFlight),
+	}
+	for method, timeout := range timeouts {
+		storeOpts = append(storeOpts, store.WithTimeout(method, timeout))
+	}
 	h := &handler{
-		dbStore: store.New(db),
+		dbStore:   store.New(db, storeOpts...),
+		batchSize: c.batchSize,
+		hub:       hub,
+	}
+	lifecycle.OnShutdown("MySQL store", h.dbStore.Shutdown)
+	expvar.Publish("store_swaps", expvar.Func(func() any {
+		return h.dbStore.SwapStats()
+	}))
+	expvar.Publish("store_health", expvar.Func(func() any {
+		return h.dbStore.Health()
+	}))
+	expvar.Publish("watchers", expvar.Func(func() any {
+		return hub.Watchers()
+	}))
+	if len(replicas) > 0 {
+		log.Printf("Reading users from MySQL replicas %v", replicas)
+		go h.dbStore.CheckReplicasEvery(ctx, c.replicaHealthCheckInterval)
+	}
+
+	if c.eventsSink != "" {
+		if err := startRelay(ctx, c, lifecycle, h.dbStore); err != nil {
+			return err
+		}
 	}
 
 	// Start X.509 watcher
-	go startWatcher(ctx, client, h)
+	go startWatcher(ctx, client, h, replicas, lifecycle)
 
 	log.Printf("Starting API handlers")
 	// Add API handlers
-	http.HandleFunc(usersAPIPath, func(w http.ResponseWriter, req *http.Request) {
-		switch req.Method {
-		case http.MethodGet:
-			h.list(w, req)
-		case http.MethodPost:
-			h.create(w, req)
+	mux := http.NewServeMux()
+	h.register(mux)
+
+	// Attribute the store operations to the authenticated caller, if any
+	handler := readYourWrites(attributeCaller(mux))
+
+	var policy *auth.Policy
+	if c.mtlsListenAddr != "" || c.grpcListenAddr != "" || c.jwtAudience != "" {
+		if policy, err = loadPolicy(c, x509Context); err != nil {
+			return err
+		}
+	}
+
+	// The mTLS listeners share the service's X.509-SVID
+	var source *workloadapi.X509Source
+	if c.mtlsListenAddr != "" || c.grpcListenAddr != "" {
+		if source, err = newX509Source(ctx, lifecycle, client); err != nil {
+			return err
+		}
+	}
+
+	if c.plainHTTP {
+		plainHandler := handler
+		if c.jwtAudience != "" {
+			if plainHandler, err = newJWTHandler(ctx, c, lifecycle, client, policy, handler); err != nil {
+				return err
+			}
+			plainHandler = withProbes(h, plainHandler)
+		}
+		srv := &http.Server{
+			Addr:    common.EnvOrDefault(listenAddrEnv, defaultListenAddr),
+			Handler: plainHandler,
+		}
+		if err := lifecycle.ServeHTTP("users API", srv); err != nil {
+			return err
 		}
+	}
+	if c.mtlsListenAddr != "" {
+		if err := serveMTLS(c, lifecycle, source, policy, handler); err != nil {
+			return err
+		}
+	}
+	if c.grpcListenAddr != "" {
+		if err := serveGRPC(c, lifecycle, source, policy, h.dbStore); err != nil {
+			return err
+		}
+	}
+	// Registered last to run first on shutdown: watch streams only end once
+	// the hub is closed, and would hold up draining the servers otherwise
+	lifecycle.CloseOnShutdown("watch streams", hub)
+	return lifecycle.Wait()
+}
+
+// attributeCaller attributes the store operations made while handling a
+// request to the caller authenticated by the mTLS or JWT-SVID middleware.
+func attributeCaller(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id, ok := auth.CallerID(r.Context()); ok {
+			r = r.WithContext(store.WithCaller(r.Context(), id.String()))
+		}
+		next.ServeHTTP(w, r)
 	})
-	log.Fatal(http.ListenAndServe(":8888", nil))
 }
 
-func startWatcher(ctx context.Context, client *workloadapi.Client, h *handler) {
-	// Start a watcher for X.509 SVID updates
-	doneCh := make(chan struct{}, 1)
-	go func() {
-		err := client.WatchX509Context(ctx, &x509Watcher{
-			h: h,
-		})
-		if err != nil && status.Code(err) != codes.Canceled {
-			log.Fatalf("Error watching X.509 context: %v", err)
+// readYourWrites reads from the MySQL primary for requests asking to observe
+// their earlier writes.
+func readYourWrites(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(usersapi.ReadYourWritesHeader) == "true" {
+			r = r.WithContext(store.WithReadYourWrites(r.Context()))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// parseStoreTimeouts parses comma-separated <method>=<duration> timeouts of
+// store methods.
+func parseStoreTimeouts(s string) (map[store.Method]time.Duration, error) {
+	timeouts := make(map[store.Method]time.Duration)
+	if s == "" {
+		return timeouts, nil
+	}
+	defaults := store.DefaultTimeouts()
+	for _, pair := range strings.Split(s, ",") {
+		name, rawTimeout, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			return nil, fmt.Errorf("malformed timeout %q; expected <method>=<duration>", pair)
+		}
+		method := store.Method(name)
+		if _, ok := defaults[method]; !ok {
+			return nil, fmt.Errorf("unknown store method %q", name)
 		}
-		doneCh <- struct{}{}
-	}()
-	<-doneCh
+		timeout, err := time.ParseDuration(rawTimeout)
+		if err != nil || timeout < 0 {
+			return nil, fmt.Errorf("malformed timeout %q of %s", rawTimeout, name)
+		}
+		timeouts[method] = timeout
+	}
+	return timeouts, nil
+}
+
+// newDBs creates the primary and replica DBs with the SVID in the X.509
+// context.
+func newDBs(c *workloadapi.X509Context, replicas []common.MySQLServer) (*sql.DB, []store.Replica, error) {
+	db, err := common.NewMySQLDBWithSPIRETLSConfig(c, mysqlUser, mysqlDBName, "")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var replicaDBs []store.Replica
+	for _, replica := range replicas {
+		replicaDB, err := common.NewMySQLDBForServer(c, replica, mysqlUser, mysqlDBName, "")
+		if err != nil {
+			db.Close()
+			for _, replicaDB := range replicaDBs {
+				replicaDB.DB.Close()
+			}
+			return nil, nil, fmt.Errorf("replica %s: %w", replica.Addr, err)
+		}
+		replicaDBs = append(replicaDBs, store.Replica{Addr: replica.Addr, DB: replicaDB})
+	}
+	return db, replicaDBs, nil
+}
+
+func startWatcher(ctx context.Context, client *workloadapi.Client, h *handler, replicas []common.MySQLServer, lifecycle *command.Lifecycle) {
+	// Start a watcher for X.509 SVID updates
+	err := client.WatchX509Context(ctx, &x509Watcher{
+		h:        h,
+		replicas: replicas,
+	})
+	if err != nil && status.Code(err) != codes.Canceled {
+		lifecycle.Fail(fmt.Errorf("error watching X.509 context: %w", err))
+	}
 }
 
 type x509Watcher struct {
-	h *handler
+	h        *handler
+	replicas []common.MySQLServer
 }
 
 // OnX509ContextUpdate is run every time an SVID is updated
@@ -149,8 +326,8 @@ func (w *x509Watcher) OnX509ContextUpdate(c *workloadapi.X509Context) {
 		return
 	}
 
-	// Create new DB instance with udpate TLS config
-	db, err := common.NewMySQLDBWithSPIRETLSConfig(c, mysqlUser, mysqlDBName, "")
+	// Create new DB instances with udpate TLS config
+	db, replicaDBs, err := newDBs(c, w.replicas)
 	if err != nil {
 		log.Printf("Failed to create MySQL Client: %v", err)
 		return
@@ -159,9 +336,16 @@ func (w *x509Watcher) OnX509ContextUpdate(c *workloadapi.X509Context) {
 	// Set max connection lifetime to be slightly more than the frequency of SVID updates from SPIRE
 	// so that we don't close connection before establishing a new one
 	db.SetConnMaxLifetime(dbConnectionLifetime)
+	for _, replica := range replicaDBs {
+		replica.DB.SetConnMaxLifetime(dbConnectionLifetime)
+	}
 
-	// Update DB instance in store
-	w.h.dbStore.UpdateDB(db)
+	// Update DB instances in store, which keeps the current ones if the new
+	// ones don't work
+	if err := w.h.dbStore.UpdateDB(db, replicaDBs...); err != nil {
+		log.Printf("Failed to update DB client TLS config: %v", err)
+		return
+	}
 	log.Printf("Successfully updated DB client TLS config")
 }
 
@@ -171,17 +355,3 @@ func (w *x509Watcher) OnX509ContextWatchError(err error) {
 		log.Printf("OnX509ContextWatchError error: %v", err)
 	}
 }
-
-// waitForCtrlC waits until an os.Interrupt signal is sent (ctrl + c)
-func waitForCtrlC(cancel context.CancelFunc) {
-	signalCh := make(chan os.Signal, 1)
-	signal.Notify(signalCh, os.Interrupt)
-	<-signalCh
-
-	cancel()
-}
-
-func writeErr(w http.ResponseWriter, err error) {
-	w.WriteHeader(http.StatusInternalServerError)
-	fmt.Fprintf(w, `{"error": "%s"}`, err.Error())
-}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/rturner3/spire-mysql-demo/pkg/store"
+)
+
+func TestParseStoreTimeouts(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		in        string
+		expect    map[store.Method]time.Duration
+		expectErr bool
+	}{
+		{name: "empty", expect: map[store.Method]time.Duration{}},
+		{
+			name: "timeouts",
+			in:   "ListUsers=5s, CreateUsers=1m,GetUser=0",
+			expect: map[store.Method]time.Duration{
+				store.MethodListUsers:   5 * time.Second,
+				store.MethodCreateUsers: time.Minute,
+				store.MethodGetUser:     0,
+			},
+		},
+		{name: "unknown method", in: "DropUsers=5s", expectErr: true},
+		{name: "missing duration", in: "ListUsers", expectErr: true},
+		{name: "malformed duration", in: "ListUsers=5", expectErr: true},
+		{name: "negative duration", in: "ListUsers=-5s", expectErr: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			timeouts, err := parseStoreTimeouts(tt.in)
+			if tt.expectErr {
+				if err == nil {
+					t.Fatalf("expected an error; got %v", timeouts)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to parse timeouts: %v", err)
+			}
+			if !reflect.DeepEqual(timeouts, tt.expect) {
+				t.Fatalf("expected %v; got %v", tt.expect, timeouts)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/rturner3/spire-mysql-demo/pkg/usersapi"
+	"github.com/rturner3/spire-mysql-demo/pkg/watch"
+)
+
+// watchHeartbeat is how often an idle watch stream is sent a comment, so that
+// proxies don't time it out and closed connections are noticed
+const watchHeartbeat = 15 * time.Second
+
+// watch streams the user change events committed from now on, or since the
+// resume token, as server-sent events until the client disconnects.
+func (h *handler) watch(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	flusher, ok := w.(http.Flusher)
+	if !ok || h.hub == nil {
+		writeStatusErr(w, http.StatusNotImplemented, fmt.Errorf("watching users is not supported"))
+		return
+	}
+
+	token := r.Header.Get(usersapi.LastEventIDHeader)
+	if token == "" {
+		token = r.URL.Query().Get(usersapi.ResumeTokenParam)
+	}
+	sub, resumed := h.hub.Subscribe(token)
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", usersapi.EventStreamContentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if !resumed {
+		data, _ := json.Marshal(usersapi.Error{
+			Error: "can't resume watching from the token, list the users to catch up",
+			Code:  usersapi.CodeResumeTokenExpired,
+		})
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", usersapi.ResetEventType, data)
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(watchHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case event, ok := <-sub.Events():
+			if !ok {
+				// The watcher didn't keep up, or the service is shutting
+				// down: end the stream, so that it resumes from its last
+				// event
+				if sub.Lagged() {
+					log.Printf("Closing watch stream that didn't keep up with events")
+				}
+				return
+			}
+			if err := writeWatchEvent(w, event); err != nil {
+				log.Printf("Failed to write watch event: %v", err)
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// writeWatchEvent writes the event as a server-sent event, with the resume
+// token as its ID.
+func writeWatchEvent(w http.ResponseWriter, event watch.Event) error {
+	data, err := json.Marshal(event.Event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", event.Token, event.Type, data)
+	return err
+}
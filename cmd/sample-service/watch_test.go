@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rturner3/spire-mysql-demo/pkg/store"
+	"github.com/rturner3/spire-mysql-demo/pkg/usersapi"
+	"github.com/rturner3/spire-mysql-demo/pkg/watch"
+)
+
+func TestWatch(t *testing.T) {
+	hub := watch.NewHub(10)
+	mux := http.NewServeMux()
+	(&handler{hub: hub}).register(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	client, err := usersapi.NewClient(server.URL)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	errStop := errors.New("stop")
+	// watchEvents watches from token until n events were received
+	watchEvents := func(token string, n int) []usersapi.WatchEvent {
+		var events []usersapi.WatchEvent
+		err := client.WatchUsers(ctx, token, func(event usersapi.WatchEvent) error {
+			events = append(events, event)
+			if len(events) == n {
+				return errStop
+			}
+			return nil
+		})
+		if !errors.Is(err, errStop) {
+			t.Fatalf("expected the watch to be stopped; got %v", err)
+		}
+		return events
+	}
+
+	go func() {
+		// Notify once the watch below subscribed
+		for hub.Watchers() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		hub.Notify([]store.Event{
+			{ID: 1, IdempotencyKey: "user-1-v1", Type: store.EventUserCreated, User: store.User{ID: 1, Name: "David", Version: 1}},
+			{ID: 2, IdempotencyKey: "user-1-v2", Type: store.EventUserUpdated, User: store.User{ID: 1, Name: "Dave", Version: 2}},
+		})
+	}()
+	events := watchEvents("", 2)
+	if events[0].Type != string(store.EventUserCreated) || events[0].Event.User.Name != "David" || events[0].Token == "" {
+		t.Fatalf("expected user created event with a token; got %+v", events[0])
+	}
+
+	// Resuming after the first event receives the second one again
+	resumed := watchEvents(events[0].Token, 1)
+	if resumed[0].Token != events[1].Token || resumed[0].Event.IdempotencyKey != "user-1-v2" {
+		t.Fatalf("expected to resume with event %+v; got %+v", events[1], resumed[0])
+	}
+
+	reset := watchEvents("unknown-1", 1)
+	if reset[0].Type != usersapi.ResetEventType || reset[0].Event != nil {
+		t.Fatalf("expected a reset event for an unknown token; got %+v", reset[0])
+	}
+
+	// The server notices the watches stopped once their connections close
+	for hub.Watchers() != 0 {
+		if ctx.Err() != nil {
+			t.Fatalf("expected no watchers once the watches stopped; got %d", hub.Watchers())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,22 @@
+package auth
+
+import (
+	"context"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+)
+
+type callerIDKey struct{}
+
+// WithCallerID returns a copy of ctx carrying the authenticated caller's
+// SPIFFE ID.
+func WithCallerID(ctx context.Context, id spiffeid.ID) context.Context {
+	return context.WithValue(ctx, callerIDKey{}, id)
+}
+
+// CallerID returns the authenticated caller's SPIFFE ID, if the request was
+// authenticated.
+func CallerID(ctx context.Context) (spiffeid.ID, bool) {
+	id, ok := ctx.Value(callerIDKey{}).(spiffeid.ID)
+	return id, ok
+}
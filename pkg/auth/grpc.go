@@ -0,0 +1,41 @@
+package auth
+
+import (
+	"context"
+	"log"
+	"net/http"
+
+	"github.com/spiffe/go-spiffe/v2/spiffegrpc/grpccredentials"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+)
+
+// MTLSServerCredentials returns gRPC transport credentials serving the
+// X.509-SVID from source and requiring callers to present an X.509-SVID
+// allowed by at least one policy rule. Per-method authorization is left to
+// UnaryServerInterceptor.
+func MTLSServerCredentials(source X509Source, policy *Policy) credentials.TransportCredentials {
+	return grpccredentials.MTLSServerCredentials(source, source, tlsconfig.AdaptMatcher(policy.MatchCaller()))
+}
+
+// UnaryServerInterceptor authorizes gRPC calls received over SPIFFE mTLS by
+// the caller's SPIFFE ID and makes the ID available to handlers through
+// CallerID. gRPC calls are HTTP/2 POST requests to /<service>/<method>, so
+// policy rules match them with the POST method and that path.
+func UnaryServerInterceptor(policy *Policy) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		id, ok := grpccredentials.PeerIDFromContext(ctx)
+		if !ok {
+			return nil, status.Error(codes.Unauthenticated, "client certificate required")
+		}
+
+		if err := policy.Authorize(id, http.MethodPost, info.FullMethod); err != nil {
+			log.Printf("Denied request: %v", err)
+			return nil, status.Error(codes.PermissionDenied, "caller is not authorized")
+		}
+		return handler(WithCallerID(ctx, id), req)
+	}
+}
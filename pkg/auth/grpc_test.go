@@ -0,0 +1,78 @@
+package auth
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/rturner3/spire-mysql-demo/pkg/test/fakeworkloadapi"
+	"github.com/spiffe/go-spiffe/v2/spiffegrpc/grpccredentials"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthv1 "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	ca := fakeworkloadapi.NewCA(t, td)
+	serverSVID := ca.MintX509SVID(fakeworkloadapi.Identity{ID: spiffeid.RequireFromPath(td, "/sample-service")})
+
+	policy, err := NewPolicy(
+		Rule{Method: "POST", Path: "/grpc.health.v1.Health/Check", AllowIDs: []string{readerID.String()}},
+		Rule{Path: "/grpc.health.v1.Health/*", AllowIDs: []string{writerID.String()}},
+	)
+	if err != nil {
+		t.Fatalf("failed to create policy: %v", err)
+	}
+
+	var callers []spiffeid.ID
+	recordCaller := func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if id, ok := CallerID(ctx); ok {
+			callers = append(callers, id)
+		}
+		return handler(ctx, req)
+	}
+
+	server := grpc.NewServer(
+		grpc.Creds(MTLSServerCredentials(staticSource{serverSVID, ca.X509Bundle()}, policy)),
+		grpc.ChainUnaryInterceptor(UnaryServerInterceptor(policy), recordCaller),
+	)
+	healthv1.RegisterHealthServer(server, health.NewServer())
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	go server.Serve(ln)
+	defer server.Stop()
+
+	clientFor := func(id spiffeid.ID) healthv1.HealthClient {
+		svid := ca.MintX509SVID(fakeworkloadapi.Identity{ID: id})
+		conn, err := grpc.Dial(ln.Addr().String(), grpc.WithTransportCredentials(
+			grpccredentials.MTLSClientCredentials(svid, ca.X509Bundle(), tlsconfig.AuthorizeID(serverSVID.ID)),
+		))
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return healthv1.NewHealthClient(conn)
+	}
+
+	ctx := context.Background()
+	if _, err := clientFor(readerID).Check(ctx, new(healthv1.HealthCheckRequest)); err != nil {
+		t.Fatalf("expected reader to be allowed to call Check: %v", err)
+	}
+	if _, err := clientFor(writerID).Check(ctx, new(healthv1.HealthCheckRequest)); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected PermissionDenied for writer calling Check; got %v", err)
+	}
+	if len(callers) != 1 || callers[0] != readerID {
+		t.Fatalf("expected handler to see caller %s; got %v", readerID, callers)
+	}
+
+	unknown := clientFor(spiffeid.RequireFromPath(td, "/ns/default/sa/unknown"))
+	if _, err := unknown.Check(ctx, new(healthv1.HealthCheckRequest)); status.Code(err) != codes.Unavailable {
+		t.Fatalf("expected the TLS handshake to fail for a caller not allowed by any rule; got %v", err)
+	}
+}
@@ -0,0 +1,51 @@
+package auth
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/spiffe/go-spiffe/v2/bundle/jwtbundle"
+	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
+)
+
+const bearerPrefix = "Bearer "
+
+// JWTMiddleware authenticates requests by the JWT-SVID in their
+// `Authorization: Bearer` header, validated against bundles for one of the
+// audiences, authorizes the caller's SPIFFE ID with policy, and makes the ID
+// available to next through CallerID.
+func JWTMiddleware(bundles jwtbundle.Source, audience []string, policy *Policy, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := bearerToken(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, "bearer token required")
+			return
+		}
+		svid, err := jwtsvid.ParseAndValidate(token, bundles, audience)
+		if err != nil {
+			log.Printf("Rejected JWT-SVID: %v", err)
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			writeError(w, http.StatusUnauthorized, "invalid bearer token")
+			return
+		}
+
+		if err := policy.Authorize(svid.ID, r.Method, r.URL.Path); err != nil {
+			log.Printf("Denied request: %v", err)
+			writeError(w, http.StatusForbidden, "caller is not authorized")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(WithCallerID(r.Context(), svid.ID)))
+	})
+}
+
+// bearerToken returns the token from the request's Authorization header.
+func bearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	if len(header) < len(bearerPrefix) || !strings.EqualFold(header[:len(bearerPrefix)], bearerPrefix) {
+		return "", false
+	}
+	token := strings.TrimSpace(header[len(bearerPrefix):])
+	return token, token != ""
+}
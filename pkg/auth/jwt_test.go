@@ -0,0 +1,119 @@
+package auth
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rturner3/spire-mysql-demo/pkg/test/fakeworkloadapi"
+	"github.com/rturner3/spire-mysql-demo/pkg/usersapi"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+)
+
+func TestJWTMiddleware(t *testing.T) {
+	ca := fakeworkloadapi.NewCA(t, td)
+	otherCA := fakeworkloadapi.NewCA(t, td)
+
+	policy, err := NewPolicy(
+		Rule{Method: "POST", Path: "/api/v1/users", AllowIDs: []string{writerID.String()}},
+		Rule{Method: "GET", Path: "/api/v1/users", AllowTrustDomains: []string{"example.org"}},
+	)
+	if err != nil {
+		t.Fatalf("failed to create policy: %v", err)
+	}
+
+	handler := JWTMiddleware(ca.JWTBundle(), []string{"sample-service"}, policy, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, ok := CallerID(r.Context())
+		if !ok {
+			t.Error("expected caller ID in request context")
+		}
+		io.WriteString(w, id.String())
+	}))
+
+	token := func(ca *fakeworkloadapi.CA, id spiffeid.ID, audience string) string {
+		return "Bearer " + ca.MintJWTSVID(fakeworkloadapi.Identity{ID: id}, audience)
+	}
+
+	for _, tt := range []struct {
+		name          string
+		method        string
+		authorization string
+		expectStatus  int
+		expectCaller  spiffeid.ID
+	}{
+		{
+			name:          "allowed",
+			method:        http.MethodPost,
+			authorization: token(ca, writerID, "sample-service"),
+			expectStatus:  http.StatusOK,
+			expectCaller:  writerID,
+		},
+		{
+			name:          "allowed by trust domain",
+			method:        http.MethodGet,
+			authorization: token(ca, readerID, "sample-service"),
+			expectStatus:  http.StatusOK,
+			expectCaller:  readerID,
+		},
+		{
+			name:          "not allowed for method",
+			method:        http.MethodPost,
+			authorization: token(ca, readerID, "sample-service"),
+			expectStatus:  http.StatusForbidden,
+		},
+		{
+			name:         "missing token",
+			method:       http.MethodGet,
+			expectStatus: http.StatusUnauthorized,
+		},
+		{
+			name:          "not a bearer token",
+			method:        http.MethodGet,
+			authorization: "Basic dXNlcjpwYXNz",
+			expectStatus:  http.StatusUnauthorized,
+		},
+		{
+			name:          "wrong audience",
+			method:        http.MethodGet,
+			authorization: token(ca, readerID, "other-service"),
+			expectStatus:  http.StatusUnauthorized,
+		},
+		{
+			name:          "untrusted signer",
+			method:        http.MethodGet,
+			authorization: token(otherCA, readerID, "sample-service"),
+			expectStatus:  http.StatusUnauthorized,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/api/v1/users", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.expectStatus {
+				t.Fatalf("expected status %d; got %d: %s", tt.expectStatus, rec.Code, rec.Body)
+			}
+			if tt.expectStatus == http.StatusOK && rec.Body.String() != tt.expectCaller.String() {
+				t.Fatalf("expected caller ID %q; got %q", tt.expectCaller, rec.Body)
+			}
+			if tt.expectStatus == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+				t.Fatal("expected WWW-Authenticate header")
+			}
+			if tt.expectStatus != http.StatusOK {
+				expectCode := usersapi.CodeUnauthenticated
+				if tt.expectStatus == http.StatusForbidden {
+					expectCode = usersapi.CodePermissionDenied
+				}
+				var body usersapi.Error
+				if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body.Code != expectCode {
+					t.Fatalf("expected error code %q; got %s (err=%v)", expectCode, rec.Body, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffetls"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+
+	"github.com/rturner3/spire-mysql-demo/pkg/usersapi"
+)
+
+// X509Source provides the X.509-SVID served to callers and the bundles used to
+// verify theirs, e.g. a workloadapi.X509Source.
+type X509Source interface {
+	x509svid.Source
+	x509bundle.Source
+}
+
+// MTLSServerConfig returns a TLS configuration serving the X.509-SVID from
+// source and requiring callers to present an X.509-SVID allowed by at least
+// one policy rule. Per-route authorization is left to MTLSMiddleware.
+func MTLSServerConfig(source X509Source, policy *Policy) *tls.Config {
+	return tlsconfig.MTLSServerConfig(source, source, tlsconfig.AdaptMatcher(policy.MatchCaller()))
+}
+
+// MTLSMiddleware authorizes requests received over mTLS by the caller's SPIFFE
+// ID, taken from its X.509-SVID, and makes the ID available to next through
+// CallerID.
+func MTLSMiddleware(policy *Policy, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil {
+			writeError(w, http.StatusUnauthorized, "client certificate required")
+			return
+		}
+		id, err := spiffetls.PeerIDFromConnectionState(*r.TLS)
+		if err != nil {
+			writeError(w, http.StatusUnauthorized, "invalid client certificate")
+			return
+		}
+
+		if err := policy.Authorize(id, r.Method, r.URL.Path); err != nil {
+			log.Printf("Denied request: %v", err)
+			writeError(w, http.StatusForbidden, "caller is not authorized")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(WithCallerID(r.Context(), id)))
+	})
+}
+
+// writeError writes an authentication (401) or authorization (403) error.
+func writeError(w http.ResponseWriter, status int, message string) {
+	code := usersapi.CodeUnauthenticated
+	if status == http.StatusForbidden {
+		code = usersapi.CodePermissionDenied
+	}
+	data, _ := json.Marshal(usersapi.Error{Error: message, Code: code})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
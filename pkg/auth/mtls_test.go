@@ -0,0 +1,105 @@
+package auth
+
+import (
+	"crypto/tls"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rturner3/spire-mysql-demo/pkg/test/fakeworkloadapi"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+)
+
+type staticSource struct {
+	*x509svid.SVID
+	*x509bundle.Bundle
+}
+
+func TestMTLSMiddleware(t *testing.T) {
+	ca := fakeworkloadapi.NewCA(t, td)
+	serverSVID := ca.MintX509SVID(fakeworkloadapi.Identity{ID: spiffeid.RequireFromPath(td, "/sample-service")})
+
+	policy, err := NewPolicy(
+		Rule{Method: "POST", Path: "/api/v1/users", AllowIDs: []string{writerID.String()}},
+		Rule{Method: "GET", Path: "/api/v1/users", AllowIDs: []string{readerID.String(), writerID.String()}},
+	)
+	if err != nil {
+		t.Fatalf("failed to create policy: %v", err)
+	}
+
+	// httptest.Server.StartTLS would replace the SVID with its own certificate
+	server := httptest.NewUnstartedServer(MTLSMiddleware(policy, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, ok := CallerID(r.Context())
+		if !ok {
+			t.Error("expected caller ID in request context")
+		}
+		io.WriteString(w, id.String())
+	})))
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.Listener = tls.NewListener(server.Listener, MTLSServerConfig(staticSource{serverSVID, ca.X509Bundle()}, policy))
+	server.Start()
+	defer server.Close()
+	serverURL := "https://" + server.Listener.Addr().String()
+
+	clientFor := func(id spiffeid.ID) *http.Client {
+		svid := ca.MintX509SVID(fakeworkloadapi.Identity{ID: id})
+		return &http.Client{Transport: &http.Transport{
+			TLSClientConfig: tlsconfig.MTLSClientConfig(svid, ca.X509Bundle(), tlsconfig.AuthorizeID(serverSVID.ID)),
+		}}
+	}
+
+	for _, tt := range []struct {
+		name         string
+		caller       spiffeid.ID
+		method       string
+		expectStatus int
+	}{
+		{name: "allowed", caller: writerID, method: http.MethodPost, expectStatus: http.StatusOK},
+		{name: "allowed read", caller: readerID, method: http.MethodGet, expectStatus: http.StatusOK},
+		{name: "not allowed for method", caller: readerID, method: http.MethodPost, expectStatus: http.StatusForbidden},
+		{name: "no rule for method", caller: writerID, method: http.MethodDelete, expectStatus: http.StatusForbidden},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, serverURL+"/api/v1/users", nil)
+			if err != nil {
+				t.Fatalf("failed to create request: %v", err)
+			}
+			resp, err := clientFor(tt.caller).Do(req)
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+
+			if resp.StatusCode != tt.expectStatus {
+				t.Fatalf("expected status %d; got %d: %s", tt.expectStatus, resp.StatusCode, body)
+			}
+			if tt.expectStatus == http.StatusOK && string(body) != tt.caller.String() {
+				t.Fatalf("expected caller ID %q; got %q", tt.caller, body)
+			}
+		})
+	}
+
+	t.Run("caller not allowed by any rule fails the handshake", func(t *testing.T) {
+		client := clientFor(spiffeid.RequireFromPath(td, "/ns/default/sa/unknown"))
+		if resp, err := client.Get(serverURL + "/api/v1/users"); err == nil {
+			resp.Body.Close()
+			t.Fatal("expected the TLS handshake to fail")
+		}
+	})
+
+	t.Run("client without certificate fails the handshake", func(t *testing.T) {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, //nolint:gosec // only testing client authentication
+		}}
+		if resp, err := client.Get(serverURL + "/api/v1/users"); err == nil {
+			resp.Body.Close()
+			t.Fatal("expected the TLS handshake to fail")
+		}
+	})
+}
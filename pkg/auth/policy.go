@@ -0,0 +1,177 @@
+// Package auth authenticates the callers of the sample-service API by their
+// SPIFFE ID and authorizes them per route and method.
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+)
+
+// Policy authorizes callers per route and method. Rules are evaluated in
+// order and the first rule matching the request decides; requests matching no
+// rule are denied.
+type Policy struct {
+	rules []rule
+}
+
+// Rule is a policy rule as configured in a policy file.
+type Rule struct {
+	// Method is the HTTP method the rule applies to; empty or "*" matches any
+	// method.
+	Method string `json:"method,omitempty"`
+
+	// Path is the request path the rule applies to. A trailing "*" matches any
+	// path with the preceding prefix.
+	Path string `json:"path"`
+
+	// AllowIDs and AllowTrustDomains list the callers allowed by the rule.
+	AllowIDs          []string `json:"allow_ids,omitempty"`
+	AllowTrustDomains []string `json:"allow_trust_domains,omitempty"`
+}
+
+// PolicyFile is the format of a policy file.
+type PolicyFile struct {
+	Rules []Rule `json:"rules"`
+}
+
+type rule struct {
+	method       string
+	path         string
+	prefix       bool
+	ids          map[spiffeid.ID]struct{}
+	trustDomains map[spiffeid.TrustDomain]struct{}
+}
+
+// NewPolicy validates the rules and returns a policy enforcing them.
+func NewPolicy(rules ...Rule) (*Policy, error) {
+	if len(rules) == 0 {
+		return nil, errors.New("policy must have at least one rule")
+	}
+
+	p := new(Policy)
+	for i, r := range rules {
+		parsed, err := parseRule(r)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i, err)
+		}
+		p.rules = append(p.rules, parsed)
+	}
+	return p, nil
+}
+
+// MemberOfPolicy returns a policy allowing any caller in the trust domain to
+// call any route.
+func MemberOfPolicy(td spiffeid.TrustDomain) *Policy {
+	return &Policy{rules: []rule{{
+		prefix:       true,
+		trustDomains: map[spiffeid.TrustDomain]struct{}{td: {}},
+	}}}
+}
+
+// LoadPolicyFile reads and parses the JSON policy file at path.
+func LoadPolicyFile(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file PolicyFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid policy file %s: %w", path, err)
+	}
+	policy, err := NewPolicy(file.Rules...)
+	if err != nil {
+		return nil, fmt.Errorf("invalid policy file %s: %w", path, err)
+	}
+	return policy, nil
+}
+
+func parseRule(r Rule) (rule, error) {
+	parsed := rule{
+		method:       strings.ToUpper(r.Method),
+		path:         r.Path,
+		ids:          make(map[spiffeid.ID]struct{}),
+		trustDomains: make(map[spiffeid.TrustDomain]struct{}),
+	}
+	if parsed.method == "*" {
+		parsed.method = ""
+	}
+	if strings.HasSuffix(parsed.path, "*") {
+		parsed.path = strings.TrimSuffix(parsed.path, "*")
+		parsed.prefix = true
+	}
+	if !strings.HasPrefix(parsed.path, "/") {
+		return rule{}, fmt.Errorf("path %q must be absolute", r.Path)
+	}
+
+	if len(r.AllowIDs) == 0 && len(r.AllowTrustDomains) == 0 {
+		return rule{}, fmt.Errorf("rule for %q must allow at least one SPIFFE ID or trust domain", r.Path)
+	}
+	for _, rawID := range r.AllowIDs {
+		id, err := spiffeid.FromString(rawID)
+		if err != nil {
+			return rule{}, fmt.Errorf("malformed SPIFFE ID %q: %w", rawID, err)
+		}
+		parsed.ids[id] = struct{}{}
+	}
+	for _, rawTD := range r.AllowTrustDomains {
+		td, err := spiffeid.TrustDomainFromString(rawTD)
+		if err != nil {
+			return rule{}, fmt.Errorf("malformed trust domain %q: %w", rawTD, err)
+		}
+		parsed.trustDomains[td] = struct{}{}
+	}
+	return parsed, nil
+}
+
+// Authorize returns an error if the caller isn't allowed to call the route
+// with the method.
+func (p *Policy) Authorize(caller spiffeid.ID, method, path string) error {
+	for _, r := range p.rules {
+		if !r.matches(method, path) {
+			continue
+		}
+		if !r.allows(caller) {
+			return fmt.Errorf("%s is not allowed to call %s %s", caller, method, path)
+		}
+		return nil
+	}
+	return fmt.Errorf("no rule allows calling %s %s", method, path)
+}
+
+// MatchCaller returns a matcher accepting the callers allowed by any rule, so
+// that callers which can't call any route are rejected up front, e.g. during
+// the TLS handshake.
+func (p *Policy) MatchCaller() spiffeid.Matcher {
+	return func(id spiffeid.ID) error {
+		for _, r := range p.rules {
+			if r.allows(id) {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s is not allowed by any rule", id)
+	}
+}
+
+func (r rule) matches(method, path string) bool {
+	if r.method != "" && r.method != method {
+		return false
+	}
+	if r.prefix {
+		return strings.HasPrefix(path, r.path)
+	}
+	return path == r.path
+}
+
+func (r rule) allows(id spiffeid.ID) bool {
+	if _, ok := r.ids[id]; ok {
+		return true
+	}
+	_, ok := r.trustDomains[id.TrustDomain()]
+	return ok
+}
@@ -0,0 +1,141 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+)
+
+var (
+	td        = spiffeid.RequireTrustDomainFromString("example.org")
+	readerID  = spiffeid.RequireFromPath(td, "/ns/default/sa/reader")
+	writerID  = spiffeid.RequireFromPath(td, "/ns/default/sa/writer")
+	foreignID = spiffeid.RequireFromString("spiffe://other.org/ns/default/sa/writer")
+)
+
+func TestPolicyAuthorize(t *testing.T) {
+	policy, err := NewPolicy(
+		Rule{Method: "POST", Path: "/api/v1/users", AllowIDs: []string{writerID.String()}},
+		Rule{Method: "get", Path: "/api/v1/users*", AllowTrustDomains: []string{"example.org"}},
+		Rule{Path: "/openapi.json", AllowTrustDomains: []string{"example.org", "other.org"}},
+	)
+	if err != nil {
+		t.Fatalf("failed to create policy: %v", err)
+	}
+
+	for _, tt := range []struct {
+		name   string
+		caller spiffeid.ID
+		method string
+		path   string
+		allow  bool
+	}{
+		{name: "allowed ID", caller: writerID, method: "POST", path: "/api/v1/users", allow: true},
+		{name: "ID not allowed", caller: readerID, method: "POST", path: "/api/v1/users"},
+		{name: "allowed trust domain", caller: readerID, method: "GET", path: "/api/v1/users", allow: true},
+		{name: "path prefix", caller: readerID, method: "GET", path: "/api/v1/users/1", allow: true},
+		{name: "trust domain not allowed", caller: foreignID, method: "GET", path: "/api/v1/users"},
+		{name: "any method", caller: foreignID, method: "HEAD", path: "/openapi.json", allow: true},
+		{name: "no matching rule", caller: writerID, method: "DELETE", path: "/api/v1/users"},
+		{name: "no matching path", caller: writerID, method: "POST", path: "/api/v1/users/1"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := policy.Authorize(tt.caller, tt.method, tt.path)
+			switch {
+			case tt.allow && err != nil:
+				t.Fatalf("expected %s to be allowed to call %s %s: %v", tt.caller, tt.method, tt.path, err)
+			case !tt.allow && err == nil:
+				t.Fatalf("expected %s not to be allowed to call %s %s", tt.caller, tt.method, tt.path)
+			}
+		})
+	}
+}
+
+func TestPolicyMatchCaller(t *testing.T) {
+	policy, err := NewPolicy(
+		Rule{Method: "POST", Path: "/api/v1/users", AllowIDs: []string{foreignID.String()}},
+		Rule{Method: "GET", Path: "/api/v1/users", AllowIDs: []string{readerID.String()}},
+	)
+	if err != nil {
+		t.Fatalf("failed to create policy: %v", err)
+	}
+
+	match := policy.MatchCaller()
+	for _, id := range []spiffeid.ID{readerID, foreignID} {
+		if err := match(id); err != nil {
+			t.Fatalf("expected %s to match: %v", id, err)
+		}
+	}
+	if err := match(writerID); err == nil {
+		t.Fatalf("expected %s not to match", writerID)
+	}
+}
+
+func TestNewPolicyInvalid(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		rules     []Rule
+		expectErr string
+	}{
+		{
+			name:      "no rules",
+			expectErr: "policy must have at least one rule",
+		},
+		{
+			name:      "relative path",
+			rules:     []Rule{{Path: "api/v1/users", AllowTrustDomains: []string{"example.org"}}},
+			expectErr: `rule 0: path "api/v1/users" must be absolute`,
+		},
+		{
+			name:      "nothing allowed",
+			rules:     []Rule{{Path: "/api/v1/users"}},
+			expectErr: `rule 0: rule for "/api/v1/users" must allow at least one SPIFFE ID or trust domain`,
+		},
+		{
+			name:      "malformed SPIFFE ID",
+			rules:     []Rule{{Path: "/api/v1/users", AllowIDs: []string{"example.org/writer"}}},
+			expectErr: `rule 0: malformed SPIFFE ID "example.org/writer"`,
+		},
+		{
+			name:      "malformed trust domain",
+			rules:     []Rule{{Path: "/api/v1/users", AllowTrustDomains: []string{"Example.org"}}},
+			expectErr: `rule 0: malformed trust domain "Example.org"`,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewPolicy(tt.rules...)
+			if err == nil || !strings.HasPrefix(err.Error(), tt.expectErr) {
+				t.Fatalf("expected error starting with %q; got %v", tt.expectErr, err)
+			}
+		})
+	}
+}
+
+func TestLoadPolicyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.json")
+	if err := os.WriteFile(path, []byte(`{
+		"rules": [
+			{"method": "GET", "path": "/api/v1/users", "allow_trust_domains": ["example.org"]}
+		]
+	}`), 0o600); err != nil {
+		t.Fatalf("failed to write policy file: %v", err)
+	}
+
+	policy, err := LoadPolicyFile(path)
+	if err != nil {
+		t.Fatalf("failed to load policy file: %v", err)
+	}
+	if err := policy.Authorize(readerID, "GET", "/api/v1/users"); err != nil {
+		t.Fatalf("expected %s to be allowed: %v", readerID, err)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"rules": [{"path": "/api/v1/users", "allow": ["example.org"]}]}`), 0o600); err != nil {
+		t.Fatalf("failed to write policy file: %v", err)
+	}
+	if _, err := LoadPolicyFile(path); err == nil {
+		t.Fatal("expected invalid policy file to fail to load")
+	}
+}
@@ -0,0 +1,62 @@
+// Package command contains the bootstrap shared by the commands in this
+// repository, such as resolving the SPIRE agent Workload API address, and the
+// lifecycle handling their graceful shutdown.
+package command
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+)
+
+const (
+	// DefaultWorkloadAPIAddr is the SPIRE agent socket mounted into the pods
+	DefaultWorkloadAPIAddr = "unix:///run/spire/sockets/agent.sock"
+
+	workloadAPIAddrFlag = "workload-api-addr"
+)
+
+// Bootstrap holds the configuration shared by all commands.
+type Bootstrap struct {
+	workloadAPIAddr string
+}
+
+// RegisterFlags registers the shared command-line flags on fs.
+func (b *Bootstrap) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&b.workloadAPIAddr, workloadAPIAddrFlag, "",
+		fmt.Sprintf("SPIRE agent Workload API address, e.g. unix:///path/to/agent.sock or tcp://127.0.0.1:8081 (defaults to $%s, then %s)", workloadapi.SocketEnv, DefaultWorkloadAPIAddr))
+}
+
+// WorkloadAPIAddr resolves the Workload API address from the command-line flag,
+// then the SPIFFE_ENDPOINT_SOCKET environment variable, then the default.
+// Both unix:// and tcp:// addresses are supported.
+func (b *Bootstrap) WorkloadAPIAddr() (string, error) {
+	addr, source := b.workloadAPIAddr, "-"+workloadAPIAddrFlag
+	if addr == "" {
+		addr, source = os.Getenv(workloadapi.SocketEnv), workloadapi.SocketEnv
+	}
+	if addr == "" {
+		addr, source = DefaultWorkloadAPIAddr, "default"
+	}
+
+	if err := workloadapi.ValidateAddress(addr); err != nil {
+		return "", fmt.Errorf("invalid Workload API address %q from %s: %w", addr, source, err)
+	}
+	return addr, nil
+}
+
+// NewWorkloadAPIClient creates a Workload API client connected to the
+// resolved Workload API address.
+func (b *Bootstrap) NewWorkloadAPIClient(ctx context.Context) (*workloadapi.Client, error) {
+	addr, err := b.WorkloadAPIAddr()
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Connecting to Workload API at %s", addr)
+	return workloadapi.New(ctx, workloadapi.WithAddr(addr))
+}
@@ -0,0 +1,74 @@
+package command
+
+import (
+	"flag"
+	"testing"
+
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+)
+
+func TestWorkloadAPIAddr(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		args      []string
+		env       string
+		expect    string
+		expectErr bool
+	}{
+		{
+			name:   "default",
+			expect: DefaultWorkloadAPIAddr,
+		},
+		{
+			name:   "environment variable",
+			env:    "unix:///tmp/agent.sock",
+			expect: "unix:///tmp/agent.sock",
+		},
+		{
+			name:   "flag takes precedence over environment variable",
+			args:   []string{"-workload-api-addr", "unix:///var/run/agent.sock"},
+			env:    "unix:///tmp/agent.sock",
+			expect: "unix:///var/run/agent.sock",
+		},
+		{
+			name:   "tcp address",
+			args:   []string{"-workload-api-addr", "tcp://127.0.0.1:8081"},
+			expect: "tcp://127.0.0.1:8081",
+		},
+		{
+			name:      "tcp address without IP",
+			args:      []string{"-workload-api-addr", "tcp://localhost:8081"},
+			expectErr: true,
+		},
+		{
+			name:      "unsupported scheme",
+			env:       "http://127.0.0.1:8081",
+			expectErr: true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(workloadapi.SocketEnv, tt.env)
+
+			var b Bootstrap
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			b.RegisterFlags(fs)
+			if err := fs.Parse(tt.args); err != nil {
+				t.Fatalf("failed to parse flags: %v", err)
+			}
+
+			addr, err := b.WorkloadAPIAddr()
+			if tt.expectErr {
+				if err == nil {
+					t.Fatalf("expected an error; got address %q", addr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to resolve address: %v", err)
+			}
+			if addr != tt.expect {
+				t.Fatalf("expected address %q; got %q", tt.expect, addr)
+			}
+		})
+	}
+}
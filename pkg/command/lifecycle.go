@@ -0,0 +1,210 @@
+package command
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// ExitSuccess is returned when the command finished or shut down cleanly
+	ExitSuccess = 0
+	// ExitFailure is returned when the command failed or didn't shut down cleanly
+	ExitFailure = 1
+
+	// DefaultShutdownGracePeriod leaves headroom within the default Kubernetes
+	// termination grace period of 30s before the process is killed
+	DefaultShutdownGracePeriod = 20 * time.Second
+
+	shutdownGracePeriodFlag = "shutdown-grace-period"
+)
+
+// Lifecycle runs a command until it finishes, fails or the process receives
+// SIGINT or SIGTERM, then shuts it down gracefully: hooks registered with
+// OnShutdown run in the reverse order of registration, like deferred calls,
+// within a shared grace period. A second signal exits immediately.
+type Lifecycle struct {
+	gracePeriod time.Duration
+
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+
+	mu    sync.Mutex
+	hooks []shutdownHook
+}
+
+type shutdownHook struct {
+	name string
+	fn   func(context.Context) error
+}
+
+// errSignal is the cause of the lifecycle context being cancelled by a signal.
+type errSignal struct {
+	sig os.Signal
+}
+
+func (e errSignal) Error() string {
+	return fmt.Sprintf("received signal %s", e.sig)
+}
+
+// NewLifecycle returns a lifecycle with the default shutdown grace period.
+func NewLifecycle() *Lifecycle {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	return &Lifecycle{
+		gracePeriod: DefaultShutdownGracePeriod,
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+}
+
+// RegisterFlags registers the lifecycle command-line flags on fs.
+func (l *Lifecycle) RegisterFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&l.gracePeriod, shutdownGracePeriodFlag, DefaultShutdownGracePeriod,
+		"How long to wait for in-flight work to drain and resources to close on shutdown")
+}
+
+// Context returns the context cancelled when shutdown begins.
+func (l *Lifecycle) Context() context.Context {
+	return l.ctx
+}
+
+// Fail begins shutdown because of err, e.g. when a background goroutine
+// fails. Run returns ExitFailure.
+func (l *Lifecycle) Fail(err error) {
+	l.cancel(err)
+}
+
+// Wait blocks until shutdown begins. It returns the error passed to Fail, or
+// nil if shutdown was requested by a signal.
+func (l *Lifecycle) Wait() error {
+	<-l.ctx.Done()
+	return l.failure()
+}
+
+// OnShutdown registers fn to run on shutdown. Hooks run in the reverse order
+// they were registered in, so resources should be registered as soon as they
+// are created, before anything that uses them.
+func (l *Lifecycle) OnShutdown(name string, fn func(context.Context) error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.hooks = append(l.hooks, shutdownHook{name: name, fn: fn})
+}
+
+// CloseOnShutdown registers c to be closed on shutdown.
+func (l *Lifecycle) CloseOnShutdown(name string, c io.Closer) {
+	l.OnShutdown(name, func(context.Context) error {
+		return c.Close()
+	})
+}
+
+// ServeHTTP serves srv on its address in the background and registers it to be
+// shut down gracefully, draining in-flight requests. A failure to serve fails
+// the lifecycle.
+func (l *Lifecycle) ServeHTTP(name string, srv *http.Server) error {
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for %s on %s: %w", name, srv.Addr, err)
+	}
+	l.Serve(name, srv, ln)
+	return nil
+}
+
+// Serve is like ServeHTTP, but serves srv on ln.
+func (l *Lifecycle) Serve(name string, srv *http.Server, ln net.Listener) {
+	l.OnShutdown(name, srv.Shutdown)
+
+	log.Printf("Serving %s on %s", name, ln.Addr())
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			l.Fail(fmt.Errorf("%s failed: %w", name, err))
+		}
+	}()
+}
+
+// Run runs the command with a context that is cancelled when the process
+// receives SIGINT or SIGTERM or the lifecycle fails, then runs the shutdown
+// hooks. It returns the exit code for the process.
+func (l *Lifecycle) Run(run func(ctx context.Context) error) int {
+	signalCh := make(chan os.Signal, 2)
+	signal.Notify(signalCh, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signalCh)
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case sig := <-signalCh:
+			log.Printf("Received %s; shutting down", sig)
+			l.cancel(errSignal{sig: sig})
+		case <-l.ctx.Done():
+		case <-done:
+			return
+		}
+
+		select {
+		case sig := <-signalCh:
+			log.Printf("Received %s during shutdown; exiting immediately", sig)
+			os.Exit(ExitFailure)
+		case <-done:
+		}
+	}()
+
+	exitCode := ExitSuccess
+	err := run(l.ctx)
+	if err == nil {
+		err = l.failure()
+	}
+	if err != nil {
+		log.Printf("Failed: %v", err)
+		exitCode = ExitFailure
+	}
+
+	l.cancel(context.Canceled)
+	if err := l.shutdown(); err != nil {
+		log.Printf("Shutdown failed: %v", err)
+		exitCode = ExitFailure
+	}
+	return exitCode
+}
+
+// failure returns the error passed to Fail, if any.
+func (l *Lifecycle) failure() error {
+	cause := context.Cause(l.ctx)
+	if cause == nil || errors.Is(cause, context.Canceled) || errors.As(cause, new(errSignal)) {
+		return nil
+	}
+	return cause
+}
+
+// shutdown runs the shutdown hooks within the grace period, returning the
+// errors of the hooks that failed.
+func (l *Lifecycle) shutdown() error {
+	l.mu.Lock()
+	hooks := l.hooks
+	l.hooks = nil
+	l.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), l.gracePeriod)
+	defer cancel()
+
+	var errs []error
+	for i := len(hooks) - 1; i >= 0; i-- {
+		hook := hooks[i]
+		if err := hook.fn(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", hook.name, err))
+			continue
+		}
+		log.Printf("Shut down %s", hook.name)
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,168 @@
+package command
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestLifecycleRun(t *testing.T) {
+	errFailed := errors.New("failed")
+
+	for _, tt := range []struct {
+		name       string
+		run        func(ctx context.Context, l *Lifecycle) error
+		hookErr    error
+		expectCode int
+	}{
+		{
+			name: "run finishes",
+			run: func(context.Context, *Lifecycle) error {
+				return nil
+			},
+			expectCode: ExitSuccess,
+		},
+		{
+			name: "run fails",
+			run: func(context.Context, *Lifecycle) error {
+				return errFailed
+			},
+			expectCode: ExitFailure,
+		},
+		{
+			name: "background failure",
+			run: func(ctx context.Context, l *Lifecycle) error {
+				go l.Fail(errFailed)
+				<-ctx.Done()
+				return nil
+			},
+			expectCode: ExitFailure,
+		},
+		{
+			name: "shutdown hook fails",
+			run: func(context.Context, *Lifecycle) error {
+				return nil
+			},
+			hookErr:    errFailed,
+			expectCode: ExitFailure,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewLifecycle()
+
+			var order []string
+			for _, name := range []string{"client", "store", "server"} {
+				name := name
+				l.OnShutdown(name, func(context.Context) error {
+					order = append(order, name)
+					if name == "store" {
+						return tt.hookErr
+					}
+					return nil
+				})
+			}
+
+			code := l.Run(func(ctx context.Context) error {
+				return tt.run(ctx, l)
+			})
+			if code != tt.expectCode {
+				t.Fatalf("expected exit code %d; got %d", tt.expectCode, code)
+			}
+
+			// Hooks run even when a hook fails, in reverse order of registration
+			if expect := []string{"server", "store", "client"}; !reflect.DeepEqual(order, expect) {
+				t.Fatalf("expected shutdown order %v; got %v", expect, order)
+			}
+			if l.Context().Err() == nil {
+				t.Fatal("expected context to be cancelled after run")
+			}
+		})
+	}
+}
+
+func TestLifecycleSignalDrainsRequests(t *testing.T) {
+	l := NewLifecycle()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		close(started)
+		<-release
+		io.WriteString(w, "done")
+	})}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	var closed bool
+	l.OnShutdown("store", func(context.Context) error {
+		closed = true
+		return nil
+	})
+	l.Serve("test server", srv, ln)
+
+	type response struct {
+		body string
+		err  error
+	}
+	respCh := make(chan response, 1)
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String())
+		if err != nil {
+			respCh <- response{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		respCh <- response{body: string(body), err: err}
+	}()
+
+	code := l.Run(func(ctx context.Context) error {
+		<-started
+		if err := syscall.Kill(syscall.Getpid(), syscall.SIGTERM); err != nil {
+			return err
+		}
+		<-ctx.Done()
+
+		// The request in flight when the signal arrived is still served
+		time.AfterFunc(50*time.Millisecond, func() { close(release) })
+		return l.Wait()
+	})
+	if code != ExitSuccess {
+		t.Fatalf("expected exit code %d; got %d", ExitSuccess, code)
+	}
+	if !closed {
+		t.Fatal("expected store to be closed on shutdown")
+	}
+
+	resp := <-respCh
+	if resp.err != nil {
+		t.Fatalf("in-flight request failed: %v", resp.err)
+	}
+	if resp.body != "done" {
+		t.Fatalf("expected in-flight request to complete; got %q", resp.body)
+	}
+}
+
+func TestLifecycleShutdownGracePeriod(t *testing.T) {
+	l := NewLifecycle()
+	l.gracePeriod = 10 * time.Millisecond
+	l.OnShutdown("slow", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	code := l.Run(func(context.Context) error {
+		return nil
+	})
+	if code != ExitFailure {
+		t.Fatalf("expected exit code %d when the grace period is exceeded; got %d", ExitFailure, code)
+	}
+}
@@ -0,0 +1,136 @@
+package common
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+)
+
+// mysqlErrAccessDenied is the MySQL error number of a rejected login
+const mysqlErrAccessDenied = 1045 // ER_ACCESS_DENIED_ERROR
+
+// The kinds of ConnError, telling why connecting to MySQL failed.
+var (
+	// ErrCertVerification means the MySQL server's certificate failed
+	// verification against the trust bundle, or the server rejected the
+	// client's SVID during the TLS handshake.
+	ErrCertVerification = errors.New("MySQL TLS certificate verification failed")
+
+	// ErrServerIDMismatch means the MySQL server presented a valid SVID, but
+	// not with the SPIFFE ID expected of it.
+	ErrServerIDMismatch = errors.New("MySQL server SPIFFE ID mismatch")
+
+	// ErrSVIDExpired means the client's or the server's X.509-SVID expired,
+	// or isn't valid yet.
+	ErrSVIDExpired = errors.New("X.509-SVID expired")
+
+	// ErrAccessDenied means MySQL rejected the login after the TLS handshake,
+	// e.g. because the SVID's subject doesn't pass the user's REQUIRE
+	// SUBJECT check.
+	ErrAccessDenied = errors.New("MySQL access denied")
+
+	// ErrNetwork means MySQL couldn't be reached, or the connection broke.
+	ErrNetwork = errors.New("MySQL unreachable")
+)
+
+// ConnError is a failure to connect to MySQL. It matches its Kind, one of the
+// errors above, and the underlying error with errors.Is and errors.As.
+type ConnError struct {
+	Kind error
+	Err  error
+}
+
+func (e *ConnError) Error() string {
+	return e.Kind.Error() + ": " + e.Err.Error()
+}
+
+func (e *ConnError) Unwrap() []error {
+	return []error{e.Kind, e.Err}
+}
+
+// ClassifyConnError returns err as a *ConnError if it's a failure to connect
+// to MySQL, rather than of a query, and err unchanged otherwise.
+func ClassifyConnError(err error) error {
+	var connErr *ConnError
+	if err == nil || errors.As(err, &connErr) {
+		return err
+	}
+	if kind := connErrorKind(err); kind != nil {
+		return &ConnError{Kind: kind, Err: err}
+	}
+	return err
+}
+
+func connErrorKind(err error) error {
+	var mysqlErr *mysql.MySQLError
+	var opErr *net.OpError
+	var dnsErr *net.DNSError
+	var invalidErr x509.CertificateInvalidError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var verificationErr *tls.CertificateVerificationError
+	var recordErr tls.RecordHeaderError
+	switch {
+	case errors.As(err, &mysqlErr):
+		if mysqlErr.Number == mysqlErrAccessDenied {
+			return ErrAccessDenied
+		}
+		return nil
+	case errors.As(err, &invalidErr) && invalidErr.Reason == x509.Expired:
+		return ErrSVIDExpired
+	case errors.As(err, &invalidErr), errors.As(err, &authorityErr), errors.As(err, &hostnameErr),
+		errors.As(err, &verificationErr), errors.As(err, &recordErr):
+		return ErrCertVerification
+	case errors.As(err, &opErr) && opErr.Op == "remote error":
+		// The server sent a TLS alert, rejecting the client's SVID. Alerts
+		// are only exposed by their text, e.g. "tls: expired certificate"
+		if strings.Contains(opErr.Err.Error(), "expired certificate") {
+			return ErrSVIDExpired
+		}
+		return ErrCertVerification
+	case errors.As(err, &opErr), errors.As(err, &dnsErr),
+		errors.Is(err, driver.ErrBadConn), errors.Is(err, mysql.ErrInvalidConn):
+		return ErrNetwork
+	}
+	return nil
+}
+
+// authorizeServerID authorizes a MySQL server SVID with the SPIFFE ID, like
+// tlsconfig.AuthorizeID, failing with ErrServerIDMismatch otherwise.
+func authorizeServerID(expected spiffeid.ID) tlsconfig.Authorizer {
+	return func(actual spiffeid.ID, _ [][]*x509.Certificate) error {
+		if actual != expected {
+			return fmt.Errorf("%w: got %s, expected %s", ErrServerIDMismatch, actual, expected)
+		}
+		return nil
+	}
+}
+
+// classifyVerification wraps the verification of the MySQL server's
+// certificate so that its failures are returned as a *ConnError, as the TLS
+// handshake returns them unchanged.
+func classifyVerification(verify func([][]byte, [][]*x509.Certificate) error) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, chains [][]*x509.Certificate) error {
+		err := verify(rawCerts, chains)
+		switch {
+		case err == nil:
+			return nil
+		case errors.Is(err, ErrServerIDMismatch):
+			return &ConnError{Kind: ErrServerIDMismatch, Err: err}
+		default:
+			// e.g. an expired SVID, or one signed by another trust domain
+			if kind := connErrorKind(err); kind == ErrSVIDExpired {
+				return &ConnError{Kind: kind, Err: err}
+			}
+			return &ConnError{Kind: ErrCertVerification, Err: err}
+		}
+	}
+}
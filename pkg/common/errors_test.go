@@ -0,0 +1,56 @@
+package common
+
+import (
+	"crypto/x509"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// alertError stands for the TLS alerts received from the server, whose type
+// isn't exported.
+type alertError string
+
+func (e alertError) Error() string { return string(e) }
+
+func TestClassifyConnError(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		err        error
+		expectKind error
+	}{
+		{name: "nil"},
+		{name: "query error", err: &mysql.MySQLError{Number: 1062, Message: "Duplicate entry"}},
+		{name: "access denied", err: fmt.Errorf("ping: %w", &mysql.MySQLError{Number: 1045, Message: "Access denied"}), expectKind: ErrAccessDenied},
+		{name: "expired server SVID", err: fmt.Errorf("x509svid: could not verify leaf certificate: %w", x509.CertificateInvalidError{Reason: x509.Expired}), expectKind: ErrSVIDExpired},
+		{name: "expired client SVID", err: &net.OpError{Op: "remote error", Err: alertError("tls: expired certificate")}, expectKind: ErrSVIDExpired},
+		{name: "client SVID rejected", err: &net.OpError{Op: "remote error", Err: alertError("tls: bad certificate")}, expectKind: ErrCertVerification},
+		{name: "untrusted server SVID", err: x509.UnknownAuthorityError{}, expectKind: ErrCertVerification},
+		{name: "dial failure", err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, expectKind: ErrNetwork},
+		{name: "DNS failure", err: &net.DNSError{Err: "no such host", Name: "mysql"}, expectKind: ErrNetwork},
+		{name: "bad connection", err: driver.ErrBadConn, expectKind: ErrNetwork},
+		{name: "invalid connection", err: mysql.ErrInvalidConn, expectKind: ErrNetwork},
+		{name: "classified", err: &ConnError{Kind: ErrServerIDMismatch, Err: errors.New(`unexpected ID "spiffe://example.org/mysql/replica"`)}, expectKind: ErrServerIDMismatch},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ClassifyConnError(tt.err)
+			var connErr *ConnError
+			if tt.expectKind == nil {
+				if err != tt.err {
+					t.Fatalf("expected %v to be returned unchanged; got %v", tt.err, err)
+				}
+				return
+			}
+			if !errors.As(err, &connErr) || connErr.Kind != tt.expectKind {
+				t.Fatalf("expected %v to be classified as %v; got %v", tt.err, tt.expectKind, err)
+			}
+			if !errors.Is(err, tt.expectKind) || !errors.Is(err, tt.err) {
+				t.Fatalf("expected %v to match both %v and %v", err, tt.expectKind, tt.err)
+			}
+		})
+	}
+}
@@ -5,7 +5,11 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
+	"net"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/go-sql-driver/mysql"
 	"github.com/spiffe/go-spiffe/v2/spiffeid"
@@ -15,6 +19,10 @@ import (
 )
 
 const (
+	// Environment variables overriding the in-cluster defaults, e.g. to run the commands locally
+	svidDirEnv   = "SPIRE_SVID_DIR"
+	mysqlAddrEnv = "MYSQL_ADDR"
+
 	// SPIRE SVID related constants
 	svidDir    = "/spire/certs"
 	bundleFile = "bundle.0.pem"
@@ -29,15 +37,44 @@ const (
 )
 
 var (
-	certFilePath   = fmt.Sprintf("%s/%s", svidDir, certFile)
-	keyFilePath    = fmt.Sprintf("%s/%s", svidDir, keyFile)
-	bundleFilePath = fmt.Sprintf("%s/%s", svidDir, bundleFile)
-
 	// SPIFFE ID for MySQL Server
 	mysqlServerSPIFFEID = spiffeid.RequireFromString("spiffe://example.org/mysql/server")
 )
 
+// EnvOrDefault returns the value of the environment variable key, or def if
+// it is unset or empty.
+func EnvOrDefault(key, def string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return def
+}
+
+// SVIDDir returns the directory MySQL reads its SVID files from, taken from
+// SPIRE_SVID_DIR if set.
+func SVIDDir() string {
+	return EnvOrDefault(svidDirEnv, svidDir)
+}
+
+// WriteMySQLServerSVIDFiles writes the MySQL server SVID files to SVIDDir.
 func WriteMySQLServerSVIDFiles(c *workloadapi.X509Context) error {
+	return WriteMySQLServerSVIDFilesToDir(c, SVIDDir())
+}
+
+// HasMySQLServerSVID reports whether the X.509 context contains the SVID
+// with the MySQL server hint.
+func HasMySQLServerSVID(c *workloadapi.X509Context) bool {
+	_, err := getSVIDByHint(c, mysqlServerSVIDHint)
+	return err == nil
+}
+
+// WriteMySQLServerSVIDFilesToDir writes the MySQL server SVID, its key and the
+// trust bundle to dir, using the file names MySQL is configured with.
+func WriteMySQLServerSVIDFilesToDir(c *workloadapi.X509Context, dir string) error {
+	certFilePath := filepath.Join(dir, certFile)
+	keyFilePath := filepath.Join(dir, keyFile)
+	bundleFilePath := filepath.Join(dir, bundleFile)
+
 	svid, err := getSVIDByHint(c, mysqlServerSVIDHint)
 	if err != nil {
 		return err
@@ -68,15 +105,81 @@ func WriteMySQLServerSVIDFiles(c *workloadapi.X509Context) error {
 	return nil
 }
 
+// MySQLServer is a MySQL server to connect to, e.g. a read replica, and the
+// SPIFFE ID its X.509-SVID must have.
+type MySQLServer struct {
+	Addr string
+	ID   spiffeid.ID
+}
+
+// String returns the server in the form parsed by ParseMySQLServer.
+func (s MySQLServer) String() string {
+	return s.Addr + "=" + s.ID.String()
+}
+
+// PrimaryMySQLServer returns the primary MySQL server, at MYSQL_ADDR if set.
+func PrimaryMySQLServer() MySQLServer {
+	return MySQLServer{
+		Addr: EnvOrDefault(mysqlAddrEnv, net.JoinHostPort(mysqlHost, mysqlPort)),
+		ID:   mysqlServerSPIFFEID,
+	}
+}
+
+// ParseMySQLServer parses a server given as <addr>=<SPIFFE ID>, e.g.
+// mysql-1.mysql:3306=spiffe://example.org/mysql/replica.
+func ParseMySQLServer(s string) (MySQLServer, error) {
+	addr, rawID, ok := strings.Cut(s, "=")
+	if !ok || addr == "" {
+		return MySQLServer{}, fmt.Errorf("malformed MySQL server %q; expected <addr>=<SPIFFE ID>", s)
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return MySQLServer{}, fmt.Errorf("malformed MySQL server address %q: %w", addr, err)
+	}
+	id, err := spiffeid.FromString(rawID)
+	if err != nil {
+		return MySQLServer{}, fmt.Errorf("malformed MySQL server SPIFFE ID %q: %w", rawID, err)
+	}
+	return MySQLServer{Addr: addr, ID: id}, nil
+}
+
+// ParseMySQLServers parses a comma-separated list of servers given as
+// <addr>=<SPIFFE ID>.
+func ParseMySQLServers(s string) ([]MySQLServer, error) {
+	var servers []MySQLServer
+	for _, raw := range strings.Split(s, ",") {
+		if raw = strings.TrimSpace(raw); raw == "" {
+			continue
+		}
+		server, err := ParseMySQLServer(raw)
+		if err != nil {
+			return nil, err
+		}
+		servers = append(servers, server)
+	}
+	return servers, nil
+}
+
 func NewMySQLDBWithSPIRETLSConfig(c *workloadapi.X509Context, mysqlUser string, dbName string, svidHint string) (*sql.DB, error) {
-	// Create TLS config with client certificates
-	if err := RegisterTLSConfig(c, svidHint); err != nil {
+	return NewMySQLDBForServer(c, PrimaryMySQLServer(), mysqlUser, dbName, svidHint)
+}
+
+// NewMySQLDBForServer returns a DB connecting to the server over mTLS with the
+// SVID, only trusting the server if it presents the server's SPIFFE ID.
+func NewMySQLDBForServer(c *workloadapi.X509Context, server MySQLServer, mysqlUser string, dbName string, svidHint string) (*sql.DB, error) {
+	// Create TLS config with client certificates, registered per server as each
+	// expects a different server SPIFFE ID
+	tlsConfigName := mysqlTLSConfigName
+	if server != PrimaryMySQLServer() {
+		tlsConfigName = mysqlTLSConfigName + "-" + server.Addr
+	}
+	if err := registerTLSConfig(c, svidHint, tlsConfigName, server.ID); err != nil {
 		log.Printf("Failed to register MySQL TLS config: %v", err)
 		return nil, err
 	}
 
 	// Format is specified https://github.com/go-sql-driver/mysql#dsn-data-source-name
-	dbConnectionString := fmt.Sprintf("%s@tcp(%s:%s)/%s?tls=%s", mysqlUser, mysqlHost, mysqlPort, dbName, mysqlTLSConfigName)
+	// DATETIME columns are scanned into time.Time, in UTC
+	dbConnectionString := fmt.Sprintf("%s@tcp(%s)/%s?parseTime=true&tls=%s", mysqlUser, server.Addr, dbName, url.QueryEscape(tlsConfigName))
 
 	db, err := sql.Open("mysql", dbConnectionString)
 	if err != nil {
@@ -87,13 +190,17 @@ func NewMySQLDBWithSPIRETLSConfig(c *workloadapi.X509Context, mysqlUser string,
 }
 
 func RegisterTLSConfig(c *workloadapi.X509Context, svidHint string) error {
+	return registerTLSConfig(c, svidHint, mysqlTLSConfigName, mysqlServerSPIFFEID)
+}
+
+func registerTLSConfig(c *workloadapi.X509Context, svidHint string, name string, serverID spiffeid.ID) error {
 	// Create TLS config with client certificates
-	tlsConf, err := createTLSConf(c, svidHint)
+	tlsConf, err := createTLSConf(c, svidHint, serverID)
 	if err != nil {
 		return err
 	}
 
-	return mysql.RegisterTLSConfig(mysqlTLSConfigName, tlsConf)
+	return mysql.RegisterTLSConfig(name, tlsConf)
 }
 
 func LogSVIDs(c *workloadapi.X509Context) error {
@@ -120,7 +227,7 @@ func LogSVIDs(c *workloadapi.X509Context) error {
 	return nil
 }
 
-func createTLSConf(c *workloadapi.X509Context, svidHint string) (*tls.Config, error) {
+func createTLSConf(c *workloadapi.X509Context, svidHint string, serverID spiffeid.ID) (*tls.Config, error) {
 	var err error
 	svid := c.DefaultSVID()
 	if svidHint != "" {
@@ -129,7 +236,10 @@ func createTLSConf(c *workloadapi.X509Context, svidHint string) (*tls.Config, er
 			return nil, err
 		}
 	}
-	return tlsconfig.MTLSClientConfig(svid, c.Bundles, tlsconfig.AuthorizeID(mysqlServerSPIFFEID)), nil
+	tlsConf := tlsconfig.MTLSClientConfig(svid, c.Bundles, authorizeServerID(serverID))
+	// Verification failures are classified, see ClassifyConnError
+	tlsConf.VerifyPeerCertificate = classifyVerification(tlsConf.VerifyPeerCertificate)
+	return tlsConf, nil
 }
 
 func getSVIDByHint(c *workloadapi.X509Context, hint string) (*x509svid.SVID, error) {
@@ -0,0 +1,200 @@
+package common
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/rturner3/spire-mysql-demo/pkg/test/fakeworkloadapi"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+)
+
+var (
+	td       = spiffeid.RequireTrustDomainFromString("example.org")
+	clientID = spiffeid.RequireFromPath(td, "/mysql/client/mysql-tls-reloader")
+)
+
+func TestWriteMySQLServerSVIDFilesToDir(t *testing.T) {
+	api := newWorkloadAPI(t)
+	x509Context := fetchX509Context(t, api)
+
+	dir := t.TempDir()
+	if err := WriteMySQLServerSVIDFilesToDir(x509Context, dir); err != nil {
+		t.Fatalf("failed to write SVID files: %v", err)
+	}
+
+	svid, err := x509svid.Load(filepath.Join(dir, certFile), filepath.Join(dir, keyFile))
+	if err != nil {
+		t.Fatalf("failed to load written SVID: %v", err)
+	}
+	if expected := api.X509SVID(mysqlServerSVIDHint); !svid.Certificates[0].Equal(expected.Certificates[0]) {
+		t.Fatal("expected the SVID with the mysql-server hint to be written")
+	}
+
+	bundle, err := x509bundle.Load(td, filepath.Join(dir, bundleFile))
+	if err != nil {
+		t.Fatalf("failed to load written bundle: %v", err)
+	}
+	if len(bundle.X509Authorities()) != 1 {
+		t.Fatalf("expected 1 authority in bundle; got %d", len(bundle.X509Authorities()))
+	}
+}
+
+func TestWriteMySQLServerSVIDFilesToDirMissingHint(t *testing.T) {
+	api := fakeworkloadapi.New(t, fakeworkloadapi.NewCA(t, td), fakeworkloadapi.Identity{ID: clientID, Hint: "mysql-client"})
+	x509Context := fetchX509Context(t, api)
+
+	dir := t.TempDir()
+	if err := WriteMySQLServerSVIDFilesToDir(x509Context, dir); err == nil {
+		t.Fatal("expected an error when no SVID has the mysql-server hint")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("expected no files to be written; got %d", len(entries))
+	}
+}
+
+func TestCreateTLSConf(t *testing.T) {
+	api := newWorkloadAPI(t)
+	x509Context := fetchX509Context(t, api)
+
+	for _, tt := range []struct {
+		name      string
+		svidHint  string
+		expectErr bool
+		expectID  spiffeid.ID
+	}{
+		{name: "default SVID", expectID: mysqlServerSPIFFEID},
+		{name: "SVID by hint", svidHint: "mysql-client", expectID: clientID},
+		{name: "unknown hint", svidHint: "unknown", expectErr: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tlsConf, err := createTLSConf(x509Context, tt.svidHint, mysqlServerSPIFFEID)
+			if tt.expectErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to create TLS config: %v", err)
+			}
+
+			cert, err := tlsConf.GetClientCertificate(nil)
+			if err != nil {
+				t.Fatalf("failed to get client certificate: %v", err)
+			}
+			leaf, err := x509.ParseCertificate(cert.Certificate[0])
+			if err != nil {
+				t.Fatalf("failed to parse client certificate: %v", err)
+			}
+			if id, err := x509svid.IDFromCert(leaf); err != nil || id != tt.expectID {
+				t.Fatalf("expected client certificate for %s; got %s (err=%v)", tt.expectID, id, err)
+			}
+		})
+	}
+}
+
+func TestCreateTLSConfVerifiesServerID(t *testing.T) {
+	api := newWorkloadAPI(t)
+	x509Context := fetchX509Context(t, api)
+	serverCert := api.X509SVID(mysqlServerSVIDHint).Certificates[0].Raw
+	untrustedCert := fakeworkloadapi.NewCA(t, td).MintX509SVID(fakeworkloadapi.Identity{ID: mysqlServerSPIFFEID}).Certificates[0].Raw
+
+	for _, tt := range []struct {
+		name       string
+		serverID   spiffeid.ID
+		serverCert []byte
+		expectKind error
+	}{
+		{name: "expected server", serverID: mysqlServerSPIFFEID, serverCert: serverCert},
+		{name: "unexpected server", serverID: spiffeid.RequireFromPath(td, "/mysql/replica"), serverCert: serverCert, expectKind: ErrServerIDMismatch},
+		{name: "untrusted server", serverID: mysqlServerSPIFFEID, serverCert: untrustedCert, expectKind: ErrCertVerification},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tlsConf, err := createTLSConf(x509Context, "", tt.serverID)
+			if err != nil {
+				t.Fatalf("failed to create TLS config: %v", err)
+			}
+			err = tlsConf.VerifyPeerCertificate([][]byte{tt.serverCert}, nil)
+			if tt.expectKind == nil && err != nil {
+				t.Fatalf("expected the server certificate to be accepted; got %v", err)
+			}
+			// The TLS handshake returns the error as is, so it must already
+			// be classified
+			var connErr *ConnError
+			if tt.expectKind != nil && (!errors.As(err, &connErr) || connErr.Kind != tt.expectKind) {
+				t.Fatalf("expected the server certificate to be rejected with %v; got %v", tt.expectKind, err)
+			}
+		})
+	}
+}
+
+func TestParseMySQLServers(t *testing.T) {
+	replicaID := spiffeid.RequireFromPath(td, "/mysql/replica")
+
+	for _, tt := range []struct {
+		name      string
+		in        string
+		expect    []MySQLServer
+		expectErr bool
+	}{
+		{name: "empty"},
+		{
+			name: "servers",
+			in:   "mysql-1.mysql:3306=spiffe://example.org/mysql/replica, mysql-2.mysql:3306=spiffe://example.org/mysql/replica",
+			expect: []MySQLServer{
+				{Addr: "mysql-1.mysql:3306", ID: replicaID},
+				{Addr: "mysql-2.mysql:3306", ID: replicaID},
+			},
+		},
+		{name: "missing SPIFFE ID", in: "mysql-1.mysql:3306", expectErr: true},
+		{name: "missing port", in: "mysql-1.mysql=spiffe://example.org/mysql/replica", expectErr: true},
+		{name: "malformed SPIFFE ID", in: "mysql-1.mysql:3306=example.org/mysql/replica", expectErr: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			servers, err := ParseMySQLServers(tt.in)
+			if tt.expectErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to parse servers: %v", err)
+			}
+			if !reflect.DeepEqual(servers, tt.expect) {
+				t.Fatalf("expected %v; got %v", tt.expect, servers)
+			}
+		})
+	}
+}
+
+func newWorkloadAPI(t *testing.T) *fakeworkloadapi.WorkloadAPI {
+	return fakeworkloadapi.New(t, fakeworkloadapi.NewCA(t, td),
+		fakeworkloadapi.Identity{ID: mysqlServerSPIFFEID, Hint: mysqlServerSVIDHint},
+		fakeworkloadapi.Identity{
+			ID:      clientID,
+			Hint:    "mysql-client",
+			Subject: pkix.Name{Country: []string{"US"}, Organization: []string{"SPIRE"}, CommonName: "mysql-tls-reloader"},
+		},
+	)
+}
+
+func fetchX509Context(t *testing.T, api *fakeworkloadapi.WorkloadAPI) *workloadapi.X509Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	x509Context, err := workloadapi.FetchX509Context(ctx, workloadapi.WithAddr(api.Addr()))
+	if err != nil {
+		t.Fatalf("failed to fetch X.509 context: %v", err)
+	}
+	return x509Context
+}
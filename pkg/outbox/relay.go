@@ -0,0 +1,179 @@
+// Package outbox relays the user change events written by the store to its
+// UserEvents outbox table to a sink, e.g. a webhook, so that other services
+// can react to changes without polling the users API.
+//
+// Delivery is at least once: an event is only removed from the outbox once
+// the sink accepted it, so it's published again if the relay fails or stops
+// in between. Consumers drop duplicates by the event's idempotency key.
+package outbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/rturner3/spire-mysql-demo/pkg/store"
+)
+
+const (
+	// DefaultPollInterval is how often the relay polls for new events by
+	// default
+	DefaultPollInterval = time.Second
+	// DefaultBatchSize is the number of events read per poll by default
+	DefaultBatchSize = 100
+
+	defaultMaxBackoff = time.Minute
+	// ackTimeout bounds acknowledging published events, which is still done
+	// once the relay is stopping so that they aren't published again
+	ackTimeout = 10 * time.Second
+)
+
+// Source is the outbox events are read from and removed from once published,
+// implemented by *store.Store.
+type Source interface {
+	PendingEvents(ctx context.Context, limit int) ([]store.Event, error)
+	AckEvents(ctx context.Context, ids []int64) error
+}
+
+// Sink publishes events. Publish must only return nil once the event was
+// accepted, as it isn't published again afterwards.
+type Sink interface {
+	Publish(ctx context.Context, event store.Event) error
+}
+
+// Relay publishes the pending events of a source to a sink, in ID order,
+// polling the source for new events.
+type Relay struct {
+	source Source
+	sink   Sink
+
+	pollInterval time.Duration
+	batchSize    int
+	maxBackoff   time.Duration
+
+	published atomic.Uint64
+	failures  atomic.Uint64
+}
+
+// Option configures a Relay.
+type Option func(*Relay)
+
+// WithPollInterval sets how often the relay polls the source for events once
+// it published all pending events.
+func WithPollInterval(interval time.Duration) Option {
+	return func(r *Relay) {
+		r.pollInterval = interval
+	}
+}
+
+// WithBatchSize sets the number of events read from the source per poll.
+func WithBatchSize(size int) Option {
+	return func(r *Relay) {
+		if size > 0 {
+			r.batchSize = size
+		}
+	}
+}
+
+// WithMaxBackoff sets the longest delay between attempts after failures,
+// which starts at the poll interval and doubles with each failure.
+func WithMaxBackoff(backoff time.Duration) Option {
+	return func(r *Relay) {
+		r.maxBackoff = backoff
+	}
+}
+
+// NewRelay returns a relay publishing the events of source to sink.
+func NewRelay(source Source, sink Sink, opts ...Option) *Relay {
+	r := &Relay{
+		source:       source,
+		sink:         sink,
+		pollInterval: DefaultPollInterval,
+		batchSize:    DefaultBatchSize,
+		maxBackoff:   defaultMaxBackoff,
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// Run publishes events until ctx is done. Failures are retried with
+// exponential backoff, starting over with the first event that wasn't
+// published.
+func (r *Relay) Run(ctx context.Context) {
+	var backoff time.Duration
+	for {
+		n, err := r.relay(ctx)
+		wait := r.pollInterval
+		switch {
+		case err != nil && ctx.Err() != nil:
+			return
+		case err != nil:
+			r.failures.Add(1)
+			backoff = min(max(2*backoff, r.pollInterval), r.maxBackoff)
+			wait = backoff
+			log.Printf("Failed to relay events, retrying in %s: %v", wait, err)
+		case n == r.batchSize:
+			// More events may be pending
+			backoff, wait = 0, 0
+		default:
+			backoff = 0
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// relay publishes a batch of pending events, returning how many were pending.
+// The events published before a failure are still acknowledged.
+func (r *Relay) relay(ctx context.Context) (int, error) {
+	events, err := r.source.PendingEvents(ctx, r.batchSize)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read pending events: %w", err)
+	}
+
+	var published []int64
+	var publishErr error
+	for _, event := range events {
+		if err := r.sink.Publish(ctx, event); err != nil {
+			publishErr = fmt.Errorf("failed to publish event %s: %w", event.IdempotencyKey, err)
+			break
+		}
+		published = append(published, event.ID)
+	}
+
+	ackCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), ackTimeout)
+	defer cancel()
+	if err := r.source.AckEvents(ackCtx, published); err != nil {
+		// The events are published again, which consumers tolerate
+		return len(events), errors.Join(publishErr, fmt.Errorf("failed to ack %d published events: %w", len(published), err))
+	}
+	r.published.Add(uint64(len(published)))
+	return len(events), publishErr
+}
+
+// Stats describes the events relayed so far.
+type Stats struct {
+	// Published is the number of events published and acknowledged
+	Published uint64 `json:"published"`
+	// Failures is the number of failed attempts to relay events
+	Failures uint64 `json:"failures"`
+}
+
+// Stats returns the statistics of the events relayed so far.
+func (r *Relay) Stats() Stats {
+	return Stats{
+		Published: r.published.Load(),
+		Failures:  r.failures.Load(),
+	}
+}
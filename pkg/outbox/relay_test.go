@@ -0,0 +1,166 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rturner3/spire-mysql-demo/pkg/store"
+)
+
+func TestRelayPublishesEvents(t *testing.T) {
+	source := newFakeSource(5)
+	events := make(chan store.Event)
+	relay := NewRelay(source, ChannelSink(events), WithBatchSize(2), WithPollInterval(time.Millisecond))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go relay.Run(ctx)
+
+	var keys []string
+	for i := 0; i < 5; i++ {
+		keys = append(keys, (<-events).IdempotencyKey)
+	}
+	if expect := []string{"user-1-v1", "user-2-v1", "user-3-v1", "user-4-v1", "user-5-v1"}; !reflect.DeepEqual(keys, expect) {
+		t.Fatalf("expected events %v in order; got %v", expect, keys)
+	}
+	waitFor(t, func() bool { return relay.Stats().Published == 5 })
+	if pending := source.pending(); pending != 0 {
+		t.Fatalf("expected all events to be acknowledged; got %d pending", pending)
+	}
+}
+
+func TestRelayRetriesFailures(t *testing.T) {
+	source := newFakeSource(3)
+	sink := &flakySink{failAt: map[int]bool{2: true}}
+	relay := NewRelay(source, sink, WithPollInterval(time.Millisecond), WithMaxBackoff(time.Millisecond))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go relay.Run(ctx)
+
+	// The events published before the failure are acknowledged, and the
+	// failed event is published again along with the following ones
+	waitFor(t, func() bool { return relay.Stats().Published == 3 })
+	if expect := []string{"user-1-v1", "user-2-v1", "user-2-v1", "user-3-v1"}; !reflect.DeepEqual(sink.attempts(), expect) {
+		t.Fatalf("expected publish attempts %v; got %v", expect, sink.attempts())
+	}
+	if stats := relay.Stats(); stats.Failures != 1 {
+		t.Fatalf("expected 1 failure; got %+v", stats)
+	}
+}
+
+func TestRelayRepublishesUnacknowledgedEvents(t *testing.T) {
+	source := newFakeSource(2)
+	source.failAcks(1)
+	sink := &flakySink{}
+	relay := NewRelay(source, sink, WithPollInterval(time.Millisecond), WithMaxBackoff(time.Millisecond))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go relay.Run(ctx)
+
+	// Events whose ack failed are delivered again, with the same keys
+	waitFor(t, func() bool { return relay.Stats().Published == 2 })
+	if expect := []string{"user-1-v1", "user-2-v1", "user-1-v1", "user-2-v1"}; !reflect.DeepEqual(sink.attempts(), expect) {
+		t.Fatalf("expected publish attempts %v; got %v", expect, sink.attempts())
+	}
+}
+
+// fakeSource is an outbox with the creation events of users.
+type fakeSource struct {
+	mu       sync.Mutex
+	events   []store.Event
+	ackFails int
+}
+
+func newFakeSource(n int) *fakeSource {
+	s := &fakeSource{}
+	for id := 1; id <= n; id++ {
+		s.events = append(s.events, store.Event{
+			ID:             int64(id),
+			IdempotencyKey: fmt.Sprintf("user-%d-v1", id),
+			Type:           store.EventUserCreated,
+			User:           store.User{ID: id, Name: "David", Version: 1},
+		})
+	}
+	return s
+}
+
+func (s *fakeSource) failAcks(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ackFails = n
+}
+
+func (s *fakeSource) pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.events)
+}
+
+func (s *fakeSource) PendingEvents(_ context.Context, limit int) ([]store.Event, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]store.Event(nil), s.events[:min(limit, len(s.events))]...), nil
+}
+
+func (s *fakeSource) AckEvents(_ context.Context, ids []int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ackFails > 0 {
+		s.ackFails--
+		return errors.New("ack failed")
+	}
+	acked := make(map[int64]bool)
+	for _, id := range ids {
+		acked[id] = true
+	}
+	var events []store.Event
+	for _, event := range s.events {
+		if !acked[event.ID] {
+			events = append(events, event)
+		}
+	}
+	s.events = events
+	return nil
+}
+
+// flakySink records the keys of the events published to it, failing the
+// attempts numbered in failAt, starting at 1.
+type flakySink struct {
+	mu     sync.Mutex
+	failAt map[int]bool
+	keys   []string
+}
+
+func (s *flakySink) Publish(_ context.Context, event store.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = append(s.keys, event.IdempotencyKey)
+	if s.failAt[len(s.keys)] {
+		return errors.New("sink is unavailable")
+	}
+	return nil
+}
+
+func (s *flakySink) attempts() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.keys...)
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,106 @@
+package outbox
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/rturner3/spire-mysql-demo/pkg/store"
+)
+
+// IdempotencyKeyHeader carries the idempotency key of the event posted by a
+// WebhookSink.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// WebhookSink publishes each event as the JSON body of a POST request to a
+// URL, which must respond with a 2xx status once it accepted the event.
+type WebhookSink struct {
+	url    string
+	client *http.Client
+}
+
+// NewWebhookSink returns a sink posting events to url with client.
+func NewWebhookSink(url string, client *http.Client) *WebhookSink {
+	return &WebhookSink{url: url, client: client}
+}
+
+func (s *WebhookSink) Publish(ctx context.Context, event store.Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(IdempotencyKeyHeader, event.IdempotencyKey)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// Drain the body so that the connection can be reused
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// FileSink appends each event as a line of JSON to a file, synced to disk
+// before the event is acknowledged.
+type FileSink struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewFileSink returns a sink appending events to the file at path, which is
+// created if needed.
+func NewFileSink(path string) (*FileSink, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open events file: %w", err)
+	}
+	return &FileSink{file: file}, nil
+}
+
+func (s *FileSink) Publish(_ context.Context, event store.Event) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
+// Close closes the file.
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
+
+// ChannelSink sends each event on the channel, e.g. to consume events in
+// process or in tests.
+type ChannelSink chan<- store.Event
+
+func (s ChannelSink) Publish(ctx context.Context, event store.Event) error {
+	select {
+	case s <- event:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
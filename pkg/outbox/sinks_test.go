@@ -0,0 +1,79 @@
+package outbox
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rturner3/spire-mysql-demo/pkg/store"
+)
+
+func TestWebhookSink(t *testing.T) {
+	var keys []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event store.Event
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil || r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		keys = append(keys, r.Header.Get(IdempotencyKeyHeader))
+		if event.User.Name == "Mallory" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	sink := NewWebhookSink(server.URL, server.Client())
+	ctx := context.Background()
+	if err := sink.Publish(ctx, store.Event{IdempotencyKey: "user-1-v1", User: store.User{Name: "David"}}); err != nil {
+		t.Fatalf("failed to publish event: %v", err)
+	}
+	if err := sink.Publish(ctx, store.Event{IdempotencyKey: "user-2-v1", User: store.User{Name: "Mallory"}}); err == nil {
+		t.Fatal("expected an error status to fail the publish")
+	}
+	if len(keys) != 2 || keys[0] != "user-1-v1" || keys[1] != "user-2-v1" {
+		t.Fatalf("expected the idempotency keys to be sent; got %v", keys)
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.ndjson")
+	for _, key := range []string{"user-1-v1", "user-1-v2"} {
+		// The file is appended to across sinks
+		sink, err := NewFileSink(path)
+		if err != nil {
+			t.Fatalf("failed to create file sink: %v", err)
+		}
+		if err := sink.Publish(context.Background(), store.Event{IdempotencyKey: key}); err != nil {
+			t.Fatalf("failed to publish event: %v", err)
+		}
+		if err := sink.Close(); err != nil {
+			t.Fatalf("failed to close file sink: %v", err)
+		}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("failed to open events file: %v", err)
+	}
+	defer file.Close()
+	var keys []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var event store.Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("malformed event line %q: %v", scanner.Text(), err)
+		}
+		keys = append(keys, event.IdempotencyKey)
+	}
+	if len(keys) != 2 || keys[0] != "user-1-v1" || keys[1] != "user-1-v2" {
+		t.Fatalf("expected 2 event lines; got %v", keys)
+	}
+}
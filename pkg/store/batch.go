@@ -0,0 +1,168 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"strings"
+)
+
+const (
+	// DefaultBatchSize is the default number of users inserted or exported per
+	// statement
+	DefaultBatchSize = 500
+
+	createUsersQueryPrefix = "INSERT INTO Users (name, created_by, created_at, updated_at) VALUES "
+	exportUsersQuery       = "SELECT " + userColumns + " FROM Users WHERE id > ? AND deleted_at IS NULL ORDER BY id LIMIT ?"
+)
+
+// WithBatchSize sets the number of users inserted per statement by
+// CreateUsers and read per query by ExportUsers.
+func WithBatchSize(size int) Option {
+	return func(s *Store) {
+		if size > 0 {
+			s.batchSize = size
+		}
+	}
+}
+
+// CreateResult is the outcome of creating one of the users passed to
+// CreateUsers: the created user with its assigned ID, or the error creating it.
+type CreateResult struct {
+	User User
+	Err  error
+}
+
+// CreateUsers creates the users, attributed to the caller in ctx, with one
+// multi-row INSERT per batch, committed along with their events. Batches are
+// created independently, each within the CreateUsers timeout: the result for
+// each user, in order, tells whether it was created. When a batch fails, its
+// users are retried one by one so that the error is reported for the
+// offending users only.
+func (s *Store) CreateUsers(ctx context.Context, users []User) []CreateResult {
+	results := make([]CreateResult, 0, len(users))
+	for start := 0; start < len(users); start += s.batchSize {
+		end := min(start+s.batchSize, len(users))
+		results = append(results, s.createBatch(ctx, users[start:end])...)
+	}
+	return results
+}
+
+func (s *Store) createBatch(ctx context.Context, users []User) []CreateResult {
+	results := make([]CreateResult, len(users))
+	err := s.guard(ctx, MethodCreateUsers, func(ctx context.Context) error {
+		return s.withTx(ctx, func(tx *Tx) error {
+			created, err := createUsers(ctx, tx, users)
+			if err != nil {
+				return err
+			}
+			for i := range created {
+				results[i].User = created[i]
+			}
+			return nil
+		})
+	})
+	// Users aren't retried one by one when MySQL is unavailable, slow or
+	// refused the connection, which would fail or time out the same way
+	if err == nil || len(users) == 1 || ctx.Err() != nil || errors.Is(err, ErrCircuitOpen) || errors.Is(err, ErrOverloaded) || errors.Is(err, ErrTimeout) || isConnectionError(err) {
+		for i := range results {
+			results[i].Err = err
+		}
+		return results
+	}
+
+	log.Printf("Failed to create batch of %d users, creating them one by one: %v", len(users), err)
+	for i, user := range users {
+		results[i].User, results[i].Err = s.CreateUser(ctx, user)
+	}
+	return results
+}
+
+func createUsers(ctx context.Context, t *Tx, users []User) ([]User, error) {
+	caller := callerFrom(ctx)
+	createdBy := sql.NullString{String: caller, Valid: caller != ""}
+	createdAt := now()
+
+	var query strings.Builder
+	query.WriteString(createUsersQueryPrefix)
+	args := make([]any, 0, 4*len(users))
+	for i, user := range users {
+		if i > 0 {
+			query.WriteString(", ")
+		}
+		query.WriteString("(?, ?, ?, ?)")
+		args = append(args, user.Name, createdBy, createdAt, createdAt)
+	}
+
+	result, err := t.tx.ExecContext(ctx, annotate(ctx, query.String()), args...)
+	if err != nil {
+		log.Printf("Failed to run create users query: %v", err)
+		return nil, err
+	}
+	// A multi-row INSERT with a known number of rows is allocated consecutive
+	// IDs, starting with the one returned as the last insert ID
+	firstID, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	created := make([]User, len(users))
+	for i, user := range users {
+		created[i] = User{ID: int(firstID) + i, Name: user.Name, CreatedBy: caller, Version: 1, CreatedAt: createdAt, UpdatedAt: createdAt}
+	}
+	if err := t.insertEvents(ctx, EventUserCreated, created...); err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+// ExportUsers calls fn with every user that wasn't deleted, in ID order, until
+// fn returns an error. Users are read from the replicas, like ListUsers, one
+// batch per query within the ExportUsers timeout, so that no query stays open
+// while fn is slow.
+func (s *Store) ExportUsers(ctx context.Context, fn func(User) error) error {
+	afterID := 0
+	for {
+		var users []User
+		err := s.guard(ctx, MethodExportUsers, func(ctx context.Context) error {
+			return s.read(ctx, func(db *sql.DB) (err error) {
+				users, err = exportUsers(ctx, db, afterID, s.batchSize)
+				return err
+			})
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, user := range users {
+			if err := fn(user); err != nil {
+				return err
+			}
+		}
+		if len(users) < s.batchSize {
+			return nil
+		}
+		afterID = users[len(users)-1].ID
+	}
+}
+
+func exportUsers(ctx context.Context, q querier, afterID, limit int) ([]User, error) {
+	rows, err := q.QueryContext(ctx, annotate(ctx, exportUsersQuery), afterID, limit)
+	if err != nil {
+		log.Printf("Failed to run export users query: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			log.Printf("Failed to scan user: %v", err)
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
@@ -0,0 +1,84 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestCreateUsers(t *testing.T) {
+	errTooLong := errors.New("Data too long for column 'name'")
+
+	primary := newFakeServer("primary")
+	s := New(primary.open(t), WithBatchSize(2))
+
+	// The second batch fails, then only its second user fails on its own;
+	// each user or batch is inserted along with its events
+	primary.failExecs(nil, nil, errTooLong, nil, nil, errTooLong)
+	results := s.CreateUsers(WithCaller(context.Background(), "spiffe://example.org/importer"), []User{
+		{Name: "Alice"}, {Name: "Bob"}, {Name: "Carol"}, {Name: "Mallory is far too long"}, {Name: "Erin"},
+	})
+
+	var errs []error
+	for _, result := range results {
+		errs = append(errs, result.Err)
+	}
+	if expect := []error{nil, nil, nil, errTooLong, nil}; !reflect.DeepEqual(errs, expect) {
+		t.Fatalf("expected errors %v; got %v", expect, errs)
+	}
+	if user := results[1].User; user.ID != 2 || user.Name != "Bob" || user.CreatedBy != "spiffe://example.org/importer" || user.Version != 1 || user.CreatedAt.IsZero() {
+		t.Fatalf("expected user 2 Bob created by the importer at version 1; got %+v", user)
+	}
+
+	// 2 users of 4 arguments, and their events of 5, per batch, a failed
+	// batch retried one user at a time, then the last partial batch
+	if expect := []int{8, 10, 8, 4, 5, 4, 4, 5}; !reflect.DeepEqual(primary.execArgs, expect) {
+		t.Fatalf("expected statements with %v arguments; got %v", expect, primary.execArgs)
+	}
+}
+
+func TestExportUsers(t *testing.T) {
+	for _, users := range []int{0, 3, 4, 5} {
+		primary := newFakeServer("primary")
+		primary.exportUsers = users
+		s := New(primary.open(t), WithBatchSize(2))
+
+		var ids []int
+		err := s.ExportUsers(context.Background(), func(user User) error {
+			ids = append(ids, user.ID)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("failed to export users: %v", err)
+		}
+		if len(ids) != users {
+			t.Fatalf("expected %d users to be exported; got %v", users, ids)
+		}
+		for i, id := range ids {
+			if id != i+1 {
+				t.Fatalf("expected users to be exported in ID order; got %v", ids)
+			}
+		}
+		// Users are read 2 at a time, until a partial page
+		if expect := users/2 + 1; primary.reads() != expect {
+			t.Fatalf("expected %d queries to export %d users; got %d", expect, users, primary.reads())
+		}
+	}
+}
+
+func TestExportUsersStopsOnError(t *testing.T) {
+	errStop := errors.New("client went away")
+	primary := newFakeServer("primary")
+	primary.exportUsers = 5
+	s := New(primary.open(t), WithBatchSize(2))
+
+	var exported int
+	err := s.ExportUsers(context.Background(), func(User) error {
+		exported++
+		return errStop
+	})
+	if !errors.Is(err, errStop) || exported != 1 {
+		t.Fatalf("expected export to stop after the first error; got %d users and %v", exported, err)
+	}
+}
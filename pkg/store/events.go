@@ -0,0 +1,167 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+const (
+	insertEventsQueryPrefix = "INSERT INTO UserEvents (type, user_id, version, payload, created_at) VALUES "
+	pendingEventsQuery      = "SELECT id, type, user_id, version, payload, created_at FROM UserEvents ORDER BY id LIMIT ?"
+	ackEventsQueryPrefix    = "DELETE FROM UserEvents WHERE id IN "
+)
+
+// EventType is the kind of change an Event records.
+type EventType string
+
+const (
+	EventUserCreated EventType = "user.created"
+	EventUserUpdated EventType = "user.updated"
+	EventUserDeleted EventType = "user.deleted"
+)
+
+// Event records a change to a user. Events are written to the UserEvents
+// outbox table in the same transaction as the change, and stay there until
+// they're acknowledged with AckEvents once published. They're also passed to
+// the hook set with WithEventHook as soon as the change is committed.
+type Event struct {
+	// ID orders the events in the outbox. Events of a user are ordered by
+	// its version, but events of concurrent transactions may be committed
+	// out of ID order.
+	ID int64 `json:"id"`
+	// IdempotencyKey is unique to the change, and the same for every
+	// delivery of the event, so that consumers can drop duplicates
+	IdempotencyKey string    `json:"idempotency_key"`
+	Type           EventType `json:"type"`
+	// User is the user as of the change
+	User User      `json:"user"`
+	Time time.Time `json:"time"`
+}
+
+// WithEventHook sets a function called with the events of each committed
+// transaction, in the order they were written, e.g. to stream changes to
+// watchers without waiting for the outbox to be polled. It's called by the
+// goroutine that committed, so it must not block, and concurrent transactions
+// may call it out of commit order. It only sees the transactions of this Store.
+func WithEventHook(hook func([]Event)) Option {
+	return func(s *Store) {
+		s.eventHook = hook
+	}
+}
+
+// idempotencyKey returns the key of the change that made the user version.
+func idempotencyKey(userID int, version int64) string {
+	return fmt.Sprintf("user-%d-v%d", userID, version)
+}
+
+// insertEvents writes an event of the type for each of the users, as of their
+// change, and records them to be passed to the event hook once committed.
+func (t *Tx) insertEvents(ctx context.Context, eventType EventType, users ...User) error {
+	createdAt := now()
+
+	var query strings.Builder
+	query.WriteString(insertEventsQueryPrefix)
+	args := make([]any, 0, 5*len(users))
+	for i, user := range users {
+		payload, err := json.Marshal(user)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			query.WriteString(", ")
+		}
+		query.WriteString("(?, ?, ?, ?, ?)")
+		args = append(args, string(eventType), user.ID, user.Version, payload, createdAt)
+	}
+
+	result, err := t.tx.ExecContext(ctx, annotate(ctx, query.String()), args...)
+	if err != nil {
+		log.Printf("Failed to run insert events query: %v", err)
+		return err
+	}
+	// Like users created in bulk, the events are allocated consecutive IDs
+	firstID, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	for i, user := range users {
+		t.events = append(t.events, Event{
+			ID:             firstID + int64(i),
+			IdempotencyKey: idempotencyKey(user.ID, user.Version),
+			Type:           eventType,
+			User:           user,
+			Time:           createdAt,
+		})
+	}
+	return nil
+}
+
+// PendingEvents returns up to limit events that weren't acknowledged yet, in
+// ID order. They're read from the primary, which the events were committed to.
+func (s *Store) PendingEvents(ctx context.Context, limit int) ([]Event, error) {
+	var events []Event
+	err := s.guard(ctx, MethodPendingEvents, func(ctx context.Context) error {
+		return s.read(WithReadYourWrites(ctx), func(db *sql.DB) error {
+			rows, err := db.QueryContext(ctx, annotate(ctx, pendingEventsQuery), limit)
+			if err != nil {
+				log.Printf("Failed to run pending events query: %v", err)
+				return err
+			}
+			defer rows.Close()
+
+			events = nil
+			for rows.Next() {
+				event, err := scanEvent(rows)
+				if err != nil {
+					log.Printf("Failed to scan event: %v", err)
+					return err
+				}
+				events = append(events, event)
+			}
+			return rows.Err()
+		})
+	})
+	return events, err
+}
+
+func scanEvent(row scanner) (Event, error) {
+	var event Event
+	var userID int
+	var version int64
+	var payload []byte
+	if err := row.Scan(&event.ID, &event.Type, &userID, &version, &payload, &event.Time); err != nil {
+		return Event{}, err
+	}
+	if err := json.Unmarshal(payload, &event.User); err != nil {
+		return Event{}, fmt.Errorf("malformed payload of event %d: %w", event.ID, err)
+	}
+	event.IdempotencyKey = idempotencyKey(userID, version)
+	return event, nil
+}
+
+// AckEvents removes the events with the IDs from the outbox once they were
+// published.
+func (s *Store) AckEvents(ctx context.Context, ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	query := ackEventsQueryPrefix + "(" + strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", ") + ")"
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	return s.guard(ctx, MethodAckEvents, func(ctx context.Context) error {
+		return s.write(func(db *sql.DB) error {
+			if _, err := db.ExecContext(ctx, annotate(ctx, query), args...); err != nil {
+				log.Printf("Failed to run ack events query: %v", err)
+				return err
+			}
+			return nil
+		})
+	})
+}
@@ -0,0 +1,110 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestStoreWritesEvents(t *testing.T) {
+	errFailed := errors.New("failed")
+	primary := newFakeServer("primary")
+	s := New(primary.open(t))
+	ctx := context.Background()
+
+	if _, err := s.CreateUser(ctx, User{Name: "David"}); err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	if _, err := s.UpdateUser(ctx, User{ID: 1, Name: "Dave"}); err != nil {
+		t.Fatalf("failed to update user: %v", err)
+	}
+	// Each change is committed with its event
+	if expect := []int{4, 5, 3, 5}; !reflect.DeepEqual(primary.execArgs, expect) {
+		t.Fatalf("expected statements with %v arguments; got %v", expect, primary.execArgs)
+	}
+	if commits, rollbacks := primary.txs(); commits != 2 || rollbacks != 0 {
+		t.Fatalf("expected 2 commits; got %d commits and %d rollbacks", commits, rollbacks)
+	}
+
+	// A change whose event can't be written is rolled back
+	primary.failExecs(nil, errFailed)
+	if _, err := s.CreateUser(ctx, User{Name: "Erin"}); !errors.Is(err, errFailed) {
+		t.Fatalf("expected %v; got %v", errFailed, err)
+	}
+	if commits, rollbacks := primary.txs(); commits != 2 || rollbacks != 1 {
+		t.Fatalf("expected the change to be rolled back; got %d commits and %d rollbacks", commits, rollbacks)
+	}
+}
+
+func TestPendingEvents(t *testing.T) {
+	primary, replica := newFakeServer("primary"), newFakeServer("replica")
+	s := New(primary.open(t), WithReplicas(replica.replica(t)))
+	ctx := context.Background()
+
+	events, err := s.PendingEvents(ctx, 10)
+	if err != nil {
+		t.Fatalf("failed to get pending events: %v", err)
+	}
+	if replica.reads() != 0 {
+		t.Fatal("expected pending events to be read from the primary")
+	}
+	if len(events) != 1 {
+		t.Fatalf("expected 1 event; got %+v", events)
+	}
+	event := events[0]
+	if event.ID != 7 || event.Type != EventUserCreated || event.IdempotencyKey != "user-1-v1" || event.User.Name != "David" {
+		t.Fatalf("unexpected event %+v", event)
+	}
+
+	if err := s.AckEvents(ctx, []int64{7, 8}); err != nil {
+		t.Fatalf("failed to ack events: %v", err)
+	}
+	if err := s.AckEvents(ctx, nil); err != nil {
+		t.Fatalf("failed to ack no events: %v", err)
+	}
+	if expect := []int{2}; !reflect.DeepEqual(primary.execArgs, expect) {
+		t.Fatalf("expected statements with %v arguments; got %v", expect, primary.execArgs)
+	}
+}
+
+func TestEventHook(t *testing.T) {
+	errFailed := errors.New("failed")
+	primary := newFakeServer("primary")
+	var committed []Event
+	s := New(primary.open(t), WithEventHook(func(events []Event) {
+		committed = append(committed, events...)
+	}))
+	ctx := context.Background()
+
+	// Only the events of committed transactions are passed to the hook
+	err := s.WithTx(ctx, func(tx *Tx) error {
+		if _, err := tx.CreateUser(ctx, User{Name: "David"}); err != nil {
+			return err
+		}
+		return errFailed
+	})
+	if !errors.Is(err, errFailed) {
+		t.Fatalf("expected %v; got %v", errFailed, err)
+	}
+	if len(committed) != 0 {
+		t.Fatalf("expected no events for a rolled back transaction; got %+v", committed)
+	}
+
+	if _, err := s.UpdateUser(ctx, User{ID: 1, Name: "Dave"}); err != nil {
+		t.Fatalf("failed to update user: %v", err)
+	}
+	if err := s.DeleteUser(ctx, 1, 0); err != nil {
+		t.Fatalf("failed to delete user: %v", err)
+	}
+	var types []EventType
+	for _, event := range committed {
+		types = append(types, event.Type)
+	}
+	if expect := []EventType{EventUserUpdated, EventUserDeleted}; !reflect.DeepEqual(types, expect) {
+		t.Fatalf("expected events %v; got %v", expect, types)
+	}
+	if key := committed[0].IdempotencyKey; key != "user-1-v1" {
+		t.Fatalf("expected the key of the user version; got %q", key)
+	}
+}
@@ -0,0 +1,302 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rturner3/spire-mysql-demo/pkg/common"
+)
+
+const (
+	// DefaultBreakerThreshold is the number of consecutive connection
+	// failures that open the circuit breaker by default
+	DefaultBreakerThreshold = 5
+	// DefaultBreakerCooldown is how long the circuit breaker stays open by
+	// default before letting an operation probe MySQL again
+	DefaultBreakerCooldown = 5 * time.Second
+)
+
+var (
+	// ErrCircuitOpen is returned without reaching MySQL while the circuit
+	// breaker is open after consecutive connection failures.
+	ErrCircuitOpen = errors.New("MySQL is unavailable")
+
+	// ErrOverloaded is returned without reaching MySQL when the maximum
+	// number of operations are already in flight.
+	ErrOverloaded = errors.New("too many store operations in flight")
+
+	// ErrTimeout is returned when an operation exceeds its method's timeout.
+	ErrTimeout = errors.New("store operation timed out")
+)
+
+// Method names a store operation, to set its timeout.
+type Method string
+
+const (
+	MethodListUsers     Method = "ListUsers"
+	MethodGetUser       Method = "GetUser"
+	MethodCreateUser    Method = "CreateUser"
+	MethodUpdateUser    Method = "UpdateUser"
+	MethodDeleteUser    Method = "DeleteUser"
+	MethodWithTx        Method = "WithTx"
+	MethodPendingEvents Method = "PendingEvents"
+	MethodAckEvents     Method = "AckEvents"
+	// MethodCreateUsers and MethodExportUsers bound each batch rather than
+	// the whole operation, whose length depends on the number of users
+	MethodCreateUsers Method = "CreateUsers"
+	MethodExportUsers Method = "ExportUsers"
+)
+
+// DefaultTimeouts returns the timeout of each method by default. They bound
+// operations on the server side when the caller's context has no shorter
+// deadline, e.g. while MySQL doesn't respond.
+func DefaultTimeouts() map[Method]time.Duration {
+	return map[Method]time.Duration{
+		MethodListUsers:     10 * time.Second,
+		MethodGetUser:       5 * time.Second,
+		MethodCreateUser:    5 * time.Second,
+		MethodUpdateUser:    5 * time.Second,
+		MethodDeleteUser:    5 * time.Second,
+		MethodWithTx:        10 * time.Second,
+		MethodPendingEvents: 5 * time.Second,
+		MethodAckEvents:     5 * time.Second,
+		MethodCreateUsers:   30 * time.Second,
+		MethodExportUsers:   30 * time.Second,
+	}
+}
+
+// WithTimeout sets the timeout of the method's operations, or removes it if
+// timeout is 0.
+func WithTimeout(method Method, timeout time.Duration) Option {
+	return func(s *Store) {
+		s.timeouts[method] = timeout
+	}
+}
+
+// WithCircuitBreaker sets the number of consecutive connection or TLS
+// handshake failures that open the circuit breaker, and how long it then
+// fails operations fast with ErrCircuitOpen before letting one probe MySQL
+// again. A threshold of 0 disables the circuit breaker.
+func WithCircuitBreaker(threshold int, cooldown time.Duration) Option {
+	return func(s *Store) {
+		s.breaker.threshold = threshold
+		s.breaker.cooldown = cooldown
+	}
+}
+
+// WithMaxInFlight sets the number of operations that may be in flight at
+// once, beyond which operations fail with ErrOverloaded instead of queuing
+// for MySQL connections. 0, the default, doesn't limit them.
+func WithMaxInFlight(n int) Option {
+	return func(s *Store) {
+		s.maxInFlight = int64(n)
+	}
+}
+
+// guard runs op as an operation of the method. It fails fast while the
+// circuit breaker is open or the maximum number of operations are in flight,
+// and bounds the context passed to op with the method's timeout. Failures to
+// connect to MySQL are returned as a *common.ConnError.
+func (s *Store) guard(ctx context.Context, method Method, op func(ctx context.Context) error) error {
+	if inFlight := s.inFlight.Add(1); s.maxInFlight > 0 && inFlight > s.maxInFlight {
+		s.inFlight.Add(-1)
+		s.guardStats.shed.Add(1)
+		return ErrOverloaded
+	}
+	defer s.inFlight.Add(-1)
+
+	trial, ok := s.breaker.allow()
+	if !ok {
+		s.guardStats.rejected.Add(1)
+		return ErrCircuitOpen
+	}
+
+	opCtx := ctx
+	timeout := s.timeouts[method]
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		opCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	err := common.ClassifyConnError(op(opCtx))
+	s.breaker.record(trial, err, opCtx.Err() != nil)
+
+	// The error may not be the context's, e.g. sql.ErrTxDone once the
+	// transaction was rolled back
+	if err != nil && ctx.Err() == nil && errors.Is(opCtx.Err(), context.DeadlineExceeded) {
+		s.guardStats.timeouts.Add(1)
+		return fmt.Errorf("%w: %s exceeded %s: %w", ErrTimeout, method, timeout, err)
+	}
+	return err
+}
+
+// isConnectionError reports whether err means MySQL couldn't be reached or
+// refused the connection, rather than failing a query.
+func isConnectionError(err error) bool {
+	var connErr *common.ConnError
+	return errors.As(err, &connErr)
+}
+
+// CircuitState is the state of the circuit breaker.
+type CircuitState string
+
+const (
+	// CircuitClosed lets operations through
+	CircuitClosed CircuitState = "closed"
+	// CircuitOpen fails operations fast after consecutive connection
+	// failures
+	CircuitOpen CircuitState = "open"
+	// CircuitHalfOpen lets a single operation through to probe MySQL once
+	// the cooldown elapsed: it closes the circuit if it reaches MySQL, and
+	// opens it again otherwise
+	CircuitHalfOpen CircuitState = "half-open"
+)
+
+// breaker is a circuit breaker opened by consecutive connection failures.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	failures int
+	open     bool
+	openedAt time.Time
+	// probing is set while the operation probing a half-open circuit is in
+	// flight
+	probing bool
+	opens   uint64
+}
+
+// allow reports whether an operation may run, and whether it's the trial
+// probing a half-open circuit.
+func (b *breaker) allow() (trial, ok bool) {
+	if b.threshold <= 0 {
+		return false, true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case !b.open:
+		return false, true
+	case b.probing || time.Since(b.openedAt) < b.cooldown:
+		return false, false
+	default:
+		b.probing = true
+		return true, true
+	}
+}
+
+// record updates the circuit with the outcome of an operation it allowed.
+// Operations that failed once their context was done don't tell whether MySQL
+// is reachable, unless they failed to connect, and leave it as is; a trial that
+// did so opens the circuit for another cooldown.
+func (b *breaker) record(trial bool, err error, interrupted bool) {
+	if b.threshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if trial {
+		b.probing = false
+	}
+	switch {
+	case isConnectionError(err):
+		b.failures++
+		if trial || (!b.open && b.failures >= b.threshold) {
+			if !b.open {
+				log.Printf("Opening the MySQL circuit breaker after %d consecutive connection failures: %v", b.failures, err)
+				b.opens++
+			}
+			b.open = true
+			b.openedAt = time.Now()
+		}
+	case err != nil && interrupted:
+		if trial {
+			b.openedAt = time.Now()
+		}
+	default:
+		b.closeLocked()
+	}
+}
+
+// reset closes the circuit, e.g. once new DBs responded to a ping.
+func (b *breaker) reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closeLocked()
+}
+
+func (b *breaker) closeLocked() {
+	if b.open {
+		log.Printf("Closing the MySQL circuit breaker")
+	}
+	b.failures = 0
+	b.open = false
+}
+
+func (b *breaker) state() (CircuitState, int, uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case !b.open:
+		return CircuitClosed, b.failures, b.opens
+	case b.probing || time.Since(b.openedAt) >= b.cooldown:
+		return CircuitHalfOpen, b.failures, b.opens
+	default:
+		return CircuitOpen, b.failures, b.opens
+	}
+}
+
+// Health describes the circuit breaker and the load of the store.
+type Health struct {
+	Circuit CircuitState `json:"circuit"`
+	// ConsecutiveFailures is the number of connection failures since an
+	// operation last reached MySQL
+	ConsecutiveFailures int `json:"consecutive_failures"`
+	// CircuitOpens is the number of times the circuit breaker opened
+	CircuitOpens uint64 `json:"circuit_opens"`
+	// Rejected is the number of operations failed fast by the open circuit
+	// breaker
+	Rejected uint64 `json:"rejected"`
+
+	InFlight    int64 `json:"in_flight"`
+	MaxInFlight int64 `json:"max_in_flight,omitempty"`
+	// Shed is the number of operations failed fast because the maximum
+	// number of operations were in flight
+	Shed uint64 `json:"shed"`
+	// Timeouts is the number of operations that exceeded their method's
+	// timeout
+	Timeouts uint64 `json:"timeouts"`
+}
+
+// Healthy reports whether the store lets operations through to MySQL, i.e.
+// the circuit breaker isn't open.
+func (h Health) Healthy() bool {
+	return h.Circuit != CircuitOpen
+}
+
+type guardStats struct {
+	rejected atomic.Uint64
+	shed     atomic.Uint64
+	timeouts atomic.Uint64
+}
+
+// Health returns the state of the circuit breaker and the load of the store.
+func (s *Store) Health() Health {
+	circuit, failures, opens := s.breaker.state()
+	return Health{
+		Circuit:             circuit,
+		ConsecutiveFailures: failures,
+		CircuitOpens:        opens,
+		Rejected:            s.guardStats.rejected.Load(),
+		InFlight:            s.inFlight.Load(),
+		MaxInFlight:         s.maxInFlight,
+		Shed:                s.guardStats.shed.Load(),
+		Timeouts:            s.guardStats.timeouts.Load(),
+	}
+}
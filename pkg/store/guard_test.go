@@ -0,0 +1,150 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+
+	"github.com/rturner3/spire-mysql-demo/pkg/common"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	primary := newFakeServer("primary")
+	s := New(primary.open(t), WithCircuitBreaker(2, 20*time.Millisecond))
+	ctx := context.Background()
+
+	// Query errors don't open the circuit, consecutive connection failures do
+	primary.failExecs(errors.New("duplicate entry"))
+	if _, err := s.CreateUser(ctx, User{Name: "David"}); err == nil {
+		t.Fatal("expected the create to fail")
+	}
+	primary.setDown(true)
+	for i := 0; i < 2; i++ {
+		if _, err := s.ListUsers(ctx); !errors.Is(err, common.ErrNetwork) {
+			t.Fatalf("expected the list to reach the server and fail with %v; got %v", common.ErrNetwork, err)
+		}
+	}
+	reads := primary.reads()
+	if _, err := s.ListUsers(ctx); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected %v; got %v", ErrCircuitOpen, err)
+	}
+	if primary.reads() != reads {
+		t.Fatal("expected the open circuit to fail fast without reaching the server")
+	}
+	if health := s.Health(); health.Circuit != CircuitOpen || health.Healthy() || health.CircuitOpens != 1 || health.Rejected != 1 {
+		t.Fatalf("expected an unhealthy open circuit; got %+v", health)
+	}
+
+	// Once the cooldown elapsed, a failed probe opens the circuit again, and
+	// a successful one closes it
+	waitFor(t, func() bool { return s.Health().Circuit == CircuitHalfOpen })
+	if _, err := s.ListUsers(ctx); err == nil || errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected the probe to reach the server and fail; got %v", err)
+	}
+	if _, err := s.ListUsers(ctx); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected %v after a failed probe; got %v", ErrCircuitOpen, err)
+	}
+
+	// A probe interrupted by its context doesn't tell whether the server is
+	// reachable, and waits for another cooldown
+	waitFor(t, func() bool { return s.Health().Circuit == CircuitHalfOpen })
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := s.ListUsers(canceled); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the probe to fail with %v; got %v", context.Canceled, err)
+	}
+	if health := s.Health(); health.Circuit != CircuitOpen || health.CircuitOpens != 1 {
+		t.Fatalf("expected the interrupted probe to leave the circuit open; got %+v", health)
+	}
+	if _, err := s.ListUsers(ctx); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected %v after an interrupted probe; got %v", ErrCircuitOpen, err)
+	}
+	primary.setDown(false)
+	waitFor(t, func() bool { return s.Health().Circuit == CircuitHalfOpen })
+	if _, err := s.ListUsers(ctx); err != nil {
+		t.Fatalf("failed to list users: %v", err)
+	}
+	if health := s.Health(); health.Circuit != CircuitClosed || health.ConsecutiveFailures != 0 || health.CircuitOpens != 1 {
+		t.Fatalf("expected the probe to close the circuit; got %+v", health)
+	}
+}
+
+func TestCircuitBreakerResetByUpdateDB(t *testing.T) {
+	primary, rotated := newFakeServer("primary"), newFakeServer("rotated")
+	s := New(primary.open(t), WithCircuitBreaker(1, time.Hour))
+	ctx := context.Background()
+
+	// MySQL rejecting the SVID also opens the circuit
+	primary.failExecs(&mysql.MySQLError{Number: 1045, Message: "Access denied"})
+	if _, err := s.CreateUser(ctx, User{Name: "David"}); !errors.Is(err, common.ErrAccessDenied) {
+		t.Fatalf("expected %v; got %v", common.ErrAccessDenied, err)
+	}
+	if _, err := s.CreateUser(ctx, User{Name: "David"}); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected %v; got %v", ErrCircuitOpen, err)
+	}
+
+	if err := s.UpdateDB(rotated.open(t)); err != nil {
+		t.Fatalf("failed to update DB: %v", err)
+	}
+	if _, err := s.CreateUser(ctx, User{Name: "David"}); err != nil {
+		t.Fatalf("expected the new DB to close the circuit; got %v", err)
+	}
+}
+
+func TestMaxInFlight(t *testing.T) {
+	s := New(newFakeServer("primary").open(t), WithMaxInFlight(1))
+	ctx := context.Background()
+
+	started, release := make(chan struct{}), make(chan struct{})
+	txErr := make(chan error, 1)
+	go func() {
+		txErr <- s.WithTx(ctx, func(tx *Tx) error {
+			close(started)
+			<-release
+			return nil
+		})
+	}()
+	<-started
+
+	if _, err := s.ListUsers(ctx); !errors.Is(err, ErrOverloaded) {
+		t.Fatalf("expected %v; got %v", ErrOverloaded, err)
+	}
+	if health := s.Health(); health.InFlight != 1 || health.MaxInFlight != 1 || health.Shed != 1 {
+		t.Fatalf("expected 1 operation in flight and 1 shed; got %+v", health)
+	}
+
+	close(release)
+	if err := <-txErr; err != nil {
+		t.Fatalf("failed to run transaction: %v", err)
+	}
+	if _, err := s.ListUsers(ctx); err != nil {
+		t.Fatalf("failed to list users: %v", err)
+	}
+}
+
+func TestTimeouts(t *testing.T) {
+	s := New(newFakeServer("primary").open(t), WithTimeout(MethodWithTx, 10*time.Millisecond), WithTimeout(MethodListUsers, 0))
+
+	// The transaction is rolled back once its timeout elapsed
+	err := s.WithTx(context.Background(), func(tx *Tx) error {
+		time.Sleep(50 * time.Millisecond)
+		_, err := tx.CreateUser(context.Background(), User{Name: "David"})
+		return err
+	})
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("expected %v; got %v", ErrTimeout, err)
+	}
+	if health := s.Health(); health.Timeouts != 1 || health.Circuit != CircuitClosed {
+		t.Fatalf("expected 1 timeout without opening the circuit; got %+v", health)
+	}
+
+	// The caller's own deadline isn't reported as a store timeout
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := s.ListUsers(ctx); errors.Is(err, ErrTimeout) || !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected %v; got %v", context.Canceled, err)
+	}
+}
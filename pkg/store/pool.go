@@ -0,0 +1,262 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultPingTimeout = 10 * time.Second
+	// defaultDrainTimeout leaves room for the slowest queries, which are
+	// cancelled with their request long before
+	defaultDrainTimeout = time.Minute
+)
+
+// pools are the primary and replica DBs the store uses until they're replaced
+// by UpdateDB. Operations hold a reference to the pools they started with, so
+// that replaced DBs are only closed once the operations using them finished.
+type pools struct {
+	db       *sql.DB
+	replicas []*replica
+
+	mu      sync.Mutex
+	refs    int
+	retired bool
+	drained chan struct{}
+}
+
+func newPools(db *sql.DB, replicas []Replica) *pools {
+	return &pools{
+		db:       db,
+		replicas: newReplicas(replicas),
+		drained:  make(chan struct{}),
+	}
+}
+
+// acquire adds a reference to the pools, unless they were retired.
+func (p *pools) acquire() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.retired {
+		return false
+	}
+	p.refs++
+	return true
+}
+
+func (p *pools) release() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.refs--
+	if p.retired && p.refs == 0 {
+		close(p.drained)
+	}
+}
+
+// retire stops new operations from using the pools. drained is closed once
+// the operations already using them have released them.
+func (p *pools) retire() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.retired = true
+	if p.refs == 0 {
+		close(p.drained)
+	}
+}
+
+func (p *pools) checkReplicas(ctx context.Context, timeout time.Duration) {
+	for _, r := range p.replicas {
+		pingCtx, cancel := context.WithTimeout(ctx, timeout)
+		err := r.db.PingContext(pingCtx)
+		cancel()
+
+		healthy := err == nil
+		if r.healthy.Swap(healthy) != healthy {
+			if healthy {
+				log.Printf("MySQL %s is healthy again", r.name)
+			} else {
+				log.Printf("MySQL %s failed its health check: %v", r.name, err)
+			}
+		}
+	}
+}
+
+func (p *pools) close() error {
+	errs := []error{p.db.Close()}
+	for _, r := range p.replicas {
+		errs = append(errs, r.db.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// acquire returns the current pools with a reference added, which the caller
+// must release once done with them.
+func (s *Store) acquire() (*pools, error) {
+	for {
+		p := s.pools.Load()
+		if p.acquire() {
+			return p, nil
+		}
+		if s.closed.Load() {
+			return nil, ErrClosed
+		}
+		// p was retired by UpdateDB, which published the new pools first
+	}
+}
+
+// UpdateDB replaces the primary and replica DBs, e.g. with DBs using a rotated
+// SVID. The new primary must respond to a ping first; otherwise the new DBs
+// are closed and the current ones kept. Operations already in flight finish
+// on the previous DBs, which are closed in the background once they're done,
+// or after the drain timeout.
+func (s *Store) UpdateDB(db *sql.DB, replicas ...Replica) error {
+	s.swapMu.Lock()
+	defer s.swapMu.Unlock()
+
+	next := newPools(db, replicas)
+	if s.closed.Load() {
+		// The store was closed while the new DBs were being created
+		if err := next.close(); err != nil {
+			log.Printf("Failed to close new DB connection: %v", err)
+		}
+		return ErrClosed
+	}
+
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), s.pingTimeout)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		s.stats.failedSwaps.Add(1)
+		if closeErr := next.close(); closeErr != nil {
+			log.Printf("Failed to close new DB connection: %v", closeErr)
+		}
+		return fmt.Errorf("new primary DB failed its ping: %w", err)
+	}
+	// Only read from the new replicas that respond
+	next.checkReplicas(ctx, s.pingTimeout)
+
+	prev := s.pools.Swap(next)
+	s.retire(prev)
+	// The new primary responded, so stop failing operations fast
+	s.breaker.reset()
+	s.stats.swaps.Add(1)
+	s.stats.lastSwapDuration.Store(int64(time.Since(start)))
+
+	s.drains.Add(1)
+	go func() {
+		defer s.drains.Done()
+		if err := s.drain(s.drainCtx, prev); err != nil {
+			log.Printf("Failed to close existing DB connection: %v", err)
+		}
+	}()
+	return nil
+}
+
+// retire stops new operations from using the pools, which are then draining
+// until closed by drain.
+func (s *Store) retire(p *pools) {
+	p.retire()
+	s.stats.draining.Add(1)
+}
+
+// drain closes the retired pools once their operations finished, after the
+// drain timeout, or once ctx is done.
+func (s *Store) drain(ctx context.Context, p *pools) error {
+	defer s.stats.draining.Add(-1)
+
+	start := time.Now()
+	timer := time.NewTimer(s.drainTimeout)
+	defer timer.Stop()
+	select {
+	case <-p.drained:
+	case <-timer.C:
+		s.stats.drainTimeouts.Add(1)
+		log.Printf("Closing DB connections with operations still in flight after %s", s.drainTimeout)
+	case <-ctx.Done():
+		s.stats.drainTimeouts.Add(1)
+		log.Printf("Closing DB connections with operations still in flight on shutdown")
+	}
+
+	err := p.close()
+	s.stats.drains.Add(1)
+	s.stats.lastDrainDuration.Store(int64(time.Since(start)))
+	return err
+}
+
+// Shutdown stops new operations, then closes the current DBs once the
+// operations in flight finished, after the drain timeout, or once ctx is done.
+// It also waits for the DBs replaced by UpdateDB to be closed, within the same
+// bounds. DBs passed to UpdateDB afterwards are closed instead of being used.
+func (s *Store) Shutdown(ctx context.Context) error {
+	s.swapMu.Lock()
+	if s.closed.Swap(true) {
+		s.swapMu.Unlock()
+		return nil
+	}
+	p := s.pools.Load()
+	s.retire(p)
+	// UpdateDB doesn't start draining DBs once closed, so drains is complete
+	s.swapMu.Unlock()
+
+	stop := context.AfterFunc(ctx, s.stopDrains)
+	defer stop()
+	err := s.drain(ctx, p)
+	s.drains.Wait()
+	return err
+}
+
+// Close is Shutdown without a deadline other than the drain timeout.
+func (s *Store) Close() error {
+	return s.Shutdown(context.Background())
+}
+
+// SwapStats describes the DB swaps made by UpdateDB.
+type SwapStats struct {
+	// Swaps is the number of times new DBs replaced the current ones
+	Swaps uint64 `json:"swaps"`
+	// FailedSwaps is the number of times new DBs were rejected because the
+	// primary didn't respond to a ping
+	FailedSwaps uint64 `json:"failed_swaps"`
+	// LastSwapDuration is how long the last swap took, including the pings
+	LastSwapDuration time.Duration `json:"last_swap_duration_ns"`
+
+	// Draining is the number of replaced sets of DBs waiting for their
+	// operations to finish
+	Draining int64 `json:"draining"`
+	// Drains is the number of replaced sets of DBs closed
+	Drains uint64 `json:"drains"`
+	// DrainTimeouts is the number of replaced sets of DBs closed with
+	// operations still in flight after the drain timeout, or on shutdown
+	DrainTimeouts uint64 `json:"drain_timeouts"`
+	// LastDrainDuration is how long the last replaced DBs took to drain
+	LastDrainDuration time.Duration `json:"last_drain_duration_ns"`
+}
+
+type swapStats struct {
+	swaps             atomic.Uint64
+	failedSwaps       atomic.Uint64
+	lastSwapDuration  atomic.Int64
+	draining          atomic.Int64
+	drains            atomic.Uint64
+	drainTimeouts     atomic.Uint64
+	lastDrainDuration atomic.Int64
+}
+
+// SwapStats returns the statistics of the DB swaps made so far.
+func (s *Store) SwapStats() SwapStats {
+	return SwapStats{
+		Swaps:             s.stats.swaps.Load(),
+		FailedSwaps:       s.stats.failedSwaps.Load(),
+		LastSwapDuration:  time.Duration(s.stats.lastSwapDuration.Load()),
+		Draining:          s.stats.draining.Load(),
+		Drains:            s.stats.drains.Load(),
+		DrainTimeouts:     s.stats.drainTimeouts.Load(),
+		LastDrainDuration: time.Duration(s.stats.lastDrainDuration.Load()),
+	}
+}
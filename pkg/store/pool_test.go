@@ -0,0 +1,257 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUpdateDBRejectsUnresponsiveDB(t *testing.T) {
+	primary, rotated := newFakeServer("primary"), newFakeServer("rotated")
+	s := New(primary.open(t))
+
+	rotated.setDown(true)
+	if err := s.UpdateDB(rotated.open(t)); err == nil {
+		t.Fatal("expected an unresponsive DB to be rejected")
+	}
+	if !rotated.isClosed() {
+		t.Fatal("expected the rejected DB to be closed")
+	}
+	if primary.isClosed() {
+		t.Fatal("expected the current DB to be kept")
+	}
+
+	if _, err := s.ListUsers(context.Background()); err != nil {
+		t.Fatalf("failed to list users: %v", err)
+	}
+	if primary.reads() != 1 {
+		t.Fatal("expected the current DB to still be used")
+	}
+	if stats := s.SwapStats(); stats.Swaps != 0 || stats.FailedSwaps != 1 {
+		t.Fatalf("expected 1 failed swap; got %+v", stats)
+	}
+}
+
+func TestUpdateDBDrainsInFlightOperations(t *testing.T) {
+	primary, rotated := newFakeServer("primary"), newFakeServer("rotated")
+	s := New(primary.open(t))
+
+	started, release := make(chan struct{}), make(chan struct{})
+	txErr := make(chan error, 1)
+	go func() {
+		txErr <- s.WithTx(context.Background(), func(tx *Tx) error {
+			close(started)
+			<-release
+			_, err := tx.CreateUser(context.Background(), User{Name: "David"})
+			return err
+		})
+	}()
+	<-started
+
+	// The swap doesn't wait for the operations in flight, and new operations
+	// use the new DB right away
+	if err := s.UpdateDB(rotated.open(t)); err != nil {
+		t.Fatalf("failed to update DB: %v", err)
+	}
+	if _, err := s.ListUsers(context.Background()); err != nil {
+		t.Fatalf("failed to list users: %v", err)
+	}
+	if rotated.reads() != 1 || primary.reads() != 0 {
+		t.Fatal("expected new operations to use the new DB")
+	}
+	if primary.isClosed() {
+		t.Fatal("expected the previous DB to stay open for the operation in flight")
+	}
+	if stats := s.SwapStats(); stats.Swaps != 1 || stats.Draining != 1 {
+		t.Fatalf("expected 1 swap with the previous DB draining; got %+v", stats)
+	}
+
+	close(release)
+	if err := <-txErr; err != nil {
+		t.Fatalf("transaction failed: %v", err)
+	}
+	waitFor(t, func() bool { return s.SwapStats().Drains == 1 })
+	if !primary.isClosed() {
+		t.Fatal("expected the previous DB to be closed once drained")
+	}
+	if stats := s.SwapStats(); stats.DrainTimeouts != 0 || stats.Draining != 0 {
+		t.Fatalf("expected the previous DB to drain without timing out; got %+v", stats)
+	}
+}
+
+func TestUpdateDBDrainTimeout(t *testing.T) {
+	primary := newFakeServer("primary")
+	s := New(primary.open(t), WithDrainTimeout(10*time.Millisecond))
+
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{})
+	go s.WithTx(context.Background(), func(*Tx) error {
+		close(started)
+		<-release
+		return nil
+	})
+	<-started
+
+	if err := s.UpdateDB(newFakeServer("rotated").open(t)); err != nil {
+		t.Fatalf("failed to update DB: %v", err)
+	}
+	waitFor(t, func() bool { return s.SwapStats().Drains == 1 })
+	if !primary.isClosed() {
+		t.Fatal("expected the previous DB to be closed after the drain timeout")
+	}
+	if stats := s.SwapStats(); stats.DrainTimeouts != 1 {
+		t.Fatalf("expected 1 drain timeout; got %+v", stats)
+	}
+}
+
+func TestStoreShutdownDeadline(t *testing.T) {
+	primary, rotated := newFakeServer("primary"), newFakeServer("rotated")
+	s := New(primary.open(t))
+
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{}, 2)
+	hold := func(*Tx) error {
+		started <- struct{}{}
+		<-release
+		return nil
+	}
+	// One transaction holds the replaced DB, the other the current one
+	go s.WithTx(context.Background(), hold)
+	<-started
+	if err := s.UpdateDB(rotated.open(t)); err != nil {
+		t.Fatalf("failed to update DB: %v", err)
+	}
+	go s.WithTx(context.Background(), hold)
+	<-started
+
+	// The drain timeout is a minute, so only the deadline ends the shutdown
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("failed to shut down store: %v", err)
+	}
+	if !primary.isClosed() || !rotated.isClosed() {
+		t.Fatal("expected the DBs to be closed once the shutdown deadline passed")
+	}
+	if stats := s.SwapStats(); stats.Drains != 2 || stats.DrainTimeouts != 2 {
+		t.Fatalf("expected 2 drains cut short; got %+v", stats)
+	}
+}
+
+func TestStoreClosed(t *testing.T) {
+	primary, replica, rotated := newFakeServer("primary"), newFakeServer("replica"), newFakeServer("rotated")
+	s := New(primary.open(t), WithReplicas(replica.replica(t)))
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("failed to close store: %v", err)
+	}
+	if !primary.isClosed() || !replica.isClosed() {
+		t.Fatal("expected the DBs to be closed")
+	}
+
+	if _, err := s.ListUsers(context.Background()); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected %v; got %v", ErrClosed, err)
+	}
+	if _, err := s.CreateUser(context.Background(), User{Name: "David"}); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected %v; got %v", ErrClosed, err)
+	}
+	if err := s.WithTx(context.Background(), func(*Tx) error { return nil }); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected %v; got %v", ErrClosed, err)
+	}
+
+	// DBs created while the store was closing are closed instead of used
+	if err := s.UpdateDB(rotated.open(t)); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected %v; got %v", ErrClosed, err)
+	}
+	if !rotated.isClosed() {
+		t.Fatal("expected the new DB to be closed")
+	}
+}
+
+// TestStoreConcurrentSwaps swaps the DBs while operations run concurrently,
+// which must all succeed; run it with -race.
+func TestStoreConcurrentSwaps(t *testing.T) {
+	const (
+		workers = 8
+		swaps   = 20
+	)
+
+	servers := []*fakeServer{newFakeServer("primary")}
+	s := New(servers[0].open(t), WithReplicas(newFakeServer("replica").replica(t)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				var err error
+				switch i % 4 {
+				case 0:
+					_, err = s.ListUsers(ctx)
+				case 1:
+					_, err = s.GetUser(WithReadYourWrites(ctx), 1)
+				case 2:
+					_, err = s.CreateUser(ctx, User{Name: "David"})
+				case 3:
+					err = s.WithTx(ctx, func(tx *Tx) error {
+						user, err := tx.CreateUser(ctx, User{Name: "David"})
+						if err != nil {
+							return err
+						}
+						return tx.DeleteUser(ctx, user.ID, user.Version)
+					})
+				}
+				if err != nil && ctx.Err() == nil {
+					errs <- err
+					return
+				}
+			}
+		}(i)
+	}
+
+	for i := 0; i < swaps; i++ {
+		server := newFakeServer("rotated")
+		servers = append(servers, server)
+		if err := s.UpdateDB(server.open(t), newFakeServer("rotated replica").replica(t)); err != nil {
+			t.Fatalf("failed to update DB: %v", err)
+		}
+		go s.CheckReplicas(ctx, time.Second)
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("operation failed during swaps: %v", err)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("failed to close store: %v", err)
+	}
+	for i, server := range servers {
+		if !server.isClosed() {
+			t.Fatalf("expected DB %d to be closed", i)
+		}
+	}
+	if stats := s.SwapStats(); stats.Swaps != swaps || stats.Drains != swaps+1 || stats.DrainTimeouts != 0 {
+		t.Fatalf("expected %d swaps drained without timing out; got %+v", swaps, stats)
+	}
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,2 @@
+USE spiredemo;
+ALTER TABLE Users ADD COLUMN created_by varchar(2048) NULL;
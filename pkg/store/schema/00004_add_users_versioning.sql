@@ -0,0 +1,7 @@
+USE spiredemo;
+ALTER TABLE Users
+    ADD COLUMN version BIGINT NOT NULL DEFAULT 1,
+    ADD COLUMN created_at DATETIME(6) NOT NULL DEFAULT (UTC_TIMESTAMP(6)),
+    ADD COLUMN updated_at DATETIME(6) NOT NULL DEFAULT (UTC_TIMESTAMP(6)),
+    ADD COLUMN deleted_at DATETIME(6) NULL,
+    ADD INDEX users_deleted_at (deleted_at);
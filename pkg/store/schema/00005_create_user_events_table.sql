@@ -0,0 +1,10 @@
+USE spiredemo;
+CREATE TABLE UserEvents (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    type varchar(32) NOT NULL,
+    user_id INT NOT NULL,
+    version BIGINT NOT NULL,
+    payload JSON NOT NULL,
+    created_at DATETIME(6) NOT NULL,
+    UNIQUE KEY user_events_user_version (user_id, version)
+);
@@ -3,65 +3,497 @@ package store
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"fmt"
 	"log"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
-	listUsersQuery  = "SELECT * FROM Users"
-	createUserQuery = "INSERT INTO Users (name) VALUES ( ? );"
+	userColumns = "id, name, created_by, version, created_at, updated_at, deleted_at"
+
+	listUsersQuery        = "SELECT " + userColumns + " FROM Users WHERE deleted_at IS NULL"
+	listAllUsersQuery     = "SELECT " + userColumns + " FROM Users"
+	getUserQuery          = "SELECT " + userColumns + " FROM Users WHERE id = ? AND deleted_at IS NULL"
+	getDeletedUserQuery   = "SELECT " + userColumns + " FROM Users WHERE id = ? AND deleted_at IS NOT NULL"
+	createUserQuery       = "INSERT INTO Users (name, created_by, created_at, updated_at) VALUES ( ?, ?, ?, ? );"
+	updateUserQuery       = "UPDATE Users SET name = ?, version = version + 1, updated_at = ? WHERE id = ? AND deleted_at IS NULL"
+	deleteUserQuery       = "UPDATE Users SET version = version + 1, updated_at = ?, deleted_at = ? WHERE id = ? AND deleted_at IS NULL"
+	matchVersionCondition = " AND version = ?"
+)
+
+var (
+	// ErrNotFound is returned when the requested user doesn't exist.
+	ErrNotFound = errors.New("user not found")
+
+	// ErrClosed is returned by operations on a closed store.
+	ErrClosed = errors.New("store is closed")
+
+	// ErrVersionMismatch is returned when updating or deleting a user whose
+	// version isn't the expected one, because it was changed concurrently.
+	ErrVersionMismatch = errors.New("user version does not match")
 )
 
+// Store reads and writes users in MySQL. Writes go to the primary DB, while
+// reads are spread round-robin across the healthy read replicas, if any, and
+// fall back to the primary.
 type Store struct {
-	mu sync.RWMutex
-	db *sql.DB
+	// pools holds the current DBs, replaced as a whole by UpdateDB without
+	// blocking the operations in flight
+	pools atomic.Pointer[pools]
+	next  atomic.Uint64
+
+	// swapMu serializes UpdateDB and Shutdown
+	swapMu sync.Mutex
+	closed atomic.Bool
+	drains sync.WaitGroup
+	// drainCtx is cancelled by Shutdown to close the DBs replaced by UpdateDB
+	// without waiting for them to drain any further
+	drainCtx   context.Context
+	stopDrains context.CancelFunc
+
+	pingTimeout  time.Duration
+	drainTimeout time.Duration
+	batchSize    int
+	stats        swapStats
+	eventHook    func([]Event)
+
+	// timeouts, breaker and maxInFlight guard the operations, see guard
+	timeouts    map[Method]time.Duration
+	breaker     breaker
+	inFlight    atomic.Int64
+	maxInFlight int64
+	guardStats  guardStats
+}
+
+// Replica is a read replica DB, named by its address in the logs.
+type Replica struct {
+	Addr string
+	DB   *sql.DB
+}
+
+// replica is a read replica DB and whether it passed its last health check.
+type replica struct {
+	name    string
+	db      *sql.DB
+	healthy atomic.Bool
+}
+
+// Option configures a Store.
+type Option func(*Store)
+
+// WithReplicas sets the read replica DBs.
+func WithReplicas(replicas ...Replica) Option {
+	return func(s *Store) {
+		s.pools.Store(newPools(s.pools.Load().db, replicas))
+	}
 }
 
-func New(db *sql.DB) *Store {
-	return &Store{
-		db: db,
+// WithPingTimeout sets how long UpdateDB waits for the new primary DB to
+// respond before rejecting it.
+func WithPingTimeout(timeout time.Duration) Option {
+	return func(s *Store) {
+		s.pingTimeout = timeout
 	}
 }
 
+// WithDrainTimeout sets how long the DBs replaced by UpdateDB are kept open
+// for the operations still using them.
+func WithDrainTimeout(timeout time.Duration) Option {
+	return func(s *Store) {
+		s.drainTimeout = timeout
+	}
+}
+
+// New returns a store writing to the primary DB.
+func New(db *sql.DB, opts ...Option) *Store {
+	s := &Store{
+		pingTimeout:  defaultPingTimeout,
+		drainTimeout: defaultDrainTimeout,
+		batchSize:    DefaultBatchSize,
+		timeouts:     DefaultTimeouts(),
+		breaker: breaker{
+			threshold: DefaultBreakerThreshold,
+			cooldown:  DefaultBreakerCooldown,
+		},
+	}
+	s.drainCtx, s.stopDrains = context.WithCancel(context.Background())
+	s.pools.Store(newPools(db, nil))
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+func newReplicas(dbs []Replica) []*replica {
+	replicas := make([]*replica, 0, len(dbs))
+	for _, db := range dbs {
+		r := &replica{name: "replica " + db.Addr, db: db.DB}
+		// Replicas are used until a health check or query fails
+		r.healthy.Store(true)
+		replicas = append(replicas, r)
+	}
+	return replicas
+}
+
 type User struct {
-	ID   int
-	Name string
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+
+	// CreatedBy is the caller that created the user, if known.
+	CreatedBy string `json:"created_by,omitempty"`
+
+	// Version starts at 1 and is incremented by every update and delete. When
+	// passed to UpdateUser, a non-zero version must match the stored one.
+	Version   int64     `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// DeletedAt is when the user was soft deleted, if it was.
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+// now returns the current time as stored in the DATETIME(6) columns.
+func now() time.Time {
+	return time.Now().UTC().Truncate(time.Microsecond)
+}
+
+// ListOption configures ListUsers.
+type ListOption func(*listOptions)
+
+type listOptions struct {
+	includeDeleted bool
+}
+
+// IncludeDeleted makes ListUsers also return the soft deleted users.
+func IncludeDeleted() ListOption {
+	return func(o *listOptions) {
+		o.includeDeleted = true
+	}
+}
+
+type callerKey struct{}
+
+// WithCaller returns a copy of ctx attributing the store operations made with
+// it to the caller, e.g. the SPIFFE ID of the workload that called the API.
+// Users created with it record the caller in their created_by column, and all
+// queries carry the caller in a comment, so that it shows up in the MySQL
+// general and slow query logs.
+func WithCaller(ctx context.Context, caller string) context.Context {
+	return context.WithValue(ctx, callerKey{}, caller)
+}
+
+func callerFrom(ctx context.Context) string {
+	caller, _ := ctx.Value(callerKey{}).(string)
+	return caller
+}
+
+type readYourWritesKey struct{}
+
+// WithReadYourWrites returns a copy of ctx whose reads go to the primary DB,
+// so that they observe the caller's earlier writes even while the replicas lag
+// behind.
+func WithReadYourWrites(ctx context.Context) context.Context {
+	return context.WithValue(ctx, readYourWritesKey{}, true)
+}
+
+func readYourWrites(ctx context.Context) bool {
+	v, _ := ctx.Value(readYourWritesKey{}).(bool)
+	return v
+}
+
+// annotate prefixes the query with a comment naming the caller, if any.
+func annotate(ctx context.Context, query string) string {
+	caller := callerFrom(ctx)
+	if caller == "" {
+		return query
+	}
+	// Keep the caller from terminating the comment early
+	caller = strings.ReplaceAll(caller, "*/", "*\\/")
+	return fmt.Sprintf("/* caller=%s */ %s", caller, query)
+}
+
+// reader returns the DB of p to read from: the next healthy replica, or the
+// primary if there is none or ctx asks to read its own writes. The replica is
+// nil when reading from the primary.
+func (s *Store) reader(ctx context.Context, p *pools) (*sql.DB, *replica) {
+	if len(p.replicas) == 0 || readYourWrites(ctx) {
+		return p.db, nil
+	}
+	start := s.next.Add(1)
+	for i := range p.replicas {
+		r := p.replicas[(start+uint64(i))%uint64(len(p.replicas))]
+		if r.healthy.Load() {
+			return r.db, r
+		}
+	}
+	return p.db, nil
+}
+
+// read runs the read on a replica, retrying it on the primary if the replica
+// fails. A failed replica isn't read from again until it passes a health check.
+func (s *Store) read(ctx context.Context, read func(db *sql.DB) error) error {
+	p, err := s.acquire()
+	if err != nil {
+		return err
+	}
+	defer p.release()
+
+	db, r := s.reader(ctx, p)
+	err = read(db)
+	if err == nil || r == nil || errors.Is(err, ErrNotFound) || ctx.Err() != nil {
+		return err
+	}
+	log.Printf("Failed to read from %s, falling back to the primary: %v", r.name, err)
+	r.healthy.Store(false)
+	return read(p.db)
+}
+
+// write runs the write on the primary.
+func (s *Store) write(write func(db *sql.DB) error) error {
+	p, err := s.acquire()
+	if err != nil {
+		return err
+	}
+	defer p.release()
+	return write(p.db)
+}
+
+// ListUsers returns the users that weren't deleted, or all users with
+// IncludeDeleted.
+func (s *Store) ListUsers(ctx context.Context, opts ...ListOption) ([]User, error) {
+	var users []User
+	err := s.guard(ctx, MethodListUsers, func(ctx context.Context) error {
+		return s.read(ctx, func(db *sql.DB) (err error) {
+			users, err = listUsers(ctx, db, opts...)
+			return err
+		})
+	})
+	return users, err
 }
 
-func (s *Store) ListUsers(ctx context.Context) ([]User, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	rows, err := s.db.QueryContext(ctx, listUsersQuery)
+func listUsers(ctx context.Context, q querier, opts ...ListOption) ([]User, error) {
+	var o listOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	query := listUsersQuery
+	if o.includeDeleted {
+		query = listAllUsersQuery
+	}
+
+	rows, err := q.QueryContext(ctx, annotate(ctx, query))
 	if err != nil {
 		log.Printf("Failed to run list users query: %v", err)
 		return nil, err
 	}
+	defer rows.Close()
 
 	var users []User
 	for rows.Next() {
-		var user User
-		err = rows.Scan(&user.ID, &user.Name)
+		user, err := scanUser(rows)
+		if err != nil {
+			log.Printf("Failed to scan user: %v", err)
+			return nil, err
+		}
 		users = append(users, user)
 	}
 
-	return users, nil
+	return users, rows.Err()
 }
 
-func (s *Store) CreateUser(ctx context.Context, user User) error {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	if _, err := s.db.ExecContext(ctx, createUserQuery, user.Name); err != nil {
-		log.Printf("Failed to run list users query: %v", err)
+// GetUser returns the user with the ID, or ErrNotFound if there is none or it
+// was deleted.
+func (s *Store) GetUser(ctx context.Context, id int) (User, error) {
+	var user User
+	err := s.guard(ctx, MethodGetUser, func(ctx context.Context) error {
+		return s.read(ctx, func(db *sql.DB) (err error) {
+			user, err = getUser(ctx, db, id)
+			return err
+		})
+	})
+	return user, err
+}
+
+func getUser(ctx context.Context, q querier, id int) (User, error) {
+	user, err := scanUser(q.QueryRowContext(ctx, annotate(ctx, getUserQuery), id))
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return User{}, ErrNotFound
+	case err != nil:
+		log.Printf("Failed to run get user query: %v", err)
+		return User{}, err
+	}
+	return user, nil
+}
+
+// CreateUser creates the user, attributed to the caller in ctx, and returns it
+// with its assigned ID. Like the other changes to users, it's committed along
+// with its event.
+func (s *Store) CreateUser(ctx context.Context, user User) (created User, err error) {
+	err = s.guard(ctx, MethodCreateUser, func(ctx context.Context) error {
+		return s.withTx(ctx, func(tx *Tx) (err error) {
+			created, err = tx.CreateUser(ctx, user)
+			return err
+		})
+	})
+	return created, err
+}
+
+func createUser(ctx context.Context, t *Tx, user User) (User, error) {
+	caller := callerFrom(ctx)
+	createdBy := sql.NullString{String: caller, Valid: caller != ""}
+	createdAt := now()
+	result, err := t.tx.ExecContext(ctx, annotate(ctx, createUserQuery), user.Name, createdBy, createdAt, createdAt)
+	if err != nil {
+		log.Printf("Failed to run create user query: %v", err)
+		return User{}, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return User{}, err
+	}
+	created := User{ID: int(id), Name: user.Name, CreatedBy: caller, Version: 1, CreatedAt: createdAt, UpdatedAt: createdAt}
+	if err := t.insertEvents(ctx, EventUserCreated, created); err != nil {
+		return User{}, err
+	}
+	return created, nil
+}
+
+// UpdateUser renames the user with the ID of user and returns the updated
+// user, or ErrNotFound. If user has a version, the update only succeeds if
+// it's still the stored version, and fails with ErrVersionMismatch otherwise.
+func (s *Store) UpdateUser(ctx context.Context, user User) (updated User, err error) {
+	err = s.guard(ctx, MethodUpdateUser, func(ctx context.Context) error {
+		return s.withTx(ctx, func(tx *Tx) (err error) {
+			updated, err = tx.UpdateUser(ctx, user)
+			return err
+		})
+	})
+	return updated, err
+}
+
+func updateUser(ctx context.Context, t *Tx, user User) (User, error) {
+	query, args := updateUserQuery, []any{user.Name, now(), user.ID}
+	if user.Version != 0 {
+		query, args = query+matchVersionCondition, append(args, user.Version)
+	}
+	if err := execVersioned(ctx, t.tx, "update user", query, user.ID, args...); err != nil {
+		return User{}, err
+	}
+	// Read the user back, from the primary, for its new version and
+	// timestamps
+	updated, err := getUser(ctx, t.tx, user.ID)
+	if err != nil {
+		return User{}, err
+	}
+	if err := t.insertEvents(ctx, EventUserUpdated, updated); err != nil {
+		return User{}, err
+	}
+	return updated, nil
+}
+
+// DeleteUser soft deletes the user with the ID, or returns ErrNotFound. A
+// non-zero version must match the stored version, or the delete fails with
+// ErrVersionMismatch. Deleted users are kept, but hidden from all reads except
+// ListUsers with IncludeDeleted.
+func (s *Store) DeleteUser(ctx context.Context, id int, version int64) error {
+	return s.guard(ctx, MethodDeleteUser, func(ctx context.Context) error {
+		return s.withTx(ctx, func(tx *Tx) error {
+			return tx.DeleteUser(ctx, id, version)
+		})
+	})
+}
+
+func deleteUser(ctx context.Context, t *Tx, id int, version int64) error {
+	deletedAt := now()
+	query, args := deleteUserQuery, []any{deletedAt, deletedAt, id}
+	if version != 0 {
+		query, args = query+matchVersionCondition, append(args, version)
+	}
+	if err := execVersioned(ctx, t.tx, "delete user", query, id, args...); err != nil {
+		return err
+	}
+
+	deleted, err := scanUser(t.tx.QueryRowContext(ctx, annotate(ctx, getDeletedUserQuery), id))
+	if err != nil {
+		log.Printf("Failed to run get deleted user query: %v", err)
+		return err
+	}
+	return t.insertEvents(ctx, EventUserDeleted, deleted)
+}
+
+// execVersioned runs an update of the user with the ID, which increments its
+// version so that it always affects the user if it matched. When it doesn't,
+// the user is read to tell whether it's missing or has another version.
+func execVersioned(ctx context.Context, q querier, op, query string, id int, args ...any) error {
+	result, err := q.ExecContext(ctx, annotate(ctx, query), args...)
+	if err != nil {
+		log.Printf("Failed to run %s query: %v", op, err)
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
 		return err
 	}
-	return nil
+	if affected > 0 {
+		return nil
+	}
+	if _, err := getUser(ctx, q, id); err != nil {
+		return err
+	}
+	return ErrVersionMismatch
+}
+
+// querier is implemented by *sql.DB and *sql.Tx.
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// scanner is implemented by *sql.Row and *sql.Rows.
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanUser(row scanner) (User, error) {
+	var user User
+	var createdBy sql.NullString
+	var deletedAt sql.NullTime
+	if err := row.Scan(&user.ID, &user.Name, &createdBy, &user.Version, &user.CreatedAt, &user.UpdatedAt, &deletedAt); err != nil {
+		return User{}, err
+	}
+	user.CreatedBy = createdBy.String
+	if deletedAt.Valid {
+		user.DeletedAt = &deletedAt.Time
+	}
+	return user, nil
+}
+
+// CheckReplicas pings each replica, only reading from those that respond
+// within the timeout until the next check.
+func (s *Store) CheckReplicas(ctx context.Context, timeout time.Duration) {
+	p, err := s.acquire()
+	if err != nil {
+		return
+	}
+	defer p.release()
+	p.checkReplicas(ctx, timeout)
 }
 
-func (s *Store) UpdateDB(db *sql.DB) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	if err := s.db.Close(); err != nil {
-		log.Printf("Failed to close existing DB connection: %v", err)
+// CheckReplicasEvery runs CheckReplicas at the interval until ctx is done.
+func (s *Store) CheckReplicasEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.CheckReplicas(ctx, interval)
+		}
 	}
-	s.db = db
 }
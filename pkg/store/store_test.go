@@ -0,0 +1,396 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAnnotate(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		caller string
+		expect string
+	}{
+		{
+			name:   "no caller",
+			expect: listUsersQuery,
+		},
+		{
+			name:   "caller",
+			caller: "spiffe://example.org/ns/default/sa/writer",
+			expect: "/* caller=spiffe://example.org/ns/default/sa/writer */ " + listUsersQuery,
+		},
+		{
+			name:   "caller can't terminate the comment",
+			caller: "spiffe://example.org/*/ DROP TABLE Users; /*",
+			expect: `/* caller=spiffe://example.org/*\/ DROP TABLE Users; /* */ ` + listUsersQuery,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.caller != "" {
+				ctx = WithCaller(ctx, tt.caller)
+			}
+			if got := annotate(ctx, listUsersQuery); got != tt.expect {
+				t.Fatalf("expected %q; got %q", tt.expect, got)
+			}
+		})
+	}
+}
+
+func TestStoreReadsFromReplicas(t *testing.T) {
+	primary, replica1, replica2 := newFakeServer("primary"), newFakeServer("replica-1"), newFakeServer("replica-2")
+	s := New(primary.open(t), WithReplicas(replica1.replica(t), replica2.replica(t)))
+
+	ctx := context.Background()
+	for i := 0; i < 4; i++ {
+		if _, err := s.ListUsers(ctx); err != nil {
+			t.Fatalf("failed to list users: %v", err)
+		}
+	}
+	// Reads alternate between the replicas
+	if primary.reads() != 0 || replica1.reads() != 2 || replica2.reads() != 2 {
+		t.Fatalf("expected reads to be spread across the replicas; got primary=%d replica-1=%d replica-2=%d", primary.reads(), replica1.reads(), replica2.reads())
+	}
+
+	// Writes, and reads of the caller's own writes, go to the primary
+	if _, err := s.CreateUser(ctx, User{Name: "David"}); err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	if _, err := s.GetUser(WithReadYourWrites(ctx), 1); err != nil {
+		t.Fatalf("failed to get user: %v", err)
+	}
+	// The user is written along with its event
+	if primary.writes() != 2 || primary.reads() != 1 {
+		t.Fatalf("expected the write and read-your-writes read to go to the primary; got writes=%d reads=%d", primary.writes(), primary.reads())
+	}
+	if replica1.writes() != 0 || replica2.writes() != 0 {
+		t.Fatal("expected no writes to go to the replicas")
+	}
+}
+
+func TestStoreFallsBackToPrimary(t *testing.T) {
+	primary, replica := newFakeServer("primary"), newFakeServer("replica")
+	s := New(primary.open(t), WithReplicas(replica.replica(t)))
+	ctx := context.Background()
+
+	// A failed read is retried on the primary, and the replica isn't read from
+	// until it passes a health check
+	replica.setDown(true)
+	for i := 0; i < 2; i++ {
+		if _, err := s.GetUser(ctx, 1); err != nil {
+			t.Fatalf("failed to get user: %v", err)
+		}
+	}
+	if replica.reads() != 1 || primary.reads() != 2 {
+		t.Fatalf("expected reads to fall back to the primary; got primary=%d replica=%d", primary.reads(), replica.reads())
+	}
+
+	s.CheckReplicas(ctx, time.Second)
+	if _, err := s.GetUser(ctx, 1); err != nil {
+		t.Fatalf("failed to get user: %v", err)
+	}
+	if replica.reads() != 1 {
+		t.Fatal("expected the unhealthy replica not to be read from")
+	}
+
+	replica.setDown(false)
+	s.CheckReplicas(ctx, time.Second)
+	if _, err := s.GetUser(ctx, 1); err != nil {
+		t.Fatalf("failed to get user: %v", err)
+	}
+	if replica.reads() != 2 {
+		t.Fatal("expected the replica to be read from again after passing a health check")
+	}
+}
+
+func TestStoreReplicaNotFoundDoesNotFallBack(t *testing.T) {
+	primary, replica := newFakeServer("primary"), newFakeServer("replica")
+	s := New(primary.open(t), WithReplicas(replica.replica(t)))
+
+	if _, err := s.GetUser(context.Background(), 2); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected %v; got %v", ErrNotFound, err)
+	}
+	if primary.reads() != 0 {
+		t.Fatal("expected a missing user not to be read from the primary")
+	}
+}
+
+func TestStoreVersionChecks(t *testing.T) {
+	primary := newFakeServer("primary")
+	s := New(primary.open(t))
+	ctx := context.Background()
+
+	user, err := s.UpdateUser(ctx, User{ID: 1, Name: "David", Version: 1})
+	if err != nil {
+		t.Fatalf("failed to update user: %v", err)
+	}
+	if user.Version != 1 || user.UpdatedAt.IsZero() || user.DeletedAt != nil {
+		t.Fatalf("expected the user to be read back; got %+v", user)
+	}
+
+	// A write affecting no rows fails with a version mismatch if the user
+	// exists, and as not found otherwise
+	primary.failVersionChecks(3)
+	if _, err := s.UpdateUser(ctx, User{ID: 1, Name: "David", Version: 2}); !errors.Is(err, ErrVersionMismatch) {
+		t.Fatalf("expected %v; got %v", ErrVersionMismatch, err)
+	}
+	if err := s.DeleteUser(ctx, 1, 2); !errors.Is(err, ErrVersionMismatch) {
+		t.Fatalf("expected %v; got %v", ErrVersionMismatch, err)
+	}
+	if err := s.DeleteUser(ctx, 2, 0); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected %v; got %v", ErrNotFound, err)
+	}
+
+	if err := s.DeleteUser(ctx, 1, 1); err != nil {
+		t.Fatalf("failed to delete user: %v", err)
+	}
+}
+
+// fakeServer is a MySQL server stand-in with a single user with ID 1,
+// counting the reads and writes made to it.
+type fakeServer struct {
+	name string
+
+	mu       sync.Mutex
+	down     bool
+	closed   bool
+	execErrs []error
+	execArgs []int
+	// staleExecs is the number of next writes that affect no rows
+	staleExecs int
+	// exportUsers is the number of users returned by the export query
+	exportUsers int
+	nReads      int
+	nWrites     int
+	nCommits    int
+	nRollbacks  int
+}
+
+func newFakeServer(name string) *fakeServer {
+	return &fakeServer{name: name}
+}
+
+func (f *fakeServer) open(t *testing.T) *sql.DB {
+	db := sql.OpenDB(f)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// replica opens a DB to the server, as a read replica named after it.
+func (f *fakeServer) replica(t *testing.T) Replica {
+	return Replica{Addr: f.name, DB: f.open(t)}
+}
+
+func (f *fakeServer) setDown(down bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.down = down
+}
+
+func (f *fakeServer) reads() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.nReads
+}
+
+func (f *fakeServer) writes() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.nWrites
+}
+
+func (f *fakeServer) isClosed() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.closed
+}
+
+// failExecs makes the next writes fail with the errors, in order; nil errors
+// let writes succeed.
+func (f *fakeServer) failExecs(errs ...error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.execErrs = append(f.execErrs, errs...)
+}
+
+// failVersionChecks makes the next n writes affect no rows, as if the user
+// had another version.
+func (f *fakeServer) failVersionChecks(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.staleExecs += n
+}
+
+func (f *fakeServer) txs() (commits, rollbacks int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.nCommits, f.nRollbacks
+}
+
+func (f *fakeServer) check() error {
+	if f.down {
+		// Like the error of a connection to an unreachable server
+		return &net.OpError{Op: "dial", Net: "tcp", Err: errors.New(f.name + " is down")}
+	}
+	return nil
+}
+
+// Connect implements driver.Connector.
+func (f *fakeServer) Connect(context.Context) (driver.Conn, error) {
+	return &fakeConn{f}, nil
+}
+
+// Close is called by sql.DB.Close.
+func (f *fakeServer) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	return nil
+}
+
+// Driver implements driver.Connector.
+func (f *fakeServer) Driver() driver.Driver {
+	return nil
+}
+
+type fakeConn struct {
+	server *fakeServer
+}
+
+func (c *fakeConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("prepared statements are not supported")
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+	if err := c.server.check(); err != nil {
+		return nil, err
+	}
+	return &fakeTx{c.server}, nil
+}
+
+func (c *fakeConn) Ping(context.Context) error {
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+	return c.server.check()
+}
+
+func (c *fakeConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+	c.server.nReads++
+	if err := c.server.check(); err != nil {
+		return nil, err
+	}
+	rows := &fakeRows{columns: []string{"id", "name", "created_by", "version", "created_at", "updated_at", "deleted_at"}}
+	if strings.Contains(query, pendingEventsQuery) {
+		// The creation of user 1 is pending
+		payload := `{"id": 1, "name": "David", "version": 1}`
+		rows.columns = []string{"id", "type", "user_id", "version", "payload", "created_at"}
+		rows.values = [][]driver.Value{{int64(7), string(EventUserCreated), int64(1), int64(1), []byte(payload), time.Now()}}
+	} else if strings.Contains(query, exportUsersQuery) {
+		// Page through the exported users by ID
+		afterID, limit := args[0].Value.(int64), args[1].Value.(int64)
+		for id := afterID + 1; id <= min(afterID+limit, int64(c.server.exportUsers)); id++ {
+			rows.values = append(rows.values, fakeUser(id))
+		}
+	} else if len(args) == 0 || args[0].Value == int64(1) {
+		rows.values = [][]driver.Value{fakeUser(1)}
+	}
+	return rows, nil
+}
+
+func (c *fakeConn) ExecContext(_ context.Context, _ string, args []driver.NamedValue) (driver.Result, error) {
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+	c.server.nWrites++
+	c.server.execArgs = append(c.server.execArgs, len(args))
+	if err := c.server.check(); err != nil {
+		return nil, err
+	}
+	if len(c.server.execErrs) > 0 {
+		err := c.server.execErrs[0]
+		c.server.execErrs = c.server.execErrs[1:]
+		if err != nil {
+			return nil, err
+		}
+	}
+	if c.server.staleExecs > 0 {
+		c.server.staleExecs--
+		return fakeResult{affected: 0}, nil
+	}
+	return fakeResult{affected: 1}, nil
+}
+
+// fakeUser returns the columns of the user with the ID, named David, at
+// version 1.
+func fakeUser(id int64) []driver.Value {
+	createdAt := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	return []driver.Value{id, "David", nil, int64(1), createdAt, createdAt, nil}
+}
+
+type fakeTx struct {
+	server *fakeServer
+}
+
+func (t *fakeTx) Commit() error {
+	t.server.mu.Lock()
+	defer t.server.mu.Unlock()
+	t.server.nCommits++
+	return nil
+}
+
+func (t *fakeTx) Rollback() error {
+	t.server.mu.Lock()
+	defer t.server.mu.Unlock()
+	t.server.nRollbacks++
+	return nil
+}
+
+type fakeRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string {
+	return r.columns
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+type fakeResult struct {
+	affected int64
+}
+
+func (fakeResult) LastInsertId() (int64, error) {
+	return 1, nil
+}
+
+func (r fakeResult) RowsAffected() (int64, error) {
+	return r.affected, nil
+}
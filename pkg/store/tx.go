@@ -0,0 +1,138 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+const (
+	// maxTxAttempts is how many times WithTx runs a transaction that keeps
+	// failing with a retryable error
+	maxTxAttempts = 3
+	// txRetryBackoff is the delay before the first retry, doubled on each
+	// further retry
+	txRetryBackoff = 10 * time.Millisecond
+
+	// MySQL error numbers of transactions worth retrying, see
+	// https://dev.mysql.com/doc/mysql-errors/8.0/en/server-error-reference.html
+	errLockDeadlock    = 1213 // ER_LOCK_DEADLOCK
+	errLockWaitTimeout = 1205 // ER_LOCK_WAIT_TIMEOUT
+)
+
+// Tx is a transaction on the primary DB, exposing the same user operations as
+// the Store. Its operations are committed together when the function passed to
+// WithTx returns nil, and rolled back otherwise.
+type Tx struct {
+	tx *sql.Tx
+	// events are the events written by the transaction so far
+	events []Event
+}
+
+// WithTx runs fn in a transaction on the primary DB. The transaction, and its
+// retries, use the same DB: if UpdateDB replaces it meanwhile, it's only closed
+// once WithTx returns. fn should only use tx, not the Store, to read and write
+// users.
+//
+// If the transaction fails with a deadlock or lock wait timeout, it's rolled
+// back and fn is run again in a new transaction, so fn must not have side
+// effects outside of tx. The transaction is rolled back if it's still running,
+// retries included, once the WithTx timeout elapsed.
+func (s *Store) WithTx(ctx context.Context, fn func(tx *Tx) error) error {
+	return s.guard(ctx, MethodWithTx, func(ctx context.Context) error {
+		return s.withTx(ctx, fn)
+	})
+}
+
+func (s *Store) withTx(ctx context.Context, fn func(tx *Tx) error) error {
+	p, err := s.acquire()
+	if err != nil {
+		return err
+	}
+	defer p.release()
+
+	backoff := txRetryBackoff
+	for attempt := 1; ; attempt++ {
+		err := s.runTx(ctx, p.db, fn)
+		if err == nil || !isRetryable(err) || attempt == maxTxAttempts {
+			return err
+		}
+
+		log.Printf("Retrying transaction after attempt %d failed: %v", attempt, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (s *Store) runTx(ctx context.Context, db *sql.DB, fn func(tx *Tx) error) error {
+	sqlTx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Printf("Failed to begin transaction: %v", err)
+		return err
+	}
+	tx := &Tx{tx: sqlTx}
+	if err := fn(tx); err != nil {
+		if rollbackErr := sqlTx.Rollback(); rollbackErr != nil && !errors.Is(rollbackErr, sql.ErrTxDone) {
+			log.Printf("Failed to roll back transaction: %v", rollbackErr)
+		}
+		return err
+	}
+	if err := sqlTx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	if s.eventHook != nil && len(tx.events) > 0 {
+		s.eventHook(tx.events)
+	}
+	return nil
+}
+
+// isRetryable reports whether err means the transaction was rolled back, or
+// should be, because of contention with other transactions.
+func isRetryable(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if !errors.As(err, &mysqlErr) {
+		return false
+	}
+	return mysqlErr.Number == errLockDeadlock || mysqlErr.Number == errLockWaitTimeout
+}
+
+// ListUsers returns the users that weren't deleted, or all users with
+// IncludeDeleted.
+func (t *Tx) ListUsers(ctx context.Context, opts ...ListOption) ([]User, error) {
+	return listUsers(ctx, t.tx, opts...)
+}
+
+// GetUser returns the user with the ID, or ErrNotFound if there is none or it
+// was deleted.
+func (t *Tx) GetUser(ctx context.Context, id int) (User, error) {
+	return getUser(ctx, t.tx, id)
+}
+
+// CreateUser creates the user, attributed to the caller in ctx, and returns it
+// with its assigned ID.
+func (t *Tx) CreateUser(ctx context.Context, user User) (User, error) {
+	return createUser(ctx, t, user)
+}
+
+// UpdateUser renames the user with the ID of user and returns the updated
+// user, or ErrNotFound. A non-zero version of user must match the stored one,
+// or the update fails with ErrVersionMismatch.
+func (t *Tx) UpdateUser(ctx context.Context, user User) (User, error) {
+	return updateUser(ctx, t, user)
+}
+
+// DeleteUser soft deletes the user with the ID, or returns ErrNotFound. A
+// non-zero version must match the stored one, or the delete fails with
+// ErrVersionMismatch.
+func (t *Tx) DeleteUser(ctx context.Context, id int, version int64) error {
+	return deleteUser(ctx, t, id, version)
+}
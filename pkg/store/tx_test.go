@@ -0,0 +1,123 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestWithTx(t *testing.T) {
+	errFailed := errors.New("failed")
+	deadlock := &mysql.MySQLError{Number: errLockDeadlock, Message: "Deadlock found when trying to get lock"}
+	lockWaitTimeout := &mysql.MySQLError{Number: errLockWaitTimeout, Message: "Lock wait timeout exceeded"}
+
+	for _, tt := range []struct {
+		name            string
+		execErrs        []error
+		expectErr       error
+		expectAttempts  int
+		expectCommits   int
+		expectRollbacks int
+	}{
+		{
+			name:           "commits",
+			expectAttempts: 1,
+			expectCommits:  1,
+		},
+		{
+			name:            "retries deadlock",
+			execErrs:        []error{deadlock},
+			expectAttempts:  2,
+			expectCommits:   1,
+			expectRollbacks: 1,
+		},
+		{
+			name:            "retries lock wait timeout",
+			execErrs:        []error{lockWaitTimeout, deadlock},
+			expectAttempts:  3,
+			expectCommits:   1,
+			expectRollbacks: 2,
+		},
+		{
+			name:            "gives up after max attempts",
+			execErrs:        []error{deadlock, deadlock, deadlock},
+			expectErr:       deadlock,
+			expectAttempts:  maxTxAttempts,
+			expectRollbacks: maxTxAttempts,
+		},
+		{
+			name:            "doesn't retry other errors",
+			execErrs:        []error{errFailed},
+			expectErr:       errFailed,
+			expectAttempts:  1,
+			expectRollbacks: 1,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			primary := newFakeServer("primary")
+			primary.failExecs(tt.execErrs...)
+			s := New(primary.open(t))
+
+			var attempts int
+			err := s.WithTx(context.Background(), func(tx *Tx) error {
+				attempts++
+				user, err := tx.CreateUser(context.Background(), User{Name: "David"})
+				if err != nil {
+					return err
+				}
+				_, err = tx.UpdateUser(context.Background(), User{ID: user.ID, Name: "Dave"})
+				return err
+			})
+			if !errors.Is(err, tt.expectErr) {
+				t.Fatalf("expected error %v; got %v", tt.expectErr, err)
+			}
+			if attempts != tt.expectAttempts {
+				t.Fatalf("expected %d attempts; got %d", tt.expectAttempts, attempts)
+			}
+			if commits, rollbacks := primary.txs(); commits != tt.expectCommits || rollbacks != tt.expectRollbacks {
+				t.Fatalf("expected %d commits and %d rollbacks; got %d and %d", tt.expectCommits, tt.expectRollbacks, commits, rollbacks)
+			}
+		})
+	}
+}
+
+func TestWithTxHoldsDB(t *testing.T) {
+	primary := newFakeServer("primary")
+	s := New(primary.open(t))
+	// The first attempt deadlocks, so that the transaction is retried after
+	// the DB was replaced
+	primary.failExecs(&mysql.MySQLError{Number: errLockDeadlock, Message: "Deadlock found when trying to get lock"})
+
+	attempts := 0
+	err := s.WithTx(context.Background(), func(tx *Tx) error {
+		if attempts++; attempts == 1 {
+			if err := s.UpdateDB(newFakeServer("rotated").open(t)); err != nil {
+				return err
+			}
+		}
+
+		// The DB the transaction runs on isn't closed until it finishes
+		time.Sleep(50 * time.Millisecond)
+		if primary.isClosed() {
+			return errors.New("DB was closed during the transaction")
+		}
+		_, err := tx.CreateUser(context.Background(), User{Name: "David"})
+		return err
+	})
+	if err != nil {
+		t.Fatalf("transaction failed: %v", err)
+	}
+	if commits, rollbacks := primary.txs(); attempts != 2 || commits != 1 || rollbacks != 1 {
+		t.Fatalf("expected both attempts to run on the original DB; got %d attempts, %d commits and %d rollbacks", attempts, commits, rollbacks)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("failed to close store: %v", err)
+	}
+	if !primary.isClosed() {
+		t.Fatal("expected the original DB to be closed once the transaction finished")
+	}
+}
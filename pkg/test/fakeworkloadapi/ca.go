@@ -0,0 +1,199 @@
+package fakeworkloadapi
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
+	"github.com/spiffe/go-spiffe/v2/bundle/jwtbundle"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+)
+
+const defaultSVIDTTL = time.Hour
+
+// Identity describes an X.509-SVID served by the fake Workload API.
+type Identity struct {
+	// ID is the SPIFFE ID of the X.509-SVID.
+	ID spiffeid.ID
+
+	// Hint is the SVID hint used to select between multiple SVIDs.
+	Hint string
+
+	// Subject is the subject of the X.509-SVID, e.g. the subject set by the
+	// dbcredentialcomposer plugin for MySQL clients.
+	Subject pkix.Name
+
+	// DNSNames are added as DNS SANs of the X.509-SVID.
+	DNSNames []string
+
+	// TTL defaults to one hour.
+	TTL time.Duration
+}
+
+// CA is a tiny in-memory certificate authority for a single trust domain that
+// mints X.509-SVIDs.
+type CA struct {
+	tb   testing.TB
+	td   spiffeid.TrustDomain
+	cert *x509.Certificate
+	key  crypto.Signer
+
+	jwtKey   crypto.Signer
+	jwtKeyID string
+}
+
+// NewCA creates a CA with a self-signed root certificate for the trust domain.
+func NewCA(tb testing.TB, td spiffeid.TrustDomain) *CA {
+	tb.Helper()
+	key := newKey(tb)
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          newSerialNumber(tb),
+		Subject:               pkix.Name{Country: []string{"US"}, Organization: []string{"SPIFFE"}, CommonName: td.String() + " test CA"},
+		URIs:                  []*url.URL{td.ID().URL()},
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              now.Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	cert := createCertificate(tb, template, template, key.Public(), key)
+	return &CA{
+		tb:       tb,
+		td:       td,
+		cert:     cert,
+		key:      key,
+		jwtKey:   newKey(tb),
+		jwtKeyID: newSerialNumber(tb).Text(36),
+	}
+}
+
+// TrustDomain returns the trust domain of the CA.
+func (ca *CA) TrustDomain() spiffeid.TrustDomain {
+	return ca.td
+}
+
+// X509Bundle returns the X.509 bundle containing the CA root certificate.
+func (ca *CA) X509Bundle() *x509bundle.Bundle {
+	return x509bundle.FromX509Authorities(ca.td, []*x509.Certificate{ca.cert})
+}
+
+// JWTBundle returns the JWT bundle containing the CA JWT signing key.
+func (ca *CA) JWTBundle() *jwtbundle.Bundle {
+	return jwtbundle.FromJWTAuthorities(ca.td, map[string]crypto.PublicKey{
+		ca.jwtKeyID: ca.jwtKey.Public(),
+	})
+}
+
+// MintJWTSVID mints a JWT-SVID for the identity with the audience and returns
+// the signed token.
+func (ca *CA) MintJWTSVID(identity Identity, audience ...string) string {
+	ca.tb.Helper()
+	token, err := ca.mintJWTSVID(identity, audience...)
+	if err != nil {
+		ca.tb.Fatal(err)
+	}
+	return token
+}
+
+// mintJWTSVID is MintJWTSVID for the Workload API server goroutines, which
+// must not fail the test.
+func (ca *CA) mintJWTSVID(identity Identity, audience ...string) (string, error) {
+	ttl := identity.TTL
+	if ttl == 0 {
+		ttl = defaultSVIDTTL
+	}
+
+	signer, err := jose.NewSigner(jose.SigningKey{
+		Algorithm: jose.ES256,
+		Key:       jose.JSONWebKey{Key: ca.jwtKey, KeyID: ca.jwtKeyID},
+	}, new(jose.SignerOptions).WithType("JWT"))
+	if err != nil {
+		return "", fmt.Errorf("failed to create JWT signer: %w", err)
+	}
+
+	now := time.Now()
+	token, err := jwt.Signed(signer).Claims(jwt.Claims{
+		Subject:  identity.ID.String(),
+		Audience: audience,
+		IssuedAt: jwt.NewNumericDate(now),
+		Expiry:   jwt.NewNumericDate(now.Add(ttl)),
+	}).CompactSerialize()
+	if err != nil {
+		return "", fmt.Errorf("failed to sign JWT-SVID: %w", err)
+	}
+	return token, nil
+}
+
+// MintX509SVID mints a new X.509-SVID with a fresh key for the identity.
+func (ca *CA) MintX509SVID(identity Identity) *x509svid.SVID {
+	ca.tb.Helper()
+	ttl := identity.TTL
+	if ttl == 0 {
+		ttl = defaultSVIDTTL
+	}
+
+	key := newKey(ca.tb)
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          newSerialNumber(ca.tb),
+		Subject:               identity.Subject,
+		URIs:                  []*url.URL{identity.ID.URL()},
+		DNSNames:              identity.DNSNames,
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              now.Add(ttl),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment | x509.KeyUsageKeyAgreement,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+	cert := createCertificate(ca.tb, template, ca.cert, key.Public(), ca.key)
+	return &x509svid.SVID{
+		ID:           identity.ID,
+		Certificates: []*x509.Certificate{cert},
+		PrivateKey:   key,
+		Hint:         identity.Hint,
+	}
+}
+
+func createCertificate(tb testing.TB, template, parent *x509.Certificate, publicKey crypto.PublicKey, signer crypto.Signer) *x509.Certificate {
+	tb.Helper()
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, publicKey, signer)
+	if err != nil {
+		tb.Fatalf("failed to create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		tb.Fatalf("failed to parse certificate: %v", err)
+	}
+	return cert
+}
+
+func newKey(tb testing.TB) crypto.Signer {
+	tb.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		tb.Fatalf("failed to generate key: %v", err)
+	}
+	return key
+}
+
+func newSerialNumber(tb testing.TB) *big.Int {
+	tb.Helper()
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		tb.Fatalf("failed to generate serial number: %v", err)
+	}
+	return serialNumber
+}
@@ -0,0 +1,285 @@
+// Package fakeworkloadapi provides an in-process SPIFFE Workload API server
+// for tests. It listens on a temporary Unix socket and serves X.509-SVIDs
+// minted by an in-memory CA, which can be rotated on demand, and JWT-SVIDs
+// signed by the same CA.
+package fakeworkloadapi
+
+import (
+	"context"
+	"crypto/x509"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/spiffe/go-spiffe/v2/proto/spiffe/workload"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// WorkloadAPI is a fake SPIFFE Workload API server.
+type WorkloadAPI struct {
+	workload.UnimplementedSpiffeWorkloadAPIServer
+
+	tb     testing.TB
+	ca     *CA
+	addr   string
+	server *grpc.Server
+	wg     sync.WaitGroup
+
+	mu         sync.Mutex
+	identities []Identity
+	svids      []*x509svid.SVID
+	x509Resp   *workload.X509SVIDResponse
+	watchers   map[chan struct{}]struct{}
+}
+
+// New starts a fake Workload API serving X.509-SVIDs for the identities,
+// minted by ca. The server is stopped when the test finishes.
+func New(tb testing.TB, ca *CA, identities ...Identity) *WorkloadAPI {
+	tb.Helper()
+
+	// Unix socket paths are limited to ~100 characters, which a test's
+	// TempDir can exceed, so use a short directory instead.
+	dir, err := os.MkdirTemp("", "wlapi")
+	if err != nil {
+		tb.Fatalf("failed to create socket directory: %v", err)
+	}
+	tb.Cleanup(func() { os.RemoveAll(dir) })
+
+	socketPath := filepath.Join(dir, "agent.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		tb.Fatalf("failed to listen on %s: %v", socketPath, err)
+	}
+
+	w := &WorkloadAPI{
+		tb:       tb,
+		ca:       ca,
+		addr:     "unix://" + socketPath,
+		server:   grpc.NewServer(),
+		watchers: make(map[chan struct{}]struct{}),
+	}
+	w.SetIdentities(identities...)
+	workload.RegisterSpiffeWorkloadAPIServer(w.server, w)
+
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		_ = w.server.Serve(listener)
+	}()
+	tb.Cleanup(w.Stop)
+	return w
+}
+
+// Addr returns the address of the Workload API, e.g. unix:///tmp/wlapi123/agent.sock.
+func (w *WorkloadAPI) Addr() string {
+	return w.addr
+}
+
+// SocketPath returns the path of the Unix socket the Workload API listens on.
+func (w *WorkloadAPI) SocketPath() string {
+	return w.addr[len("unix://"):]
+}
+
+// Stop stops the server, ending all streams.
+func (w *WorkloadAPI) Stop() {
+	w.server.Stop()
+	w.wg.Wait()
+}
+
+// SetIdentities replaces the served identities with freshly minted
+// X.509-SVIDs and pushes them to all watchers. The first identity is the
+// default SVID. Serving no identities makes fetches fail with PermissionDenied,
+// as the SPIRE agent does for workloads without registration entries.
+func (w *WorkloadAPI) SetIdentities(identities ...Identity) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.identities = identities
+	w.mintLocked()
+}
+
+// Rotate mints new X.509-SVIDs for the served identities and pushes them to
+// all watchers, as the SPIRE agent does ahead of SVID expiration.
+func (w *WorkloadAPI) Rotate() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.mintLocked()
+}
+
+// X509SVIDs returns the X.509-SVIDs currently served.
+func (w *WorkloadAPI) X509SVIDs() []*x509svid.SVID {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]*x509svid.SVID(nil), w.svids...)
+}
+
+// X509SVID returns the X.509-SVID currently served with the hint.
+func (w *WorkloadAPI) X509SVID(hint string) *x509svid.SVID {
+	w.tb.Helper()
+	for _, svid := range w.X509SVIDs() {
+		if svid.Hint == hint {
+			return svid
+		}
+	}
+	w.tb.Fatalf("no X.509-SVID served with hint %q", hint)
+	return nil
+}
+
+func (w *WorkloadAPI) mintLocked() {
+	w.svids = nil
+	w.x509Resp = nil
+	if len(w.identities) > 0 {
+		bundle := concatRawCerts(w.ca.X509Bundle().X509Authorities())
+		resp := new(workload.X509SVIDResponse)
+		for _, identity := range w.identities {
+			svid := w.ca.MintX509SVID(identity)
+			keyDER, err := x509.MarshalPKCS8PrivateKey(svid.PrivateKey)
+			if err != nil {
+				w.tb.Fatalf("failed to marshal private key: %v", err)
+			}
+			w.svids = append(w.svids, svid)
+			resp.Svids = append(resp.Svids, &workload.X509SVID{
+				SpiffeId:    svid.ID.String(),
+				X509Svid:    concatRawCerts(svid.Certificates),
+				X509SvidKey: keyDER,
+				Bundle:      bundle,
+				Hint:        svid.Hint,
+			})
+		}
+		w.x509Resp = resp
+	}
+
+	for ch := range w.watchers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// FetchX509SVID implements the Workload API FetchX509SVID RPC.
+func (w *WorkloadAPI) FetchX509SVID(_ *workload.X509SVIDRequest, stream workload.SpiffeWorkloadAPI_FetchX509SVIDServer) error {
+	return w.stream(stream, func(resp *workload.X509SVIDResponse) error {
+		return stream.Send(resp)
+	})
+}
+
+// FetchX509Bundles implements the Workload API FetchX509Bundles RPC.
+func (w *WorkloadAPI) FetchX509Bundles(_ *workload.X509BundlesRequest, stream workload.SpiffeWorkloadAPI_FetchX509BundlesServer) error {
+	return w.stream(stream, func(*workload.X509SVIDResponse) error {
+		return stream.Send(&workload.X509BundlesResponse{
+			Bundles: map[string][]byte{
+				w.ca.TrustDomain().IDString(): concatRawCerts(w.ca.X509Bundle().X509Authorities()),
+			},
+		})
+	})
+}
+
+// FetchJWTSVID implements the Workload API FetchJWTSVID RPC, minting a
+// JWT-SVID for the audience for each served identity, or only for the
+// requested SPIFFE ID.
+func (w *WorkloadAPI) FetchJWTSVID(ctx context.Context, req *workload.JWTSVIDRequest) (*workload.JWTSVIDResponse, error) {
+	if err := checkHeader(ctx); err != nil {
+		return nil, err
+	}
+	if len(req.Audience) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "audience must be specified")
+	}
+
+	w.mu.Lock()
+	identities := w.identities
+	w.mu.Unlock()
+
+	resp := new(workload.JWTSVIDResponse)
+	for _, identity := range identities {
+		if req.SpiffeId != "" && req.SpiffeId != identity.ID.String() {
+			continue
+		}
+		token, err := w.ca.mintJWTSVID(identity, req.Audience...)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		resp.Svids = append(resp.Svids, &workload.JWTSVID{
+			SpiffeId: identity.ID.String(),
+			Svid:     token,
+			Hint:     identity.Hint,
+		})
+	}
+	if len(resp.Svids) == 0 {
+		return nil, status.Error(codes.PermissionDenied, "no identity issued")
+	}
+	return resp, nil
+}
+
+// FetchJWTBundles implements the Workload API FetchJWTBundles RPC.
+func (w *WorkloadAPI) FetchJWTBundles(_ *workload.JWTBundlesRequest, stream workload.SpiffeWorkloadAPI_FetchJWTBundlesServer) error {
+	jwks, err := w.ca.JWTBundle().Marshal()
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to marshal JWT bundle: %v", err)
+	}
+	return w.stream(stream, func(*workload.X509SVIDResponse) error {
+		return stream.Send(&workload.JWTBundlesResponse{
+			Bundles: map[string][]byte{
+				w.ca.TrustDomain().IDString(): jwks,
+			},
+		})
+	})
+}
+
+// stream sends the current X.509-SVID response, and each new one after an
+// update, until the client goes away.
+func (w *WorkloadAPI) stream(stream grpc.ServerStream, send func(*workload.X509SVIDResponse) error) error {
+	if err := checkHeader(stream.Context()); err != nil {
+		return err
+	}
+
+	ch := make(chan struct{}, 1)
+	ch <- struct{}{}
+	w.mu.Lock()
+	w.watchers[ch] = struct{}{}
+	w.mu.Unlock()
+	defer func() {
+		w.mu.Lock()
+		delete(w.watchers, ch)
+		w.mu.Unlock()
+	}()
+
+	for {
+		select {
+		case <-ch:
+			w.mu.Lock()
+			resp := w.x509Resp
+			w.mu.Unlock()
+			if resp == nil {
+				return status.Error(codes.PermissionDenied, "no identity issued")
+			}
+			if err := send(resp); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+	}
+}
+
+// checkHeader requires the security header sent by Workload API clients.
+func checkHeader(ctx context.Context) error {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok || len(md.Get("workload.spiffe.io")) != 1 || md.Get("workload.spiffe.io")[0] != "true" {
+		return status.Error(codes.InvalidArgument, "security header missing from request")
+	}
+	return nil
+}
+
+func concatRawCerts(certs []*x509.Certificate) []byte {
+	var raw []byte
+	for _, cert := range certs {
+		raw = append(raw, cert.Raw...)
+	}
+	return raw
+}
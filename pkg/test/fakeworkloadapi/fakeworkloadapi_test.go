@@ -0,0 +1,138 @@
+package fakeworkloadapi_test
+
+import (
+	"context"
+	"crypto/x509/pkix"
+	"testing"
+	"time"
+
+	"github.com/rturner3/spire-mysql-demo/pkg/test/fakeworkloadapi"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	td            = spiffeid.RequireTrustDomainFromString("example.org")
+	serverID      = spiffeid.RequireFromPath(td, "/mysql/server")
+	clientID      = spiffeid.RequireFromPath(td, "/mysql/client/mysql-tls-reloader")
+	clientSubject = pkix.Name{Country: []string{"US"}, Organization: []string{"SPIRE"}, CommonName: "mysql-tls-reloader"}
+)
+
+func TestFetchX509Context(t *testing.T) {
+	ca := fakeworkloadapi.NewCA(t, td)
+	api := fakeworkloadapi.New(t, ca,
+		fakeworkloadapi.Identity{ID: serverID, Hint: "mysql-server"},
+		fakeworkloadapi.Identity{ID: clientID, Hint: "mysql-client", Subject: clientSubject},
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	x509Context, err := workloadapi.FetchX509Context(ctx, workloadapi.WithAddr(api.Addr()))
+	if err != nil {
+		t.Fatalf("failed to fetch X.509 context: %v", err)
+	}
+
+	if len(x509Context.SVIDs) != 2 {
+		t.Fatalf("expected 2 SVIDs; got %d", len(x509Context.SVIDs))
+	}
+	if svid := x509Context.DefaultSVID(); svid.ID != serverID || svid.Hint != "mysql-server" {
+		t.Fatalf("unexpected default SVID %s with hint %q", svid.ID, svid.Hint)
+	}
+	client := x509Context.SVIDs[1]
+	if client.ID != clientID || client.Hint != "mysql-client" {
+		t.Fatalf("unexpected SVID %s with hint %q", client.ID, client.Hint)
+	}
+	if cn := client.Certificates[0].Subject.CommonName; cn != "mysql-tls-reloader" {
+		t.Fatalf("expected subject CN %q; got %q", "mysql-tls-reloader", cn)
+	}
+
+	bundle, err := x509Context.Bundles.GetX509BundleForTrustDomain(td)
+	if err != nil {
+		t.Fatalf("failed to get bundle: %v", err)
+	}
+	if !bundle.Equal(ca.X509Bundle()) {
+		t.Fatal("expected bundle to contain the CA certificate")
+	}
+}
+
+func TestRotate(t *testing.T) {
+	api := fakeworkloadapi.New(t, fakeworkloadapi.NewCA(t, td), fakeworkloadapi.Identity{ID: serverID, Hint: "mysql-server"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	source, err := workloadapi.NewX509Source(ctx, workloadapi.WithClientOptions(workloadapi.WithAddr(api.Addr())))
+	if err != nil {
+		t.Fatalf("failed to create X.509 source: %v", err)
+	}
+	defer source.Close()
+
+	initial, err := source.GetX509SVID()
+	if err != nil {
+		t.Fatalf("failed to get X.509-SVID: %v", err)
+	}
+
+	api.Rotate()
+	rotated := api.X509SVID("mysql-server")
+	if rotated.Certificates[0].SerialNumber.Cmp(initial.Certificates[0].SerialNumber) == 0 {
+		t.Fatal("expected rotation to mint a new X.509-SVID")
+	}
+
+	for {
+		svid, err := source.GetX509SVID()
+		if err != nil {
+			t.Fatalf("failed to get X.509-SVID: %v", err)
+		}
+		if svid.Certificates[0].Equal(rotated.Certificates[0]) {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatal("timed out waiting for rotated X.509-SVID")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestNoIdentity(t *testing.T) {
+	api := fakeworkloadapi.New(t, fakeworkloadapi.NewCA(t, td))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := workloadapi.FetchX509Context(ctx, workloadapi.WithAddr(api.Addr()))
+	if status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected PermissionDenied; got %v", err)
+	}
+}
+
+func TestFetchJWTSVID(t *testing.T) {
+	api := fakeworkloadapi.New(t, fakeworkloadapi.NewCA(t, td),
+		fakeworkloadapi.Identity{ID: serverID},
+		fakeworkloadapi.Identity{ID: clientID},
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	svid, err := workloadapi.FetchJWTSVID(ctx, jwtsvid.Params{Audience: "sample-service", Subject: clientID}, workloadapi.WithAddr(api.Addr()))
+	if err != nil {
+		t.Fatalf("failed to fetch JWT-SVID: %v", err)
+	}
+	if svid.ID != clientID {
+		t.Fatalf("expected JWT-SVID for %s; got %s", clientID, svid.ID)
+	}
+
+	source, err := workloadapi.NewJWTSource(ctx, workloadapi.WithClientOptions(workloadapi.WithAddr(api.Addr())))
+	if err != nil {
+		t.Fatalf("failed to create JWT source: %v", err)
+	}
+	defer source.Close()
+
+	if _, err := jwtsvid.ParseAndValidate(svid.Marshal(), source, []string{"sample-service"}); err != nil {
+		t.Fatalf("expected JWT-SVID to validate against the served bundle: %v", err)
+	}
+	if _, err := jwtsvid.ParseAndValidate(svid.Marshal(), source, []string{"other-service"}); err == nil {
+		t.Fatal("expected JWT-SVID not to validate for another audience")
+	}
+}
@@ -0,0 +1,368 @@
+package usersapi
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Client is a typed client for the users API.
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	token      func(context.Context) (string, error)
+
+	readYourWrites bool
+}
+
+// ClientOption configures a Client.
+type ClientOption func(*Client)
+
+// WithHTTPClient sets the HTTP client used to call the API, e.g. one with a
+// SPIFFE mTLS transport built with tlsconfig.MTLSClientConfig.
+func WithHTTPClient(httpClient *http.Client) ClientOption {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithBearerToken authenticates each request with the token returned by
+// token, e.g. a JWT-SVID fetched from a workloadapi.JWTSource.
+func WithBearerToken(token func(context.Context) (string, error)) ClientOption {
+	return func(c *Client) {
+		c.token = token
+	}
+}
+
+// WithReadYourWrites makes reads observe the client's earlier writes, at the
+// cost of always reading from the MySQL primary.
+func WithReadYourWrites() ClientOption {
+	return func(c *Client) {
+		c.readYourWrites = true
+	}
+}
+
+// NewClient returns a client for the API served at baseURL, e.g.
+// http://sample-service:8888.
+func NewClient(baseURL string, opts ...ClientOption) (*Client, error) {
+	if _, err := url.Parse(baseURL); err != nil {
+		return nil, fmt.Errorf("invalid base URL %q: %w", baseURL, err)
+	}
+	c := &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		httpClient: http.DefaultClient,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c, nil
+}
+
+// APIError is returned when the API responds with an error status.
+type APIError struct {
+	StatusCode int
+	// Code is the error code of the response, e.g. CodeNotFound, if it has one
+	Code    string
+	Message string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("users API returned %d: %s", e.StatusCode, e.Message)
+}
+
+// ListOption configures ListUsers.
+type ListOption func(url.Values)
+
+// IncludeDeleted makes ListUsers also return the soft deleted users.
+func IncludeDeleted() ListOption {
+	return func(query url.Values) {
+		query.Set(IncludeDeletedParam, "true")
+	}
+}
+
+// ListUsers lists the users that weren't deleted, or all users with
+// IncludeDeleted.
+func (c *Client) ListUsers(ctx context.Context, opts ...ListOption) ([]User, error) {
+	query := url.Values{}
+	for _, opt := range opts {
+		opt(query)
+	}
+	path := UsersPath
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+
+	var users []User
+	if err := c.do(ctx, http.MethodGet, path, nil, nil, http.StatusOK, &users); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// GetUser gets the user with the ID. Its version can be passed to UpdateUser
+// and DeleteUser to only change the user if nobody else did meanwhile.
+func (c *Client) GetUser(ctx context.Context, id int) (User, error) {
+	var user User
+	if err := c.do(ctx, http.MethodGet, UserPath(id), nil, nil, http.StatusOK, &user); err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+// CreateUser creates a user and returns the created user. The request is
+// validated before it is sent.
+func (c *Client) CreateUser(ctx context.Context, req CreateUserRequest) (User, error) {
+	if err := req.Validate(); err != nil {
+		return User{}, err
+	}
+	var user User
+	if err := c.do(ctx, http.MethodPost, UsersPath, nil, req, http.StatusCreated, &user); err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+// UpdateUser renames the user with the ID and returns the updated user. If
+// version isn't 0, the user is only renamed if it still has the version, and
+// the API responds with 412 Precondition Failed otherwise. The request is
+// validated before it is sent.
+func (c *Client) UpdateUser(ctx context.Context, id int, version int64, req UpdateUserRequest) (User, error) {
+	if err := req.Validate(); err != nil {
+		return User{}, err
+	}
+	var user User
+	if err := c.do(ctx, http.MethodPut, UserPath(id), ifMatch(version), req, http.StatusOK, &user); err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+// DeleteUser soft deletes the user with the ID. If version isn't 0, the user
+// is only deleted if it still has the version, and the API responds with 412
+// Precondition Failed otherwise.
+func (c *Client) DeleteUser(ctx context.Context, id int, version int64) error {
+	return c.do(ctx, http.MethodDelete, UserPath(id), ifMatch(version), nil, http.StatusNoContent, nil)
+}
+
+// ifMatch returns the If-Match header of a request conditioned on the
+// version, if any.
+func ifMatch(version int64) http.Header {
+	if version == 0 {
+		return nil
+	}
+	return http.Header{"If-Match": {ETag(version)}}
+}
+
+// BatchCreateUsers creates the users in bulk, returning the outcome for each
+// request in order. Invalid requests are reported in their result rather than
+// failing the whole batch.
+func (c *Client) BatchCreateUsers(ctx context.Context, reqs []CreateUserRequest) ([]BatchCreateResult, error) {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, req := range reqs {
+		if err := enc.Encode(req); err != nil {
+			return nil, err
+		}
+	}
+
+	var results []BatchCreateResult
+	err := c.stream(ctx, http.MethodPost, BatchCreatePath, &body, NDJSONContentType, func(dec *json.Decoder) error {
+		var result BatchCreateResult
+		if err := dec.Decode(&result); err != nil {
+			return err
+		}
+		results = append(results, result)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// ExportUsers calls fn with every user, in ID order, as they're streamed by
+// the API, until fn returns an error.
+func (c *Client) ExportUsers(ctx context.Context, fn func(User) error) error {
+	return c.stream(ctx, http.MethodGet, ExportPath+"?"+FormatParam+"="+FormatNDJSON, nil, "", func(dec *json.Decoder) error {
+		var user User
+		if err := dec.Decode(&user); err != nil {
+			return err
+		}
+		return fn(user)
+	})
+}
+
+// WatchUsers calls fn with the user change events streamed by the API, right
+// after the event with the resume token or from now on if token is empty,
+// until the stream ends, ctx is done or fn returns an error. The stream ends
+// when the watcher doesn't keep up, and is resumed by calling WatchUsers again
+// with the token of the last event. A first event of type ResetEventType means
+// that the changes since token are lost.
+func (c *Client) WatchUsers(ctx context.Context, token string, fn func(WatchEvent) error) error {
+	req, err := c.newRequest(ctx, http.MethodGet, WatchPath, nil, "")
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", EventStreamContentType)
+	if token != "" {
+		req.Header.Set(LastEventIDHeader, token)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		return newAPIError(resp.StatusCode, data)
+	}
+
+	var event WatchEvent
+	var data []byte
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		field, value, _ := strings.Cut(scanner.Text(), ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "id":
+			event.Token = value
+		case "event":
+			event.Type = value
+		case "data":
+			data = append(data, value...)
+		case "":
+			// A blank line ends the event, a line starting with a colon is a
+			// comment
+			if scanner.Text() != "" || data == nil {
+				continue
+			}
+			if event.Type != ResetEventType {
+				event.Event = &UserEvent{}
+				if err := json.Unmarshal(data, event.Event); err != nil {
+					return fmt.Errorf("failed to decode event: %w", err)
+				}
+			}
+			if err := fn(event); err != nil {
+				return err
+			}
+			event, data = WatchEvent{}, nil
+		}
+	}
+	return scanner.Err()
+}
+
+// stream sends the request and calls next for each value of the NDJSON
+// response until the response ends or next fails.
+func (c *Client) stream(ctx context.Context, method, path string, body io.Reader, contentType string, next func(*json.Decoder) error) error {
+	req, err := c.newRequest(ctx, method, path, body, contentType)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", NDJSONContentType)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		return newAPIError(resp.StatusCode, data)
+	}
+
+	dec := json.NewDecoder(resp.Body)
+	for dec.More() {
+		if err := next(dec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Client) do(ctx context.Context, method, path string, header http.Header, body any, expectStatus int, out any) error {
+	var reqBody io.Reader
+	var contentType string
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(data)
+		contentType = "application/json"
+	}
+
+	req, err := c.newRequest(ctx, method, path, reqBody, contentType)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != expectStatus {
+		return newAPIError(resp.StatusCode, data)
+	}
+
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	return nil
+}
+
+func (c *Client) newRequest(ctx context.Context, method, path string, body io.Reader, contentType string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.readYourWrites {
+		req.Header.Set(ReadYourWritesHeader, "true")
+	}
+	if c.token != nil {
+		token, err := c.token(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get bearer token: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req, nil
+}
+
+func newAPIError(statusCode int, data []byte) *APIError {
+	apiErr := &APIError{StatusCode: statusCode, Message: strings.TrimSpace(string(data))}
+	var errBody Error
+	if json.Unmarshal(data, &errBody) == nil && errBody.Error != "" {
+		apiErr.Code = errBody.Code
+		apiErr.Message = errBody.Error
+	}
+	return apiErr
+}
@@ -0,0 +1,246 @@
+package usersapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestClient(t *testing.T) {
+	var created, readYourWrites []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error": "bearer token required"}`))
+			return
+		}
+		readYourWrites = append(readYourWrites, r.Header.Get(ReadYourWritesHeader))
+		switch r.Method {
+		case http.MethodGet:
+			w.Write([]byte(`[{"id": 1, "name": "Alice"}, {"id": 2, "name": "David", "created_by": "spiffe://example.org/writer"}]`))
+		case http.MethodPost:
+			var req CreateUserRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if req.Name == "Mallory" {
+				w.WriteHeader(http.StatusForbidden)
+				w.Write([]byte(`{"error": "caller is not authorized", "code": "permission_denied"}`))
+				return
+			}
+			created = append(created, req.Name)
+			w.Header().Set("ETag", ETag(1))
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprintf(w, `{"id": 3, "name": %q, "version": 1}`, req.Name)
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	client, err := NewClient(server.URL+"/", WithBearerToken(func(context.Context) (string, error) {
+		return "token", nil
+	}))
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+
+	users, err := client.ListUsers(ctx)
+	if err != nil {
+		t.Fatalf("failed to list users: %v", err)
+	}
+	expect := []User{{ID: 1, Name: "Alice"}, {ID: 2, Name: "David", CreatedBy: "spiffe://example.org/writer"}}
+	if !reflect.DeepEqual(users, expect) {
+		t.Fatalf("expected users %+v; got %+v", expect, users)
+	}
+
+	user, err := client.CreateUser(ctx, CreateUserRequest{Name: "Erin"})
+	if err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	if !reflect.DeepEqual(created, []string{"Erin"}) {
+		t.Fatalf("expected Erin to be created; got %v", created)
+	}
+	if expect := (User{ID: 3, Name: "Erin", Version: 1}); !reflect.DeepEqual(user, expect) {
+		t.Fatalf("expected created user %+v; got %+v", expect, user)
+	}
+
+	// Invalid requests are rejected without calling the API
+	if _, err := client.CreateUser(ctx, CreateUserRequest{Name: strings.Repeat("a", MaxNameLength+1)}); err == nil {
+		t.Fatal("expected invalid request to fail")
+	}
+	if len(created) != 1 {
+		t.Fatalf("expected invalid request not to be sent; got %v", created)
+	}
+
+	_, err = client.CreateUser(ctx, CreateUserRequest{Name: "Mallory"})
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("expected an API error; got %v", err)
+	}
+	if apiErr.StatusCode != http.StatusForbidden || apiErr.Code != CodePermissionDenied || apiErr.Message != "caller is not authorized" {
+		t.Fatalf("unexpected API error %+v", apiErr)
+	}
+
+	unauthenticated, err := NewClient(server.URL)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	if _, err := unauthenticated.ListUsers(ctx); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected unauthorized error; got %v", err)
+	}
+
+	readYourWritesClient, err := NewClient(server.URL, WithReadYourWrites(), WithBearerToken(func(context.Context) (string, error) {
+		return "token", nil
+	}))
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	if _, err := readYourWritesClient.ListUsers(ctx); err != nil {
+		t.Fatalf("failed to list users: %v", err)
+	}
+	// Only the client created with WithReadYourWrites sets the header
+	if expect := []string{"", "", "", "true"}; !reflect.DeepEqual(readYourWrites, expect) {
+		t.Fatalf("expected %s headers %q; got %q", ReadYourWritesHeader, expect, readYourWrites)
+	}
+}
+
+func TestClientVersions(t *testing.T) {
+	var ifMatch []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ifMatch = append(ifMatch, r.Header.Get("If-Match"))
+		switch r.Method {
+		case http.MethodGet:
+			if r.URL.Path == UsersPath {
+				if r.URL.Query().Get(IncludeDeletedParam) != "true" {
+					w.Write([]byte(`[]`))
+					return
+				}
+				w.Write([]byte(`[{"id": 1, "name": "Alice", "version": 2, "deleted_at": "2024-01-01T00:00:00Z"}]`))
+				return
+			}
+			w.Header().Set("ETag", ETag(1))
+			w.Write([]byte(`{"id": 1, "name": "Alice", "version": 1}`))
+		case http.MethodPut:
+			if r.Header.Get("If-Match") != ETag(1) {
+				w.WriteHeader(http.StatusPreconditionFailed)
+				w.Write([]byte(`{"error": "user version does not match", "code": "version_mismatch"}`))
+				return
+			}
+			w.Write([]byte(`{"id": 1, "name": "Bob", "version": 2}`))
+		case http.MethodDelete:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	client, err := NewClient(server.URL)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+
+	user, err := client.GetUser(ctx, 1)
+	if err != nil {
+		t.Fatalf("failed to get user: %v", err)
+	}
+	updated, err := client.UpdateUser(ctx, user.ID, user.Version, UpdateUserRequest{Name: "Bob"})
+	if err != nil {
+		t.Fatalf("failed to update user: %v", err)
+	}
+	if updated.Name != "Bob" || updated.Version != 2 {
+		t.Fatalf("expected Bob at version 2; got %+v", updated)
+	}
+
+	// Changing a user with a stale version fails
+	_, err = client.UpdateUser(ctx, user.ID, user.Version+1, UpdateUserRequest{Name: "Carol"})
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusPreconditionFailed || apiErr.Code != CodeVersionMismatch {
+		t.Fatalf("expected precondition failed error; got %v", err)
+	}
+
+	if err := client.DeleteUser(ctx, user.ID, 0); err != nil {
+		t.Fatalf("failed to delete user: %v", err)
+	}
+	if users, err := client.ListUsers(ctx); err != nil || len(users) != 0 {
+		t.Fatalf("expected no users; got %+v, %v", users, err)
+	}
+	users, err := client.ListUsers(ctx, IncludeDeleted())
+	if err != nil {
+		t.Fatalf("failed to list users: %v", err)
+	}
+	if len(users) != 1 || users[0].DeletedAt == nil {
+		t.Fatalf("expected the deleted user to be listed; got %+v", users)
+	}
+
+	// Only writes with a version are conditional
+	if expect := []string{"", `"1"`, `"2"`, "", "", ""}; !reflect.DeepEqual(ifMatch, expect) {
+		t.Fatalf("expected If-Match headers %q; got %q", expect, ifMatch)
+	}
+}
+
+func TestClientBulk(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case BatchCreatePath:
+			if ct := r.Header.Get("Content-Type"); ct != NDJSONContentType {
+				w.WriteHeader(http.StatusUnsupportedMediaType)
+				return
+			}
+			w.Header().Set("Content-Type", NDJSONContentType)
+			dec := json.NewDecoder(r.Body)
+			enc := json.NewEncoder(w)
+			for row := 1; dec.More(); row++ {
+				var req CreateUserRequest
+				if err := dec.Decode(&req); err != nil {
+					return
+				}
+				if err := req.Validate(); err != nil {
+					enc.Encode(BatchCreateResult{Row: row, Error: err.Error()})
+					continue
+				}
+				enc.Encode(BatchCreateResult{Row: row, User: &User{ID: row, Name: req.Name}})
+			}
+		case ExportPath:
+			if format := r.URL.Query().Get(FormatParam); format != FormatNDJSON {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error": "unsupported format"}`))
+				return
+			}
+			w.Write([]byte("{\"id\": 1, \"name\": \"Alice\"}\n{\"id\": 2, \"name\": \"Bob\"}\n"))
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	client, err := NewClient(server.URL)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+
+	results, err := client.BatchCreateUsers(ctx, []CreateUserRequest{{Name: "Alice"}, {}})
+	if err != nil {
+		t.Fatalf("failed to batch create users: %v", err)
+	}
+	if len(results) != 2 || results[0].User == nil || results[0].User.Name != "Alice" || results[1].Error == "" {
+		t.Fatalf("expected the first row to be created and the second to fail; got %+v", results)
+	}
+
+	var exported []User
+	err = client.ExportUsers(ctx, func(user User) error {
+		exported = append(exported, user)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to export users: %v", err)
+	}
+	if expect := []User{{ID: 1, Name: "Alice"}, {ID: 2, Name: "Bob"}}; !reflect.DeepEqual(exported, expect) {
+		t.Fatalf("expected users %+v; got %+v", expect, exported)
+	}
+}
@@ -0,0 +1,216 @@
+// Package usersapi describes the sample-service users API: its OpenAPI
+// document, the request and response types, request validation and a typed
+// client.
+package usersapi
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// UsersPath is the path of the users collection
+	UsersPath = "/api/v1/users"
+	// BatchCreatePath is the path users are created in bulk on, from an NDJSON
+	// or CSV body
+	BatchCreatePath = UsersPath + ":batchCreate"
+	// ExportPath is the path all users are streamed from, as NDJSON or CSV
+	ExportPath = UsersPath + ":export"
+	// WatchPath is the path user change events are streamed from, as
+	// server-sent events
+	WatchPath = UsersPath + ":watch"
+	// OpenAPIPath is the path the OpenAPI document is served on
+	OpenAPIPath = "/openapi.json"
+
+	// IncludeDeletedParam, set to "true", makes listing users also return the
+	// soft deleted users
+	IncludeDeletedParam = "include_deleted"
+
+	// ReadYourWritesHeader, set to "true", makes a read observe the caller's
+	// earlier writes by reading from the MySQL primary instead of a replica
+	ReadYourWritesHeader = "X-Read-Your-Writes"
+
+	// NDJSONContentType is the content type of newline-delimited JSON bodies,
+	// with one JSON object per line
+	NDJSONContentType = "application/x-ndjson"
+	// CSVContentType is the content type of CSV bodies, whose first row names
+	// the columns
+	CSVContentType = "text/csv"
+
+	// EventStreamContentType is the content type of server-sent events
+	EventStreamContentType = "text/event-stream"
+	// LastEventIDHeader carries the resume token of the last event a watcher
+	// received, to resume watching right after it
+	LastEventIDHeader = "Last-Event-ID"
+	// ResumeTokenParam is an alternative to LastEventIDHeader, for clients
+	// that can't set headers
+	ResumeTokenParam = "resume_token"
+	// ResetEventType is the type of the event sent first when a watch can't
+	// be resumed from its token: the changes since are lost, and the watcher
+	// must catch up by listing the users
+	ResetEventType = "reset"
+
+	// FormatParam selects the format users are exported in: FormatNDJSON, the
+	// default, or FormatCSV
+	FormatParam  = "format"
+	FormatNDJSON = "ndjson"
+	FormatCSV    = "csv"
+
+	// MaxNameLength is the length of the Users.name varchar column
+	MaxNameLength = 25
+)
+
+// OpenAPISpec is the OpenAPI 3 document describing the API.
+//
+//go:embed openapi.json
+var OpenAPISpec []byte
+
+// User is a user returned by the API.
+type User struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+
+	// CreatedBy is the SPIFFE ID of the authenticated caller that created the
+	// user, if any.
+	CreatedBy string `json:"created_by,omitempty"`
+
+	// Version starts at 1 and is incremented by every update and delete. It's
+	// also returned as the ETag of the user.
+	Version   int64     `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// DeletedAt is when the user was soft deleted, if it was.
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+// UserPath returns the path of the user with the ID.
+func UserPath(id int) string {
+	return UsersPath + "/" + strconv.Itoa(id)
+}
+
+// ETag returns the entity tag of a user with the version.
+func ETag(version int64) string {
+	return strconv.Quote(strconv.FormatInt(version, 10))
+}
+
+// ParseETag returns the version of a user's entity tag, or false if etag isn't
+// one.
+func ParseETag(etag string) (int64, bool) {
+	if len(etag) < 2 || etag[0] != '"' || etag[len(etag)-1] != '"' {
+		return 0, false
+	}
+	version, err := strconv.ParseInt(etag[1:len(etag)-1], 10, 64)
+	if err != nil || version <= 0 {
+		return 0, false
+	}
+	return version, true
+}
+
+// CreateUserRequest is the body of a create user request.
+type CreateUserRequest struct {
+	Name string `json:"name"`
+}
+
+// UpdateUserRequest is the body of an update user request.
+type UpdateUserRequest struct {
+	Name string `json:"name"`
+}
+
+// BatchCreateResult is the outcome of creating one user of a batch create
+// request. The results are streamed as NDJSON, in the order of the rows of the
+// request.
+type BatchCreateResult struct {
+	// Row is the 1-based row of the user in the request body, not counting the
+	// CSV header row
+	Row int `json:"row"`
+	// User is the created user, unless creating it failed
+	User *User `json:"user,omitempty"`
+	// Error is why creating the user failed, if it did
+	Error string `json:"error,omitempty"`
+	// Code identifies the error, if creating the user failed
+	Code string `json:"code,omitempty"`
+}
+
+// UserEvent is a change to a user, streamed by the watch endpoint.
+type UserEvent struct {
+	ID int64 `json:"id"`
+	// IdempotencyKey is unique to the change, e.g. to drop the events already
+	// received from another source
+	IdempotencyKey string `json:"idempotency_key"`
+	// Type is user.created, user.updated or user.deleted
+	Type string `json:"type"`
+	// User is the user as of the change
+	User User      `json:"user"`
+	Time time.Time `json:"time"`
+}
+
+// WatchEvent is an event of the watch stream.
+type WatchEvent struct {
+	// Token resumes watching right after the event
+	Token string
+	// Type is the type of the user event, or ResetEventType
+	Type string
+	// Event is the user event, unless Type is ResetEventType
+	Event *UserEvent
+}
+
+// Error is the body of an error response.
+type Error struct {
+	// Error describes the error, for humans
+	Error string `json:"error"`
+	// Code identifies the error, for programs, e.g. CodeDBSVIDExpired
+	Code string `json:"code"`
+}
+
+// The codes of error responses. They are stable, unlike the error messages.
+const (
+	CodeInvalidArgument      = "invalid_argument"
+	CodeNotFound             = "not_found"
+	CodeMethodNotAllowed     = "method_not_allowed"
+	CodeVersionMismatch      = "version_mismatch"
+	CodeUnsupportedMediaType = "unsupported_media_type"
+	CodeUnauthenticated      = "unauthenticated"
+	CodePermissionDenied     = "permission_denied"
+	CodeNotImplemented       = "not_implemented"
+	// CodeResumeTokenExpired is the code of the reset watch event
+	CodeResumeTokenExpired = "resume_token_expired"
+	// CodeUnavailable is returned while the store fails fast after
+	// consecutive MySQL connection failures
+	CodeUnavailable = "unavailable"
+	CodeOverloaded  = "overloaded"
+	CodeTimeout     = "timeout"
+	CodeInternal    = "internal"
+
+	// The codes of failures to connect to MySQL, which sample-service only
+	// logs the details of
+	CodeDBTLSVerification  = "db_tls_verification_failed"
+	CodeDBServerIDMismatch = "db_server_id_mismatch"
+	CodeDBSVIDExpired      = "db_svid_expired"
+	CodeDBAccessDenied     = "db_access_denied"
+	CodeDBUnreachable      = "db_unreachable"
+)
+
+// Validate checks the request against the CreateUserRequest schema.
+func (r CreateUserRequest) Validate() error {
+	return ValidateName(r.Name)
+}
+
+// Validate checks the request against the UpdateUserRequest schema.
+func (r UpdateUserRequest) Validate() error {
+	return ValidateName(r.Name)
+}
+
+// ValidateName checks that name fits the Users.name column.
+func ValidateName(name string) error {
+	switch n := utf8.RuneCountInString(name); {
+	case n == 0:
+		return errors.New("name must not be empty")
+	case n > MaxNameLength:
+		return fmt.Errorf("name must be at most %d characters; got %d", MaxNameLength, n)
+	}
+	return nil
+}
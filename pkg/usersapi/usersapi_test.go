@@ -0,0 +1,104 @@
+package usersapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestOpenAPISpec(t *testing.T) {
+	var spec struct {
+		OpenAPI    string                     `json:"openapi"`
+		Paths      map[string]json.RawMessage `json:"paths"`
+		Components struct {
+			Schemas map[string]struct {
+				Properties map[string]struct {
+					MaxLength int `json:"maxLength"`
+				} `json:"properties"`
+				Enum []string `json:"enum"`
+			} `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(OpenAPISpec, &spec); err != nil {
+		t.Fatalf("failed to parse OpenAPI document: %v", err)
+	}
+
+	if !strings.HasPrefix(spec.OpenAPI, "3.") {
+		t.Fatalf("expected an OpenAPI 3 document; got version %q", spec.OpenAPI)
+	}
+	for _, path := range []string{UsersPath, UsersPath + "/{id}", BatchCreatePath, ExportPath, WatchPath, OpenAPIPath} {
+		if _, ok := spec.Paths[path]; !ok {
+			t.Fatalf("expected path %s to be documented", path)
+		}
+	}
+
+	// Validation and the Users table must agree with the document
+	for _, schema := range []string{"User", "CreateUserRequest", "UpdateUserRequest"} {
+		if maxLength := spec.Components.Schemas[schema].Properties["name"].MaxLength; maxLength != MaxNameLength {
+			t.Fatalf("expected %s.name maxLength %d; got %d", schema, MaxNameLength, maxLength)
+		}
+	}
+	codes := []string{
+		CodeInvalidArgument, CodeNotFound, CodeMethodNotAllowed, CodeVersionMismatch, CodeUnsupportedMediaType,
+		CodeUnauthenticated, CodePermissionDenied, CodeNotImplemented, CodeResumeTokenExpired, CodeUnavailable,
+		CodeOverloaded, CodeTimeout, CodeInternal, CodeDBTLSVerification, CodeDBServerIDMismatch, CodeDBSVIDExpired,
+		CodeDBAccessDenied, CodeDBUnreachable,
+	}
+	if enum := spec.Components.Schemas["ErrorCode"].Enum; !reflect.DeepEqual(enum, codes) {
+		t.Fatalf("expected ErrorCode enum %q; got %q", codes, enum)
+	}
+	table, err := os.ReadFile("../store/schema/00001_create_users_table.sql")
+	if err != nil {
+		t.Fatalf("failed to read Users table schema: %v", err)
+	}
+	if column := fmt.Sprintf("name varchar(%d)", MaxNameLength); !strings.Contains(string(table), column) {
+		t.Fatalf("expected Users table to have column %q", column)
+	}
+}
+
+func TestValidateName(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		value     string
+		expectErr string
+	}{
+		{name: "valid", value: "David"},
+		{name: "max length", value: strings.Repeat("a", MaxNameLength)},
+		{name: "max length in characters", value: strings.Repeat("é", MaxNameLength)},
+		{name: "empty", expectErr: "name must not be empty"},
+		{name: "too long", value: strings.Repeat("a", MaxNameLength+1), expectErr: "name must be at most 25 characters; got 26"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CreateUserRequest{Name: tt.value}.Validate()
+			switch {
+			case tt.expectErr == "" && err != nil:
+				t.Fatalf("expected no error; got %v", err)
+			case tt.expectErr != "" && (err == nil || err.Error() != tt.expectErr):
+				t.Fatalf("expected error %q; got %v", tt.expectErr, err)
+			}
+		})
+	}
+}
+
+func TestParseETag(t *testing.T) {
+	for _, tt := range []struct {
+		etag          string
+		expectVersion int64
+		expectOK      bool
+	}{
+		{etag: ETag(7), expectVersion: 7, expectOK: true},
+		{etag: `"1"`, expectVersion: 1, expectOK: true},
+		{etag: `W/"1"`},
+		{etag: "1"},
+		{etag: `"0"`},
+		{etag: `"David"`},
+		{etag: `"`},
+	} {
+		if version, ok := ParseETag(tt.etag); version != tt.expectVersion || ok != tt.expectOK {
+			t.Fatalf("expected %s to parse as %d, %t; got %d, %t", tt.etag, tt.expectVersion, tt.expectOK, version, ok)
+		}
+	}
+}
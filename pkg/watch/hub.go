@@ -0,0 +1,213 @@
+// Package watch fans the user change events committed by the store out to
+// watchers, e.g. the clients of a server-sent events stream. Each event is
+// given a resume token, with which a watcher that disconnected resumes right
+// after the last event it received, as long as the event is still buffered.
+//
+// The hub is fed by the store's event hook, so it only sees the changes
+// committed through this process, not those of other processes writing to the
+// same DB.
+package watch
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rturner3/spire-mysql-demo/pkg/store"
+)
+
+const (
+	// DefaultBufferSize is the number of recent events kept for watchers to
+	// resume from by default
+	DefaultBufferSize = 1024
+
+	// subscriberQueue is the number of events queued for a watcher on top of
+	// those it resumed from, before it's considered too slow and dropped
+	subscriberQueue = 256
+)
+
+// Event is a change event with the token to resume watching after it.
+type Event struct {
+	Token string
+	store.Event
+}
+
+// Hub buffers the recent events and sends new events to its subscriptions.
+type Hub struct {
+	// epoch tells the tokens of this hub from those of a previous process,
+	// whose sequence numbers are unrelated
+	epoch string
+
+	mu     sync.Mutex
+	seq    uint64
+	buffer []Event
+	size   int
+	// versions is the version of the last event sent for each user with an
+	// event in the buffer
+	versions map[int]int64
+	subs     map[*Subscription]struct{}
+	closed   bool
+}
+
+// NewHub returns a hub keeping the last size events to resume from.
+func NewHub(size int) *Hub {
+	if size <= 0 {
+		size = DefaultBufferSize
+	}
+	return &Hub{
+		epoch:    strconv.FormatInt(time.Now().UnixNano(), 36),
+		size:     size,
+		versions: make(map[int]int64),
+		subs:     make(map[*Subscription]struct{}),
+	}
+}
+
+// Notify sends the events to the subscriptions, in order. It doesn't block:
+// a subscription that can't keep up is closed, and its watcher must resume.
+// It has the signature of the store's event hook.
+//
+// The store notifies the events of concurrent transactions once they
+// committed, which may be out of commit order. An event older than one sent
+// for the same user that's still buffered is dropped, so that watchers don't
+// see a user go back to a previous version.
+func (h *Hub) Notify(events []store.Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, event := range events {
+		if version, ok := h.versions[event.User.ID]; ok && event.User.Version < version {
+			continue
+		}
+		h.versions[event.User.ID] = event.User.Version
+
+		h.seq++
+		e := Event{Token: h.token(h.seq), Event: event}
+		h.buffer = append(h.buffer, e)
+		if len(h.buffer) > h.size {
+			evicted := h.buffer[0]
+			if h.versions[evicted.User.ID] == evicted.User.Version {
+				delete(h.versions, evicted.User.ID)
+			}
+			h.buffer = h.buffer[1:]
+		}
+
+		for sub := range h.subs {
+			select {
+			case sub.events <- e:
+			default:
+				sub.lagged = true
+				h.closeLocked(sub)
+			}
+		}
+	}
+}
+
+func (h *Hub) token(seq uint64) string {
+	return h.epoch + "-" + strconv.FormatUint(seq, 10)
+}
+
+// parseToken returns the sequence number of a token of this hub.
+func (h *Hub) parseToken(token string) (uint64, error) {
+	epoch, seq, ok := strings.Cut(token, "-")
+	if !ok || epoch != h.epoch {
+		return 0, fmt.Errorf("unknown resume token %q", token)
+	}
+	return strconv.ParseUint(seq, 10, 64)
+}
+
+// Subscribe returns a subscription to the events after the one with the
+// resume token, or to new events if the token is empty. It returns false if
+// the token can't be resumed from, because it's unknown or the events after
+// it are no longer buffered: the subscription then starts with new events,
+// and the watcher must catch up another way, e.g. by listing all users.
+func (h *Hub) Subscribe(token string) (*Subscription, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var backlog []Event
+	resumed := true
+	if token != "" {
+		seq, err := h.parseToken(token)
+		// The buffer holds the events up to h.seq, starting with oldest
+		oldest := h.seq - uint64(len(h.buffer)) + 1
+		switch {
+		case err != nil || seq > h.seq || seq+1 < oldest:
+			resumed = false
+		default:
+			backlog = h.buffer[seq+1-oldest:]
+		}
+	}
+
+	sub := &Subscription{
+		hub:    h,
+		events: make(chan Event, len(backlog)+subscriberQueue),
+	}
+	for _, e := range backlog {
+		sub.events <- e
+	}
+	if h.closed {
+		close(sub.events)
+		return sub, resumed
+	}
+	h.subs[sub] = struct{}{}
+	return sub, resumed
+}
+
+// Close closes the subscriptions, and those made afterwards once they
+// received their backlog, e.g. so that watch streams don't hold up a graceful
+// shutdown.
+func (h *Hub) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for sub := range h.subs {
+		h.closeLocked(sub)
+	}
+	return nil
+}
+
+func (h *Hub) closeLocked(sub *Subscription) {
+	if _, ok := h.subs[sub]; !ok {
+		return
+	}
+	delete(h.subs, sub)
+	close(sub.events)
+}
+
+// Subscription receives the events of a hub.
+type Subscription struct {
+	hub    *Hub
+	events chan Event
+	// lagged is set, before events is closed, if the subscription was closed
+	// because it couldn't keep up
+	lagged bool
+}
+
+// Events returns the channel the events are sent on. It's closed when the
+// subscription is closed.
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+// Lagged reports whether the subscription was closed because its watcher
+// didn't keep up with the events. It's only set once Events is closed.
+func (s *Subscription) Lagged() bool {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	return s.lagged
+}
+
+// Close stops sending events to the subscription.
+func (s *Subscription) Close() {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	s.hub.closeLocked(s)
+}
+
+// Watchers returns the number of open subscriptions.
+func (h *Hub) Watchers() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subs)
+}
@@ -0,0 +1,155 @@
+package watch
+
+import (
+	"testing"
+
+	"github.com/rturner3/spire-mysql-demo/pkg/store"
+)
+
+func events(ids ...int64) []store.Event {
+	events := make([]store.Event, len(ids))
+	for i, id := range ids {
+		events[i] = store.Event{ID: id, Type: store.EventUserCreated}
+	}
+	return events
+}
+
+// receive returns the events queued for the subscription.
+func receive(sub *Subscription) []Event {
+	var received []Event
+	for {
+		select {
+		case e, ok := <-sub.Events():
+			if !ok {
+				return received
+			}
+			received = append(received, e)
+		default:
+			return received
+		}
+	}
+}
+
+func ids(events []Event) []int64 {
+	ids := make([]int64, len(events))
+	for i, e := range events {
+		ids[i] = e.ID
+	}
+	return ids
+}
+
+func TestHubResume(t *testing.T) {
+	hub := NewHub(3)
+	sub, resumed := hub.Subscribe("")
+	if !resumed {
+		t.Fatalf("expected a watch from now on to be resumed")
+	}
+	defer sub.Close()
+
+	hub.Notify(events(1, 2))
+	hub.Notify(events(3, 4))
+	received := receive(sub)
+	if got := ids(received); len(got) != 4 || got[0] != 1 || got[3] != 4 {
+		t.Fatalf("expected events 1 to 4; got %v", got)
+	}
+
+	for _, tt := range []struct {
+		name          string
+		token         string
+		expectResumed bool
+		expectIDs     []int64
+	}{
+		{name: "last event", token: received[3].Token, expectResumed: true},
+		{name: "buffered event", token: received[1].Token, expectResumed: true, expectIDs: []int64{3, 4}},
+		{name: "oldest buffered event", token: received[0].Token, expectResumed: true, expectIDs: []int64{2, 3, 4}},
+		{name: "expired event", token: hub.token(0), expectResumed: false},
+		{name: "future event", token: hub.token(5), expectResumed: false},
+		{name: "other epoch", token: "epoch-1", expectResumed: false},
+		{name: "malformed", token: "malformed", expectResumed: false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			sub, resumed := hub.Subscribe(tt.token)
+			defer sub.Close()
+			if resumed != tt.expectResumed {
+				t.Fatalf("expected resumed %t; got %t", tt.expectResumed, resumed)
+			}
+			if got := ids(receive(sub)); len(got) != len(tt.expectIDs) || (len(got) > 0 && got[0] != tt.expectIDs[0]) {
+				t.Fatalf("expected events %v; got %v", tt.expectIDs, got)
+			}
+		})
+	}
+}
+
+func TestHubClosesLaggingSubscriptions(t *testing.T) {
+	hub := NewHub(0)
+	lagging, _ := hub.Subscribe("")
+	defer lagging.Close()
+	keeping, _ := hub.Subscribe("")
+	defer keeping.Close()
+
+	var received []Event
+	for id := int64(1); id <= subscriberQueue+1; id++ {
+		hub.Notify(events(id))
+		received = append(received, receive(keeping)...)
+	}
+	if len(received) != subscriberQueue+1 {
+		t.Fatalf("expected the subscription keeping up to receive %d events; got %d", subscriberQueue+1, len(received))
+	}
+
+	if got := len(receive(lagging)); got != subscriberQueue {
+		t.Fatalf("expected the lagging subscription to receive %d events; got %d", subscriberQueue, got)
+	}
+	if _, ok := <-lagging.Events(); ok || !lagging.Lagged() {
+		t.Fatalf("expected the lagging subscription to be closed")
+	}
+	if keeping.Lagged() {
+		t.Fatalf("expected the subscription keeping up not to be lagging")
+	}
+	if watchers := hub.Watchers(); watchers != 1 {
+		t.Fatalf("expected 1 watcher; got %d", watchers)
+	}
+}
+
+func TestHubClose(t *testing.T) {
+	hub := NewHub(0)
+	open, _ := hub.Subscribe("")
+	hub.Notify(events(1))
+	hub.Close()
+
+	if got := ids(receive(open)); len(got) != 1 {
+		t.Fatalf("expected the open subscription to receive event 1; got %v", got)
+	}
+	if _, ok := <-open.Events(); ok || open.Lagged() {
+		t.Fatalf("expected the open subscription to be closed without lagging")
+	}
+
+	resumed, _ := hub.Subscribe(hub.token(0))
+	if got := ids(receive(resumed)); len(got) != 1 {
+		t.Fatalf("expected a subscription made after closing to receive its backlog; got %v", got)
+	}
+	if _, ok := <-resumed.Events(); ok {
+		t.Fatalf("expected a subscription made after closing to be closed")
+	}
+	if watchers := hub.Watchers(); watchers != 0 {
+		t.Fatalf("expected no watchers; got %d", watchers)
+	}
+}
+
+func TestHubDropsStaleEvents(t *testing.T) {
+	hub := NewHub(0)
+	sub, _ := hub.Subscribe("")
+	defer sub.Close()
+
+	userEvent := func(id int64, userID int, version int64) store.Event {
+		return store.Event{ID: id, Type: store.EventUserUpdated, User: store.User{ID: userID, Version: version}}
+	}
+	// The transaction that made version 3 of user 1 was notified before the
+	// one that made version 2
+	hub.Notify([]store.Event{userEvent(1, 1, 1)})
+	hub.Notify([]store.Event{userEvent(3, 1, 3)})
+	hub.Notify([]store.Event{userEvent(2, 1, 2), userEvent(4, 2, 1)})
+
+	if got := ids(receive(sub)); len(got) != 3 || got[0] != 1 || got[1] != 3 || got[2] != 4 {
+		t.Fatalf("expected events 1, 3 and 4; got %v", got)
+	}
+}
@@ -0,0 +1,5 @@
+// Package usersv1 contains the UsersService protobuf messages and gRPC
+// service generated from users.proto.
+package usersv1
+
+//go:generate protoc -I ../.. --go_out=../.. --go_opt=paths=source_relative --go-grpc_out=../.. --go-grpc_opt=paths=source_relative users/v1/users.proto
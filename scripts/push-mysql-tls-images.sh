@@ -3,8 +3,5 @@
 
 username=$(docker info | sed '/Username:/!d;s/.* //')
 
-docker build --tag "${username}/spire-mysql-tls-bootstrap:latest" -f Dockerfile.tlsbootstrap .
-docker push "${username}/spire-mysql-tls-bootstrap:latest"
-
-docker build --tag "${username}/spire-mysql-tls-reload:latest" -f Dockerfile.tlsreload .
-docker push "${username}/spire-mysql-tls-reload:latest"
+docker build --tag "${username}/spire-mysql-helper:latest" -f Dockerfile.mysqlhelper .
+docker push "${username}/spire-mysql-helper:latest"
@@ -0,0 +1,563 @@
+//go:build integration
+
+// Package integration runs the spire-mysql-helper and sample-service commands
+// end to end against a local mysqld, with X.509-SVIDs served by a
+// fake Workload API instead of a SPIRE agent, so that no Kubernetes cluster
+// is needed.
+//
+// The suite requires a mysqld binary (MySQL 8), taken from $MYSQLD or PATH:
+//
+//	go test -tags integration ./test/integration/...
+package integration
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/rturner3/spire-mysql-demo/pkg/test/fakeworkloadapi"
+	"github.com/rturner3/spire-mysql-demo/pkg/usersapi"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+)
+
+const (
+	waitTimeout  = 30 * time.Second
+	pollInterval = 100 * time.Millisecond
+
+	// MySQL error returned when REQUIRE SUBJECT doesn't match the client certificate
+	errAccessDenied = 1045
+)
+
+var (
+	td = spiffeid.RequireTrustDomainFromString("example.org")
+
+	mysqlServerIdentity = fakeworkloadapi.Identity{
+		ID:       spiffeid.RequireFromPath(td, "/mysql/server"),
+		Hint:     "mysql-server",
+		DNSNames: []string{"localhost"},
+	}
+	tlsReloaderIdentity = fakeworkloadapi.Identity{
+		ID:      spiffeid.RequireFromPath(td, "/mysql/client/tls-reloader"),
+		Hint:    "mysql-client",
+		Subject: mysqlSubject("tls-reloader"),
+	}
+	sampleServiceIdentity = fakeworkloadapi.Identity{
+		ID:      spiffeid.RequireFromPath(td, "/mysql/client/spire-mysql-client"),
+		Hint:    "mysql-client",
+		Subject: mysqlSubject("spire-mysql-client"),
+	}
+)
+
+func TestEndToEnd(t *testing.T) {
+	mysqld := findMySQLD(t)
+	bins := buildCommands(t)
+
+	// The MySQL pod and sample-service have separate Workload API sockets, as
+	// they would on separate SPIRE agent selectors, backed by the same CA.
+	ca := fakeworkloadapi.NewCA(t, td)
+	mysqlPodAPI := fakeworkloadapi.New(t, ca, mysqlServerIdentity, tlsReloaderIdentity)
+	sampleServiceAPI := fakeworkloadapi.New(t, ca, sampleServiceIdentity)
+
+	certDir := shortTempDir(t)
+	runCommand(t, "bootstrap", filepath.Join(bins, "spire-mysql-helper"),
+		"SPIFFE_ENDPOINT_SOCKET="+mysqlPodAPI.Addr(),
+		"SPIRE_SVID_DIR="+certDir,
+		"bootstrap",
+	)
+
+	server := startMySQL(t, mysqld, certDir)
+	server.applySQLFiles(t, "../../pkg/store/init/*.sql")
+	server.applySQLFiles(t, "../../pkg/store/schema/*.sql")
+
+	startCommand(t, "reload", filepath.Join(bins, "spire-mysql-helper"),
+		"SPIFFE_ENDPOINT_SOCKET="+mysqlPodAPI.Addr(),
+		"SPIRE_SVID_DIR="+certDir,
+		"MYSQL_ADDR="+server.addr,
+		"reload",
+	)
+
+	apiAddr := freeAddr(t)
+	eventsFile := filepath.Join(t.TempDir(), "events.ndjson")
+	startCommand(t, "sample-service", filepath.Join(bins, "sample-service"),
+		"SPIFFE_ENDPOINT_SOCKET="+sampleServiceAPI.Addr(),
+		"MYSQL_ADDR="+server.addr,
+		"LISTEN_ADDR="+apiAddr,
+		"EVENTS_SINK=file://"+eventsFile,
+	)
+	api, err := usersapi.NewClient("http://" + apiAddr)
+	if err != nil {
+		t.Fatalf("failed to create users API client: %v", err)
+	}
+
+	t.Run("mTLS login with REQUIRE SUBJECT", func(t *testing.T) {
+		bundle := ca.X509Bundle()
+		clientSVID := sampleServiceAPI.X509SVID("mysql-client")
+		if _, err := server.connect(t, "spire-mysql-client", clientSVID, bundle); err != nil {
+			t.Fatalf("expected login with matching subject to succeed: %v", err)
+		}
+
+		// The reloader's SVID is valid, but its subject doesn't match the user
+		reloaderSVID := mysqlPodAPI.X509SVID("mysql-client")
+		_, err := server.connect(t, "spire-mysql-client", reloaderSVID, bundle)
+		var mysqlErr *mysql.MySQLError
+		if !errors.As(err, &mysqlErr) || mysqlErr.Number != errAccessDenied {
+			t.Fatalf("expected access denied for mismatched subject; got %v", err)
+		}
+	})
+
+	t.Run("users API", func(t *testing.T) {
+		waitFor(t, "sample-service to list users", func() error {
+			users, err := api.ListUsers(context.Background())
+			if err != nil {
+				return err
+			}
+			return expectNames(users, "Alice", "Bob", "Carol")
+		})
+
+		if _, err := api.CreateUser(context.Background(), usersapi.CreateUserRequest{Name: "David"}); err != nil {
+			t.Fatalf("failed to create user: %v", err)
+		}
+
+		users, err := api.ListUsers(context.Background())
+		if err != nil {
+			t.Fatalf("failed to list users: %v", err)
+		}
+		if err := expectNames(users, "Alice", "Bob", "Carol", "David"); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("versioned updates and soft delete", func(t *testing.T) {
+		ctx := context.Background()
+		erin, err := api.CreateUser(ctx, usersapi.CreateUserRequest{Name: "Erin"})
+		if err != nil {
+			t.Fatalf("failed to create user: %v", err)
+		}
+		if erin.Name != "Erin" || erin.Version != 1 {
+			t.Fatalf("expected Erin at version 1; got %+v", erin)
+		}
+
+		updated, err := api.UpdateUser(ctx, erin.ID, erin.Version, usersapi.UpdateUserRequest{Name: "Erin B"})
+		if err != nil {
+			t.Fatalf("failed to update user: %v", err)
+		}
+		if updated.Version != 2 || !updated.UpdatedAt.After(erin.UpdatedAt) {
+			t.Fatalf("expected the update to bump the version and update time; got %+v", updated)
+		}
+		var apiErr *usersapi.APIError
+		if err := api.DeleteUser(ctx, erin.ID, erin.Version); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusPreconditionFailed || apiErr.Code != usersapi.CodeVersionMismatch {
+			t.Fatalf("expected deleting with a stale version to fail; got %v", err)
+		}
+		if err := api.DeleteUser(ctx, erin.ID, updated.Version); err != nil {
+			t.Fatalf("failed to delete user: %v", err)
+		}
+
+		if _, err := api.GetUser(ctx, erin.ID); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound {
+			t.Fatalf("expected the deleted user not to be found; got %v", err)
+		}
+		users, err := api.ListUsers(ctx, usersapi.IncludeDeleted())
+		if err != nil {
+			t.Fatalf("failed to list users: %v", err)
+		}
+		if err := expectNames(users, "Alice", "Bob", "Carol", "David", "Erin B"); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("user events", func(t *testing.T) {
+		// Every change so far is relayed from the outbox to the events file
+		waitFor(t, "user events to be relayed", func() error {
+			data, err := os.ReadFile(eventsFile)
+			if err != nil {
+				return err
+			}
+			var types []string
+			for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+				var event struct {
+					IdempotencyKey string `json:"idempotency_key"`
+					Type           string `json:"type"`
+				}
+				if err := json.Unmarshal([]byte(line), &event); err != nil {
+					return fmt.Errorf("malformed event %q: %w", line, err)
+				}
+				if event.IdempotencyKey == "" {
+					return fmt.Errorf("event %q has no idempotency key", line)
+				}
+				types = append(types, event.Type)
+			}
+			if expect := "user.created,user.created,user.updated,user.deleted"; strings.Join(types, ",") != expect {
+				return fmt.Errorf("expected events %s; got %s", expect, strings.Join(types, ","))
+			}
+			return nil
+		})
+	})
+
+	t.Run("watch users", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+
+		// Only changes committed once the watch started are streamed to it,
+		// which can't be told from outside, so a "Frank" is created on each
+		// retry until the watch sees one
+		errWatched := errors.New("watched")
+		watched := make(chan error, 1)
+		go func() {
+			watched <- api.WatchUsers(ctx, "", func(event usersapi.WatchEvent) error {
+				if event.Type == "user.created" && event.Event.User.Name == "Frank" {
+					return errWatched
+				}
+				return nil
+			})
+		}()
+		waitFor(t, "the watch to receive the created user", func() error {
+			if _, err := api.CreateUser(ctx, usersapi.CreateUserRequest{Name: "Frank"}); err != nil {
+				return err
+			}
+			select {
+			case err := <-watched:
+				if !errors.Is(err, errWatched) {
+					t.Fatalf("expected the watch to receive the created user; got %v", err)
+				}
+				return nil
+			case <-time.After(5 * time.Second):
+				return errors.New("no event received")
+			}
+		})
+
+		// The retries may have created several "Frank" users, so clean up all
+		// of them for the subtests listing users afterwards
+		users, err := api.ListUsers(ctx)
+		if err != nil {
+			t.Fatalf("failed to list users: %v", err)
+		}
+		for _, user := range users {
+			if user.Name != "Frank" {
+				continue
+			}
+			if err := api.DeleteUser(ctx, user.ID, 0); err != nil {
+				t.Fatalf("failed to delete user: %v", err)
+			}
+		}
+	})
+
+	t.Run("forced rotation", func(t *testing.T) {
+		mysqlPodAPI.Rotate()
+		rotated := mysqlPodAPI.X509SVID("mysql-server")
+
+		// The reloader writes the rotated SVID to disk and runs
+		// ALTER INSTANCE RELOAD TLS, after which new connections are served
+		// with the rotated certificate.
+		clientSVID := sampleServiceAPI.X509SVID("mysql-client")
+		waitFor(t, "MySQL to serve the rotated certificate", func() error {
+			serverCert, err := server.connect(t, "spire-mysql-client", clientSVID, ca.X509Bundle())
+			if err != nil {
+				return err
+			}
+			if !serverCert.Equal(rotated.Certificates[0]) {
+				return fmt.Errorf("server certificate serial %s is not the rotated serial %s", serverCert.SerialNumber, rotated.Certificates[0].SerialNumber)
+			}
+			return nil
+		})
+
+		// sample-service swaps its DB pool to the rotated client SVID and
+		// keeps serving requests
+		sampleServiceAPI.Rotate()
+		waitFor(t, "sample-service to list users after rotation", func() error {
+			users, err := api.ListUsers(context.Background())
+			if err != nil {
+				return err
+			}
+			return expectNames(users, "Alice", "Bob", "Carol", "David")
+		})
+	})
+}
+
+// mysqlServer is a mysqld process listening on a local TCP port and Unix socket.
+type mysqlServer struct {
+	addr   string
+	socket string
+	root   *sql.DB
+}
+
+// startMySQL initializes a data directory and starts mysqld with the SVID
+// files in certDir as its TLS configuration, mirroring mysql-config.yaml.
+func startMySQL(t *testing.T, mysqld, certDir string) *mysqlServer {
+	dataDir := filepath.Join(shortTempDir(t), "data")
+	runDir := shortTempDir(t)
+
+	var userArgs []string
+	if os.Geteuid() == 0 {
+		// mysqld refuses to run as root unless asked to explicitly
+		userArgs = []string{"--user=root"}
+	}
+
+	initArgs := append([]string{"--no-defaults", "--initialize-insecure", "--datadir=" + dataDir}, userArgs...)
+	runCommand(t, "mysqld --initialize", mysqld, initArgs...)
+
+	addr := freeAddr(t)
+	_, port, _ := net.SplitHostPort(addr)
+	socket := filepath.Join(runDir, "mysqld.sock")
+	args := append([]string{
+		"--no-defaults",
+		"--datadir=" + dataDir,
+		"--socket=" + socket,
+		"--pid-file=" + filepath.Join(runDir, "mysqld.pid"),
+		"--log-error=" + filepath.Join(runDir, "error.log"),
+		"--bind-address=127.0.0.1",
+		"--port=" + port,
+		"--mysqlx=OFF",
+		"--ssl-ca=" + filepath.Join(certDir, "bundle.0.pem"),
+		"--ssl-cert=" + filepath.Join(certDir, "svid.0.pem"),
+		"--ssl-key=" + filepath.Join(certDir, "svid.0.key"),
+		"--require-secure-transport=ON",
+	}, userArgs...)
+	startCommand(t, "mysqld", mysqld, args...)
+
+	// Root logs in without a password over the Unix socket, which MySQL
+	// considers secure transport
+	root, err := sql.Open("mysql", "root@unix("+socket+")/?multiStatements=true")
+	if err != nil {
+		t.Fatalf("failed to open root connection: %v", err)
+	}
+	t.Cleanup(func() { root.Close() })
+	waitFor(t, "mysqld to accept connections", func() error {
+		return root.Ping()
+	})
+
+	return &mysqlServer{
+		addr:   addr,
+		socket: socket,
+		root:   root,
+	}
+}
+
+// applySQLFiles runs the SQL files matching pattern as root, in name order,
+// the same way 03-setup-mysql.sh does.
+func (s *mysqlServer) applySQLFiles(t *testing.T, pattern string) {
+	files, err := filepath.Glob(pattern)
+	if err != nil || len(files) == 0 {
+		t.Fatalf("no SQL files match %s: %v", pattern, err)
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		query, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatalf("failed to read %s: %v", file, err)
+		}
+		if _, err := s.root.Exec(string(query)); err != nil {
+			t.Fatalf("failed to apply %s: %v", file, err)
+		}
+	}
+}
+
+// connect logs in to MySQL over TCP as user with the X.509-SVID as client
+// certificate, verifying that MySQL presents the MySQL server SVID, and
+// returns the certificate MySQL presented.
+func (s *mysqlServer) connect(t *testing.T, user string, svid *x509svid.SVID, bundle *x509bundle.Bundle) (*x509.Certificate, error) {
+	var (
+		mu         sync.Mutex
+		serverCert *x509.Certificate
+	)
+	authorizer := func(id spiffeid.ID, verifiedChains [][]*x509.Certificate) error {
+		if id != mysqlServerIdentity.ID {
+			return fmt.Errorf("unexpected server SPIFFE ID %s", id)
+		}
+		mu.Lock()
+		serverCert = verifiedChains[0][0]
+		mu.Unlock()
+		return nil
+	}
+
+	tlsConfigName := fmt.Sprintf("integration-%d", time.Now().UnixNano())
+	if err := mysql.RegisterTLSConfig(tlsConfigName, tlsconfig.MTLSClientConfig(svid, bundle, authorizer)); err != nil {
+		t.Fatalf("failed to register TLS config: %v", err)
+	}
+	defer mysql.DeregisterTLSConfig(tlsConfigName)
+
+	db, err := sql.Open("mysql", fmt.Sprintf("%s@tcp(%s)/?tls=%s", user, s.addr, tlsConfigName))
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	if err := db.Ping(); err != nil {
+		return nil, err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	return serverCert, nil
+}
+
+// findMySQLD returns the mysqld binary to test against, skipping the test if
+// there is none.
+func findMySQLD(t *testing.T) string {
+	if mysqld := os.Getenv("MYSQLD"); mysqld != "" {
+		return mysqld
+	}
+	mysqld, err := exec.LookPath("mysqld")
+	if err != nil {
+		t.Skip("mysqld not found; set MYSQLD or add it to PATH to run the integration suite")
+	}
+	return mysqld
+}
+
+// buildCommands builds the commands under test and returns the directory
+// containing the binaries.
+func buildCommands(t *testing.T) string {
+	dir := t.TempDir()
+	cmd := exec.Command("go", "build", "-o", dir,
+		"./cmd/mysql/spire-mysql-helper",
+		"./cmd/sample-service",
+	)
+	cmd.Dir = "../.."
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("failed to build commands: %v\n%s", err, out)
+	}
+	return dir
+}
+
+// runCommand runs the command to completion, failing the test if it exits
+// with an error. Arguments of the form KEY=VALUE before any other argument
+// are set as environment variables.
+func runCommand(t *testing.T, name, path string, args ...string) {
+	cmd, output := newCommand(name, path, args...)
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("%s failed: %v\n%s", name, err, output)
+	}
+}
+
+// startCommand starts the command in the background and stops it when the
+// test finishes. Its output is logged if the test fails.
+func startCommand(t *testing.T, name, path string, args ...string) {
+	cmd, output := newCommand(name, path, args...)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("failed to start %s: %v", name, err)
+	}
+
+	t.Cleanup(func() {
+		_ = cmd.Process.Signal(syscall.SIGTERM)
+		done := make(chan struct{})
+		go func() {
+			_ = cmd.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			_ = cmd.Process.Kill()
+			<-done
+		}
+		if t.Failed() {
+			t.Logf("%s output:\n%s", name, output)
+		}
+	})
+}
+
+func newCommand(name, path string, args ...string) (*exec.Cmd, *syncBuffer) {
+	env := os.Environ()
+	for len(args) > 0 && strings.Contains(args[0], "=") && !strings.HasPrefix(args[0], "-") {
+		env = append(env, args[0])
+		args = args[1:]
+	}
+
+	output := new(syncBuffer)
+	cmd := exec.Command(path, args...)
+	cmd.Env = env
+	cmd.Stdout = output
+	cmd.Stderr = output
+	return cmd, output
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent writes by a process and
+// reads by the test.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func expectNames(users []usersapi.User, names ...string) error {
+	var actual []string
+	for _, u := range users {
+		actual = append(actual, u.Name)
+	}
+	if strings.Join(actual, ",") != strings.Join(names, ",") {
+		return fmt.Errorf("expected users %q; got %q", names, actual)
+	}
+	return nil
+}
+
+// waitFor polls condition until it succeeds, failing the test after a timeout.
+func waitFor(t *testing.T, what string, condition func() error) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), waitTimeout)
+	defer cancel()
+
+	for {
+		err := condition()
+		if err == nil {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatalf("timed out waiting for %s: %v", what, err)
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// freeAddr returns a local TCP address that is free to listen on.
+func freeAddr(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to find a free port: %v", err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+// shortTempDir returns a temporary directory with a path short enough to hold
+// Unix sockets, which a test's TempDir can exceed.
+func shortTempDir(t *testing.T) string {
+	dir, err := os.MkdirTemp("", "it")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func mysqlSubject(commonName string) pkix.Name {
+	return pkix.Name{Country: []string{"US"}, Organization: []string{"SPIRE"}, CommonName: commonName}
+}